@@ -4,10 +4,15 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	metricsclient "k8s.io/metrics/pkg/client/clientset/versioned"
 	"github.com/xanzy/go-gitlab"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
+	"net/http"
 
 	"bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/protocol/grpc"
 	"bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/service/v1"
@@ -18,6 +23,12 @@ type Config struct {
 	GRPCPort string
 	GitlabToken string
 	GitlabURL string
+	HashScheme string
+	IngressController string
+	TraefikVersion string
+	OAuth2ProxyImage string
+	MetricsPort string
+	InstanceLabel string
 }
 
 // RunServer runs gRPC server and HTTP gateway
@@ -29,12 +40,33 @@ func RunServer() error {
 	flag.StringVar(&cfg.GRPCPort, "port", "", "gRPC port to bind")
 	flag.StringVar(&cfg.GitlabToken, "token", "", "Gitlab token")
 	flag.StringVar(&cfg.GitlabURL, "url", "", "Gitlab API URL")
+	flag.StringVar(&cfg.HashScheme, "hash", "bcrypt", "Default password hashing scheme for basic auth (bcrypt, sha512 or apr1)")
+	flag.StringVar(&cfg.IngressController, "ingress", "nginx", "Ingress controller to configure (nginx or traefik)")
+	flag.StringVar(&cfg.TraefikVersion, "traefik-version", "3", "Major version of Traefik ingress controller (2 or 3), selects IP allowlist middleware")
+	flag.StringVar(&cfg.OAuth2ProxyImage, "oauth2-proxy-image", "quay.io/oauth2-proxy/oauth2-proxy:v7.6.0", "Image of oauth2-proxy deployed for OAuth2 protected instances")
+	flag.StringVar(&cfg.MetricsPort, "metrics-port", "9090", "HTTP port exposing Prometheus metrics, empty to disable")
+	flag.StringVar(&cfg.InstanceLabel, "instance-label", "app.kubernetes.io/instance", "Label identifying pods and other objects of an instance when they are not selected by instance workloads or named after it")
 	flag.Parse()
 
 	if len(cfg.GRPCPort) == 0 {
 		return fmt.Errorf("invalid TCP port for gRPC server: '%s'", cfg.GRPCPort)
 	}
 
+	hashScheme, err := v1.ParseHashScheme(cfg.HashScheme)
+	if err != nil {
+		return err
+	}
+
+	ingressController, err := v1.ParseIngressController(cfg.IngressController)
+	if err != nil {
+		return err
+	}
+
+	traefikAllowlistKey, err := v1.ParseTraefikIPAllowlistKey(cfg.TraefikVersion)
+	if err != nil {
+		return err
+	}
+
 	//Initialize kubernetes API
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -48,6 +80,26 @@ func RunServer() error {
 
 	kubeAPI := clientset
 
+	dynamicAPI, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	metricsAPI, err := metricsclient.NewForConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//Expose certificate expiry metrics
+	if len(cfg.MetricsPort) > 0 {
+		prometheus.MustRegister(v1.NewCertificateExpiryCollector(kubeAPI))
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			log.Fatal(http.ListenAndServe(":"+cfg.MetricsPort, mux))
+		}()
+	}
+
 	//Initialize Gitlab API
 	gitAPI, err := gitlab.NewClient(cfg.GitlabToken, gitlab.WithBaseURL(cfg.GitlabURL))
 	if err != nil {
@@ -55,13 +107,19 @@ func RunServer() error {
 	}
 
 	confAPI := v1.NewConfigServiceServer(kubeAPI, gitAPI)
-	authAPI := v1.NewBasicAuthServiceServer(kubeAPI)
-	certAPI := v1.NewCertManagerServiceServer(kubeAPI)
-	readyAPI := v1.NewReadinessServiceServer(kubeAPI)
-	infoAPI := v1.NewInformationServiceServer(kubeAPI)
-	podAPI := v1.NewPodServiceServer(kubeAPI)
+	authAPI := v1.NewBasicAuthServiceServer(kubeAPI, dynamicAPI, hashScheme, ingressController, cfg.InstanceLabel)
+	certAPI := v1.NewCertManagerServiceServer(kubeAPI, dynamicAPI, cfg.InstanceLabel)
+	readyAPI := v1.NewReadinessServiceServer(kubeAPI, cfg.InstanceLabel)
+	infoAPI := v1.NewInformationServiceServer(kubeAPI, dynamicAPI, cfg.InstanceLabel)
+	podAPI := v1.NewPodServiceServer(kubeAPI, metricsAPI, cfg.InstanceLabel)
 	namespaceAPI := v1.NewNamespaceServiceServer(kubeAPI)
+	repoAccessAPI := v1.NewRepositoryAccessServiceServer(kubeAPI, gitAPI)
+	ingressAuthAPI := v1.NewIngressAuthServiceServer(kubeAPI, dynamicAPI, ingressController, cfg.OAuth2ProxyImage, cfg.InstanceLabel)
+	allowlistAPI := v1.NewAllowlistServiceServer(kubeAPI, dynamicAPI, ingressController, traefikAllowlistKey, cfg.InstanceLabel)
+	diagnosticsAPI := v1.NewDiagnosticsServiceServer(kubeAPI, cfg.InstanceLabel)
+	eventAPI := v1.NewEventServiceServer(kubeAPI, cfg.InstanceLabel)
+	lifecycleAPI := v1.NewInstanceLifecycleServiceServer(kubeAPI, cfg.InstanceLabel)
 
-	return grpc.RunServer(ctx, confAPI, authAPI, certAPI, readyAPI, infoAPI, podAPI, namespaceAPI, cfg.GRPCPort)
+	return grpc.RunServer(ctx, confAPI, authAPI, certAPI, readyAPI, infoAPI, podAPI, namespaceAPI, repoAccessAPI, ingressAuthAPI, allowlistAPI, diagnosticsAPI, eventAPI, lifecycleAPI, cfg.GRPCPort)
 }
 
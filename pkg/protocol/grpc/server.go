@@ -19,6 +19,12 @@ func RunServer(ctx context.Context,
                infoAPI v1.InformationServiceServer,
                podAPI v1.PodServiceServer,
                namespaceAPI v1.NamespaceServiceServer,
+               repoAccessAPI v1.RepositoryAccessServiceServer,
+               ingressAuthAPI v1.IngressAuthServiceServer,
+               allowlistAPI v1.AllowlistServiceServer,
+               diagnosticsAPI v1.DiagnosticsServiceServer,
+               eventAPI v1.EventServiceServer,
+               lifecycleAPI v1.InstanceLifecycleServiceServer,
                port string) error {
 	listen, err := net.Listen("tcp", ":"+port)
 	if err != nil {
@@ -34,6 +40,12 @@ func RunServer(ctx context.Context,
 	v1.RegisterInformationServiceServer(server, infoAPI)
 	v1.RegisterPodServiceServer(server, podAPI)
 	v1.RegisterNamespaceServiceServer(server, namespaceAPI)
+	v1.RegisterRepositoryAccessServiceServer(server, repoAccessAPI)
+	v1.RegisterIngressAuthServiceServer(server, ingressAuthAPI)
+	v1.RegisterAllowlistServiceServer(server, allowlistAPI)
+	v1.RegisterDiagnosticsServiceServer(server, diagnosticsAPI)
+	v1.RegisterEventServiceServer(server, eventAPI)
+	v1.RegisterInstanceLifecycleServiceServer(server, lifecycleAPI)
 
 	// graceful shutdown
 	c := make(chan os.Signal, 1)
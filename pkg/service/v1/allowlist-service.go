@@ -0,0 +1,487 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"net"
+	"sort"
+	"strings"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+const (
+	allowlistComponent = "allowlist"
+	nginxWhitelistAnnotation = "nginx.ingress.kubernetes.io/whitelist-source-range"
+	//Upper bound protecting annotations and policies from growing beyond reasonable size
+	maxAllowlistEntries = 256
+	//Source ranges of LoadBalancer service from before the allowlist was applied, present only on allowlisted services
+	originalSourceRangesAnnotation = "janitor.nmaas.eu/original-source-ranges"
+)
+
+type allowlistServiceServer struct {
+	kubeAPI kubernetes.Interface
+	dynamicAPI dynamic.Interface
+	ingressController IngressController
+	traefikAllowlistKey string
+	instanceLabel string
+}
+
+func NewAllowlistServiceServer(kubeAPI kubernetes.Interface, dynamicAPI dynamic.Interface, ingressController IngressController, traefikAllowlistKey string, label string) v1.AllowlistServiceServer {
+	if len(traefikAllowlistKey) == 0 {
+		traefikAllowlistKey = traefikIPAllowListKey
+	}
+	if len(label) == 0 {
+		label = instanceLabel
+	}
+	return &allowlistServiceServer{kubeAPI: kubeAPI, dynamicAPI: dynamicAPI, ingressController: ingressController, traefikAllowlistKey: traefikAllowlistKey, instanceLabel: label}
+}
+
+//Prepare allowlist response
+func prepareAllowlistResponse(status v1.Status, message string) *v1.AllowlistResponse {
+	return &v1.AllowlistResponse {
+		Api: apiVersion,
+		Status: status,
+		Message: message,
+		Cidrs: make([]string, 0),
+		Targets: make([]*v1.AllowlistTarget, 0),
+	}
+}
+
+func getAllowlistMiddlewareName(uid string) string {
+	return uid + "-allowlist"
+}
+
+func getAllowlistPolicyName(serviceName string) string {
+	return serviceName + "-allowlist"
+}
+
+//Validate CIDRs and return them in canonical form, without duplicates
+func normalizeCidrs(cidrs []string) ([]string, error) {
+	if len(cidrs) > maxAllowlistEntries {
+		return nil, status.Errorf(codes.InvalidArgument, "Too many CIDRs, at most %d are allowed", maxAllowlistEntries)
+	}
+
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid CIDR '%s'", cidr)
+		}
+		if network.String() != strings.TrimSpace(cidr) {
+			return nil, status.Errorf(codes.InvalidArgument, "CIDR '%s' has host bits set, did you mean '%s'?", cidr, network.String())
+		}
+		if !seen[network.String()] {
+			seen[network.String()] = true
+			result = append(result, network.String())
+		}
+	}
+	return result, nil
+}
+
+//Split comma separated list of CIDRs as stored in annotations
+func splitCidrs(value string) []string {
+	cidrs := make([]string, 0)
+	for _, cidr := range strings.Split(value, ",") {
+		if cidr = strings.TrimSpace(cidr); len(cidr) > 0 {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return cidrs
+}
+
+//Find LoadBalancer services of the instance in given namespace
+func findInstanceLoadBalancers(ctx context.Context, kubeAPI kubernetes.Interface, namespace string, uid string, label string) ([]apiv1.Service, error) {
+	all, err := kubeAPI.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]apiv1.Service, 0)
+	for _, service := range all.Items {
+		if service.Spec.Type == apiv1.ServiceTypeLoadBalancer && belongsToInstance(&service, uid, label) {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+//Selector of network policies created by Janitor for the instance allowlist
+func allowlistPolicySelector(uid string, label string) string {
+	return labels.SelectorFromSet(map[string]string{
+		label: uid,
+		componentLabel: allowlistComponent,
+		managedByLabel: managedByJanitor,
+	}).String()
+}
+
+//Check if network policy can restrict sources of LoadBalancer service traffic.
+//Policy without selector would apply to every pod in the namespace and with Cluster traffic policy
+//the pods see addresses of nodes forwarding the traffic instead of the clients.
+func canRestrictWithPolicy(service *apiv1.Service) bool {
+	return len(service.Spec.Selector) > 0 && service.Spec.ExternalTrafficPolicy == apiv1.ServiceExternalTrafficPolicyLocal
+}
+
+//Prepare network policy admitting traffic to LoadBalancer service ports only from given CIDRs
+func prepareAllowlistPolicy(service *apiv1.Service, uid string, label string, cidrs []string) *networkingv1.NetworkPolicy {
+	policy := &networkingv1.NetworkPolicy{}
+	policy.SetNamespace(service.Namespace)
+	policy.SetName(getAllowlistPolicyName(service.Name))
+	policy.SetLabels(map[string]string{
+		label: uid,
+		componentLabel: allowlistComponent,
+		managedByLabel: managedByJanitor,
+	})
+	policy.Spec.PodSelector = metav1.LabelSelector{MatchLabels: service.Spec.Selector}
+	policy.Spec.PolicyTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}
+
+	ports := make([]networkingv1.NetworkPolicyPort, 0, len(service.Spec.Ports))
+	for i := range service.Spec.Ports {
+		port := service.Spec.Ports[i].TargetPort
+		if port.IntVal == 0 && len(port.StrVal) == 0 {
+			port.IntVal = service.Spec.Ports[i].Port
+		}
+		ports = append(ports, networkingv1.NetworkPolicyPort{Protocol: &service.Spec.Ports[i].Protocol, Port: &port})
+	}
+
+	peers := make([]networkingv1.NetworkPolicyPeer, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}})
+	}
+
+	policy.Spec.Ingress = []networkingv1.NetworkPolicyIngressRule{
+		{From: peers, Ports: ports},
+		//traffic from within the cluster is not subject to the allowlist
+		{From: []networkingv1.NetworkPolicyPeer{{NamespaceSelector: &metav1.LabelSelector{}}}},
+	}
+	return policy
+}
+
+//Apply allowlist to instance Ingress objects, returning number of Ingress objects found
+func (s *allowlistServiceServer) applyToIngresses(ctx context.Context, namespace string, uid string, cidrs []string) (int, error) {
+	if s.ingressController == IngressControllerTraefik {
+		middleware := getAllowlistMiddlewareName(uid)
+		spec := map[string]interface{}{s.traefikAllowlistKey: map[string]interface{}{"sourceRange": toInterfaceSlice(cidrs)}}
+		if err := createOrUpdateTraefikMiddleware(ctx, s.dynamicAPI, namespace, middleware, spec); err != nil {
+			return 0, err
+		}
+		ref := traefikMiddlewareRef(namespace, middleware)
+		return updateInstanceIngresses(ctx, s.kubeAPI, namespace, uid, s.instanceLabel, func(annotations map[string]string) bool {
+			return addTraefikMiddleware(annotations, ref)
+		})
+	}
+
+	value := strings.Join(cidrs, ",")
+	return updateInstanceIngresses(ctx, s.kubeAPI, namespace, uid, s.instanceLabel, func(annotations map[string]string) bool {
+		changed := annotations[nginxWhitelistAnnotation] != value
+		annotations[nginxWhitelistAnnotation] = value
+		return changed
+	})
+}
+
+//Apply allowlist to source ranges of instance LoadBalancer services and to their pods where possible,
+//removing policies of services that are gone
+func (s *allowlistServiceServer) applyToLoadBalancers(ctx context.Context, namespace string, uid string, cidrs []string) (int, error) {
+	services, err := findInstanceLoadBalancers(ctx, s.kubeAPI, namespace, uid, s.instanceLabel)
+	if err != nil {
+		return 0, err
+	}
+
+	expected := make(map[string]bool)
+	for i := range services {
+		service := &services[i]
+		//service allowlisted before keeps its originally recorded source ranges
+		if _, found := service.Annotations[originalSourceRangesAnnotation]; !found {
+			if service.Annotations == nil {
+				service.Annotations = make(map[string]string)
+			}
+			service.Annotations[originalSourceRangesAnnotation] = strings.Join(service.Spec.LoadBalancerSourceRanges, ",")
+		}
+		service.Spec.LoadBalancerSourceRanges = cidrs
+		logLine(fmt.Sprintf("Updating source ranges of Service %s", service.Name))
+		if _, err = s.kubeAPI.CoreV1().Services(namespace).Update(ctx, service, metav1.UpdateOptions{}); err != nil {
+			return 0, err
+		}
+
+		if !canRestrictWithPolicy(service) {
+			continue
+		}
+		policy := prepareAllowlistPolicy(service, uid, s.instanceLabel, cidrs)
+		expected[policy.Name] = true
+
+		existing, err := s.kubeAPI.NetworkingV1().NetworkPolicies(namespace).Get(ctx, policy.Name, metav1.GetOptions{})
+		if err != nil {
+			logLine(fmt.Sprintf("Creating NetworkPolicy %s", policy.Name))
+			_, err = s.kubeAPI.NetworkingV1().NetworkPolicies(namespace).Create(ctx, policy, metav1.CreateOptions{})
+		} else {
+			logLine(fmt.Sprintf("Updating NetworkPolicy %s", policy.Name))
+			existing.Spec = policy.Spec
+			_, err = s.kubeAPI.NetworkingV1().NetworkPolicies(namespace).Update(ctx, existing, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = s.deletePolicies(ctx, namespace, uid, expected); err != nil {
+		return 0, err
+	}
+	return len(services), nil
+}
+
+//Restore source ranges of instance LoadBalancer services from before the allowlist was applied
+func (s *allowlistServiceServer) restoreLoadBalancers(ctx context.Context, namespace string, uid string) error {
+	services, err := findInstanceLoadBalancers(ctx, s.kubeAPI, namespace, uid, s.instanceLabel)
+	if err != nil {
+		return err
+	}
+	for i := range services {
+		service := &services[i]
+		original, found := service.Annotations[originalSourceRangesAnnotation]
+		if !found {
+			continue
+		}
+		service.Spec.LoadBalancerSourceRanges = splitCidrs(original)
+		delete(service.Annotations, originalSourceRangesAnnotation)
+		logLine(fmt.Sprintf("Restoring source ranges of Service %s", service.Name))
+		if _, err = s.kubeAPI.CoreV1().Services(namespace).Update(ctx, service, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Delete allowlist network policies of the instance except the ones to keep
+func (s *allowlistServiceServer) deletePolicies(ctx context.Context, namespace string, uid string, keep map[string]bool) error {
+	policies, err := s.kubeAPI.NetworkingV1().NetworkPolicies(namespace).List(ctx, metav1.ListOptions{LabelSelector: allowlistPolicySelector(uid, s.instanceLabel)})
+	if err != nil {
+		return err
+	}
+	for _, policy := range policies.Items {
+		if keep[policy.Name] {
+			continue
+		}
+		logLine(fmt.Sprintf("Deleting NetworkPolicy %s", policy.Name))
+		err = s.kubeAPI.NetworkingV1().NetworkPolicies(namespace).Delete(ctx, policy.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+//Convert list of strings to form accepted by unstructured objects
+func toInterfaceSlice(values []string) []interface{} {
+	result := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		result = append(result, v)
+	}
+	return result
+}
+
+func (s *allowlistServiceServer) ReplaceAllowlist(ctx context.Context, req *v1.AllowlistRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Instance
+	cidrs, err := normalizeCidrs(req.Cidrs)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Invalid allowlist"), err
+	}
+	if len(cidrs) == 0 {
+		return prepareResponse(v1.Status_FAILED, "Empty allowlist would block all traffic, clear the allowlist instead"),
+			status.Errorf(codes.InvalidArgument, "No CIDRs provided")
+	}
+	logLine(fmt.Sprintf("> Applying allowlist of %d CIDR(s) for instance:%s in namespace:%s", len(cidrs), depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err = s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	//look up targets first, so that nothing is created for instance without any
+	ingresses, err := findInstanceIngresses(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while retrieving Ingress list"), err
+	}
+	services, err := findInstanceLoadBalancers(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while retrieving Service list"), err
+	}
+	if len(ingresses) == 0 && len(services) == 0 {
+		return prepareResponse(v1.Status_FAILED, "Neither Ingress nor LoadBalancer service found!"),
+			status.Errorf(codes.NotFound, "no Ingress or LoadBalancer service found for instance %s", depl.Uid)
+	}
+
+	ingressCount, err := s.applyToIngresses(ctx, depl.Namespace, depl.Uid, cidrs)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while configuring Ingress!"), err
+	}
+
+	serviceCount, err := s.applyToLoadBalancers(ctx, depl.Namespace, depl.Uid, cidrs)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while configuring NetworkPolicy!"), err
+	}
+
+	return prepareResponse(v1.Status_OK, fmt.Sprintf("Allowlist applied to %d Ingress and %d LoadBalancer service(s)", ingressCount, serviceCount)), nil
+}
+
+func (s *allowlistServiceServer) ListAllowlist(ctx context.Context, req *v1.InstanceRequest) (*v1.AllowlistResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareAllowlistResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	res := prepareAllowlistResponse(v1.Status_OK, "")
+	all := make(map[string]bool)
+	addTarget := func(kind string, name string, cidrs []string) {
+		res.Targets = append(res.Targets, &v1.AllowlistTarget{Kind: kind, Name: name, Cidrs: cidrs})
+		for _, cidr := range cidrs {
+			all[cidr] = true
+		}
+	}
+
+	ingresses, err := findInstanceIngresses(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareAllowlistResponse(v1.Status_FAILED, "Error while retrieving Ingress list"), err
+	}
+	ref := traefikMiddlewareRef(depl.Namespace, getAllowlistMiddlewareName(depl.Uid))
+	var middlewareCidrs []string
+	for _, ingress := range ingresses {
+		if value, ok := ingress.Annotations[nginxWhitelistAnnotation]; ok {
+			addTarget("Ingress", ingress.Name, splitCidrs(value))
+		} else if strings.Contains(ingress.Annotations[traefikMiddlewaresAnnotation], ref) {
+			if middlewareCidrs == nil {
+				middlewareCidrs = s.middlewareCidrs(ctx, depl.Namespace, depl.Uid)
+			}
+			addTarget("Ingress", ingress.Name, middlewareCidrs)
+		}
+	}
+
+	services, err := findInstanceLoadBalancers(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareAllowlistResponse(v1.Status_FAILED, "Error while retrieving Service list"), err
+	}
+	for _, service := range services {
+		if _, found := service.Annotations[originalSourceRangesAnnotation]; found {
+			addTarget("Service", service.Name, service.Spec.LoadBalancerSourceRanges)
+		}
+	}
+
+	policies, err := s.kubeAPI.NetworkingV1().NetworkPolicies(depl.Namespace).List(ctx, metav1.ListOptions{LabelSelector: allowlistPolicySelector(depl.Uid, s.instanceLabel)})
+	if err != nil {
+		return prepareAllowlistResponse(v1.Status_FAILED, "Error while retrieving NetworkPolicy list"), err
+	}
+	for _, policy := range policies.Items {
+		cidrs := make([]string, 0)
+		if len(policy.Spec.Ingress) > 0 {
+			for _, peer := range policy.Spec.Ingress[0].From {
+				if peer.IPBlock != nil {
+					cidrs = append(cidrs, peer.IPBlock.CIDR)
+				}
+			}
+		}
+		addTarget("NetworkPolicy", policy.Name, cidrs)
+	}
+
+	for cidr := range all {
+		res.Cidrs = append(res.Cidrs, cidr)
+	}
+	sort.Strings(res.Cidrs)
+	if len(res.Targets) == 0 {
+		res.Message = "No allowlist configured"
+	}
+	return res, nil
+}
+
+//Read source ranges of Traefik allowlist middleware, empty if it cannot be read
+func (s *allowlistServiceServer) middlewareCidrs(ctx context.Context, namespace string, uid string) []string {
+	cidrs := make([]string, 0)
+	if s.dynamicAPI == nil {
+		return cidrs
+	}
+	middleware, err := s.dynamicAPI.Resource(traefikMiddlewareResource).Namespace(namespace).Get(ctx, getAllowlistMiddlewareName(uid), metav1.GetOptions{})
+	if err != nil {
+		return cidrs
+	}
+	spec, _ := middleware.Object["spec"].(map[string]interface{})
+	//middleware written before switching Traefik version still uses the other key
+	whitelist, _ := spec[traefikIPAllowListKey].(map[string]interface{})
+	if whitelist == nil {
+		whitelist, _ = spec[traefikIPWhiteListKey].(map[string]interface{})
+	}
+	ranges, _ := whitelist["sourceRange"].([]interface{})
+	for _, r := range ranges {
+		if cidr, ok := r.(string); ok {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return cidrs
+}
+
+func (s *allowlistServiceServer) ClearAllowlist(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+	logLine(fmt.Sprintf("> Clearing allowlist of instance:%s in namespace:%s", depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	middleware := getAllowlistMiddlewareName(depl.Uid)
+	ref := traefikMiddlewareRef(depl.Namespace, middleware)
+	_, err = updateInstanceIngresses(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel, func(annotations map[string]string) bool {
+		changed := removeTraefikMiddleware(annotations, ref)
+		if _, ok := annotations[nginxWhitelistAnnotation]; ok {
+			delete(annotations, nginxWhitelistAnnotation)
+			changed = true
+		}
+		return changed
+	})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while removing Ingress configuration!"), err
+	}
+
+	err = deleteTraefikMiddlewareIfConfigured(ctx, s.dynamicAPI, s.ingressController, depl.Namespace, middleware)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while removing Traefik middleware!"), err
+	}
+
+	err = s.restoreLoadBalancers(ctx, depl.Namespace, depl.Uid)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while restoring Service source ranges!"), err
+	}
+
+	err = s.deletePolicies(ctx, depl.Namespace, depl.Uid, nil)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while removing NetworkPolicy!"), err
+	}
+	return prepareResponse(v1.Status_OK, "Allowlist cleared successfully"), nil
+}
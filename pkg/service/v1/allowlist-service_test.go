@@ -0,0 +1,330 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestNormalizeCidrs(t *testing.T) {
+	cidrs, err := normalizeCidrs([]string{"10.0.0.0/8", " 192.168.1.0/24", "10.0.0.0/8", "2001:db8::/32"})
+	if err != nil || len(cidrs) != 3 || cidrs[1] != "192.168.1.0/24" {
+		t.Fail()
+	}
+
+	for _, invalid := range []string{"10.0.0.1", "300.0.0.0/8", "10.0.0.1/8", "10.0.0.0/33", ""} {
+		_, err = normalizeCidrs([]string{invalid})
+		if err == nil {
+			t.Errorf("CIDR '%s' should be rejected", invalid)
+		}
+	}
+}
+
+func TestAllowlistServiceServer_ReplaceAllowlist(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewAllowlistServiceServer(client, nil, IngressControllerNginx, "", "")
+	areq := v1.AllowlistRequest{Api: apiVersion, Instance: &inst, Cidrs: []string{"10.0.0.0/8", "192.168.1.0/24"}}
+
+	//Fail on API version check
+	res, err := server.ReplaceAllowlist(context.Background(), &v1.AllowlistRequest{Api: "illegal", Instance: &inst})
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on invalid CIDR
+	res, err = server.ReplaceAllowlist(context.Background(), &v1.AllowlistRequest{Api: apiVersion, Instance: &inst, Cidrs: []string{"10.0.0.1"}})
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Fail on empty list
+	res, err = server.ReplaceAllowlist(context.Background(), &v1.AllowlistRequest{Api: apiVersion, Instance: &inst})
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	res, err = server.ReplaceAllowlist(context.Background(), &areq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//create mock namespace
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Fail without ingress or loadbalancer
+	res, err = server.ReplaceAllowlist(context.Background(), &areq)
+	if status.Code(err) != codes.NotFound || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//create mock ingress and loadbalancer service
+	ing := networkingv1.Ingress{}
+	ing.Name = "test-uid"
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &ing, metav1.CreateOptions{})
+	svc := corev1.Service{}
+	svc.Name = "test-uid-syslog"
+	svc.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	svc.Spec.Type = corev1.ServiceTypeLoadBalancer
+	svc.Spec.Selector = map[string]string{"app": "syslog"}
+	svc.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyLocal
+	svc.Spec.Ports = []corev1.ServicePort{{Port: 514, Protocol: corev1.ProtocolUDP}}
+	_, _ = client.CoreV1().Services("test-namespace").Create(context.Background(), &svc, metav1.CreateOptions{})
+	//service without selector is restricted by source ranges only
+	external := corev1.Service{}
+	external.Name = "test-uid-external"
+	external.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	external.Spec.Type = corev1.ServiceTypeLoadBalancer
+	external.Spec.Ports = []corev1.ServicePort{{Port: 443, Protocol: corev1.ProtocolTCP}}
+	_, _ = client.CoreV1().Services("test-namespace").Create(context.Background(), &external, metav1.CreateOptions{})
+
+	//Pass
+	res, err = server.ReplaceAllowlist(context.Background(), &areq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+
+	annotated, _ := client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if annotated.Annotations["nginx.ingress.kubernetes.io/whitelist-source-range"] != "10.0.0.0/8,192.168.1.0/24" {
+		t.Fail()
+	}
+
+	policy, err := client.NetworkingV1().NetworkPolicies("test-namespace").Get(context.Background(), "test-uid-syslog-allowlist", metav1.GetOptions{})
+	if err != nil || policy.Spec.PodSelector.MatchLabels["app"] != "syslog" || len(policy.Spec.Ingress) != 2 {
+		t.Fatal(err)
+	}
+	if len(policy.Spec.Ingress[0].From) != 2 || policy.Spec.Ingress[0].From[0].IPBlock.CIDR != "10.0.0.0/8" ||
+		policy.Spec.Ingress[0].Ports[0].Port.IntVal != 514 || *policy.Spec.Ingress[0].Ports[0].Protocol != corev1.ProtocolUDP {
+		t.Fail()
+	}
+	for _, name := range []string{"test-uid-syslog", "test-uid-external"} {
+		restricted, _ := client.CoreV1().Services("test-namespace").Get(context.Background(), name, metav1.GetOptions{})
+		if len(restricted.Spec.LoadBalancerSourceRanges) != 2 || restricted.Spec.LoadBalancerSourceRanges[1] != "192.168.1.0/24" {
+			t.Errorf("unexpected source ranges of %s: %v", name, restricted.Spec.LoadBalancerSourceRanges)
+		}
+	}
+	_, err = client.NetworkingV1().NetworkPolicies("test-namespace").Get(context.Background(), "test-uid-external-allowlist", metav1.GetOptions{})
+	if err == nil {
+		t.Error("policy without pod selector should not be created")
+	}
+
+	//Should replace existing list
+	areq.Cidrs = []string{"172.16.0.0/12"}
+	res, err = server.ReplaceAllowlist(context.Background(), &areq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	annotated, _ = client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	policy, _ = client.NetworkingV1().NetworkPolicies("test-namespace").Get(context.Background(), "test-uid-syslog-allowlist", metav1.GetOptions{})
+	if annotated.Annotations["nginx.ingress.kubernetes.io/whitelist-source-range"] != "172.16.0.0/12" ||
+		len(policy.Spec.Ingress[0].From) != 1 {
+		t.Fail()
+	}
+
+	//Should remove policy of service that is no longer a loadbalancer
+	_ = client.CoreV1().Services("test-namespace").Delete(context.Background(), "test-uid-syslog", metav1.DeleteOptions{})
+	_, _ = server.ReplaceAllowlist(context.Background(), &areq)
+	_, err = client.NetworkingV1().NetworkPolicies("test-namespace").Get(context.Background(), "test-uid-syslog-allowlist", metav1.GetOptions{})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestAllowlistServiceServer_ReplaceAllowlistTraefik(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	scheme := runtime.NewScheme()
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(scheme,
+		map[schema.GroupVersionResource]string{traefikMiddlewareResource: "MiddlewareList"})
+	server := NewAllowlistServiceServer(client, dynamicClient, IngressControllerTraefik, "", "")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Middleware is not created when there is nothing to attach it to
+	areq := v1.AllowlistRequest{Api: apiVersion, Instance: &inst, Cidrs: []string{"10.0.0.0/8"}}
+	res, err := server.ReplaceAllowlist(context.Background(), &areq)
+	if status.Code(err) != codes.NotFound || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+	_, err = dynamicClient.Resource(traefikMiddlewareResource).Namespace("test-namespace").Get(context.Background(), "test-uid-allowlist", metav1.GetOptions{})
+	if err == nil {
+		t.Error("orphaned middleware created")
+	}
+
+	ing := networkingv1.Ingress{}
+	ing.Name = "test-uid"
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &ing, metav1.CreateOptions{})
+
+	res, err = server.ReplaceAllowlist(context.Background(), &areq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+	middleware, err := dynamicClient.Resource(traefikMiddlewareResource).Namespace("test-namespace").Get(context.Background(), "test-uid-allowlist", metav1.GetOptions{})
+	if err != nil || middleware.Object["spec"].(map[string]interface{})["ipAllowList"] == nil {
+		t.Errorf("middleware should use Traefik v3 ipAllowList %v", middleware)
+	}
+
+	annotated, _ := client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if annotated.Annotations[traefikMiddlewaresAnnotation] != "test-namespace-test-uid-allowlist@kubernetescrd" {
+		t.Fail()
+	}
+
+	list, err := server.ListAllowlist(context.Background(), &req)
+	if err != nil || len(list.Targets) != 1 || len(list.Cidrs) != 1 || list.Cidrs[0] != "10.0.0.0/8" {
+		t.Fail()
+	}
+
+	res, err = server.ClearAllowlist(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	_, err = dynamicClient.Resource(traefikMiddlewareResource).Namespace("test-namespace").Get(context.Background(), "test-uid-allowlist", metav1.GetOptions{})
+	if err == nil {
+		t.Fail()
+	}
+
+	//Traefik v2 middleware is read as well
+	v2Server := NewAllowlistServiceServer(client, dynamicClient, IngressControllerTraefik, traefikIPWhiteListKey, "")
+	res, err = v2Server.ReplaceAllowlist(context.Background(), &areq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+	middleware, _ = dynamicClient.Resource(traefikMiddlewareResource).Namespace("test-namespace").Get(context.Background(), "test-uid-allowlist", metav1.GetOptions{})
+	if middleware.Object["spec"].(map[string]interface{})["ipWhiteList"] == nil {
+		t.Errorf("middleware should use Traefik v2 ipWhiteList %v", middleware)
+	}
+	list, err = server.ListAllowlist(context.Background(), &req)
+	if err != nil || len(list.Cidrs) != 1 || list.Cidrs[0] != "10.0.0.0/8" {
+		t.Fail()
+	}
+}
+
+func TestParseTraefikIPAllowlistKey(t *testing.T) {
+	for version, expected := range map[string]string{"": "ipAllowList", "3": "ipAllowList", "v3": "ipAllowList", "2": "ipWhiteList", "V2": "ipWhiteList"} {
+		key, err := ParseTraefikIPAllowlistKey(version)
+		if err != nil || key != expected {
+			t.Errorf("unexpected key for version '%s': %s, %v", version, key, err)
+		}
+	}
+	if _, err := ParseTraefikIPAllowlistKey("1"); err == nil {
+		t.Fail()
+	}
+}
+
+func TestAllowlistServiceServer_CustomLabel(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewAllowlistServiceServer(client, nil, IngressControllerNginx, "", "nmaas.eu/instance")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+	svc := corev1.Service{}
+	svc.Name = "syslog"
+	svc.Labels = map[string]string{"nmaas.eu/instance": "test-uid"}
+	svc.Spec.Type = corev1.ServiceTypeLoadBalancer
+	svc.Spec.ExternalTrafficPolicy = corev1.ServiceExternalTrafficPolicyLocal
+	svc.Spec.Selector = map[string]string{"app": "syslog"}
+	svc.Spec.Ports = []corev1.ServicePort{{Port: 514, Protocol: corev1.ProtocolUDP}}
+	_, _ = client.CoreV1().Services("test-namespace").Create(context.Background(), &svc, metav1.CreateOptions{})
+
+	res, err := server.ReplaceAllowlist(context.Background(), &v1.AllowlistRequest{Api: apiVersion, Instance: &inst, Cidrs: []string{"10.0.0.0/8"}})
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err, res)
+	}
+	policy, err := client.NetworkingV1().NetworkPolicies("test-namespace").Get(context.Background(), "syslog-allowlist", metav1.GetOptions{})
+	if err != nil || policy.Labels["nmaas.eu/instance"] != "test-uid" || len(policy.Labels["app.kubernetes.io/instance"]) != 0 {
+		t.Fatal(err, policy)
+	}
+
+	//policy is found through the configured label
+	list, err := server.ListAllowlist(context.Background(), &req)
+	if err != nil || len(list.Targets) != 2 || list.Targets[1].Kind != "NetworkPolicy" {
+		t.Errorf("unexpected allowlist %v, %v", list, err)
+	}
+	res, err = server.ClearAllowlist(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err, res)
+	}
+	_, err = client.NetworkingV1().NetworkPolicies("test-namespace").Get(context.Background(), "syslog-allowlist", metav1.GetOptions{})
+	if err == nil {
+		t.Error("policy not deleted")
+	}
+}
+
+func TestAllowlistServiceServer_ListAndClearAllowlist(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewAllowlistServiceServer(client, nil, IngressControllerNginx, "", "")
+
+	//Fail on API version check
+	list, err := server.ListAllowlist(context.Background(), &illegal_req)
+	if err == nil || list != nil {
+		t.Fail()
+	}
+	res, err := server.ClearAllowlist(context.Background(), &illegal_req)
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	list, err = server.ListAllowlist(context.Background(), &req)
+	if err == nil || list.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//create mock namespace, ingress and loadbalancer service
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+	ing := networkingv1.Ingress{}
+	ing.Name = "test-uid"
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &ing, metav1.CreateOptions{})
+	svc := corev1.Service{}
+	svc.Name = "test-uid"
+	svc.Spec.Type = corev1.ServiceTypeLoadBalancer
+	svc.Spec.LoadBalancerSourceRanges = []string{"0.0.0.0/0"}
+	svc.Spec.Ports = []corev1.ServicePort{{Port: 80, Protocol: corev1.ProtocolTCP}}
+	_, _ = client.CoreV1().Services("test-namespace").Create(context.Background(), &svc, metav1.CreateOptions{})
+
+	//Pass with nothing configured
+	list, err = server.ListAllowlist(context.Background(), &req)
+	if err != nil || list.Status != v1.Status_OK || len(list.Targets) != 0 {
+		t.Fail()
+	}
+
+	_, _ = server.ReplaceAllowlist(context.Background(), &v1.AllowlistRequest{Api: apiVersion, Instance: &inst, Cidrs: []string{"192.168.1.0/24", "10.0.0.0/8"}})
+
+	list, err = server.ListAllowlist(context.Background(), &req)
+	if err != nil || len(list.Targets) != 2 || len(list.Cidrs) != 2 || list.Cidrs[0] != "10.0.0.0/8" {
+		t.Fail()
+	}
+
+	//Should remove annotations and restore source ranges
+	res, err = server.ClearAllowlist(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	annotated, _ := client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if len(annotated.Annotations) != 0 {
+		t.Fail()
+	}
+	restored, _ := client.CoreV1().Services("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if len(restored.Annotations) != 0 || len(restored.Spec.LoadBalancerSourceRanges) != 1 || restored.Spec.LoadBalancerSourceRanges[0] != "0.0.0.0/0" {
+		t.Errorf("unexpected source ranges after clearing %v", restored.Spec.LoadBalancerSourceRanges)
+	}
+	list, _ = server.ListAllowlist(context.Background(), &req)
+	if len(list.Targets) != 0 || len(list.Cidrs) != 0 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,460 @@
+package v1
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"strings"
+	"time"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+const (
+	certManagerGroup = "cert-manager.io"
+	//Annotation set by cert-manager on every CertificateRequest issued for a Certificate
+	certificateNameAnnotation = "cert-manager.io/certificate-name"
+	certificateComponent = "certificate"
+)
+
+var certificateResource = schema.GroupVersionResource{Group: certManagerGroup, Version: "v1", Resource: "certificates"}
+var certificateRequestResource = schema.GroupVersionResource{Group: certManagerGroup, Version: "v1", Resource: "certificaterequests"}
+
+//Certificate has the same name as its secret, just like the ones created by cert-manager ingress-shim
+func getCertificateName(uid string) string {
+	return getCertificateSecretName(uid)
+}
+
+func getCertificateSecretName(uid string) string {
+	return uid + "-tls"
+}
+
+//Prepare certificate status response
+func prepareCertificateStatusResponse(status v1.Status, message string) *v1.CertificateStatusResponse {
+	return &v1.CertificateStatusResponse {
+		Api: apiVersion,
+		Status: status,
+		Message: message,
+		Hostnames: make([]string, 0),
+	}
+}
+
+func issuerKindName(kind v1.IssuerKind) string {
+	if kind == v1.IssuerKind_ISSUER {
+		return "Issuer"
+	}
+	return "ClusterIssuer"
+}
+
+func parseIssuerKind(name string) v1.IssuerKind {
+	if name == "Issuer" {
+		return v1.IssuerKind_ISSUER
+	}
+	return v1.IssuerKind_CLUSTER_ISSUER
+}
+
+//Collect hostnames from requested list or, if none were given, from instance Ingress rules
+func (s *certManagerServiceServer) certificateHostnames(ctx context.Context, instance *v1.Instance, hostnames []string) ([]string, error) {
+	if len(hostnames) == 0 {
+		ingresses, err := findInstanceIngresses(ctx, s.kubeAPI, instance.Namespace, instance.Uid, s.instanceLabel)
+		if err != nil {
+			return nil, err
+		}
+		for _, ingress := range ingresses {
+			for _, rule := range ingress.Spec.Rules {
+				hostnames = append(hostnames, rule.Host)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(hostnames))
+	for _, host := range hostnames {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if len(host) == 0 || seen[host] {
+			continue
+		}
+		if len(validation.IsDNS1123Subdomain(host)) > 0 && len(validation.IsWildcardDNS1123Subdomain(host)) > 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid hostname '%s'", host)
+		}
+		seen[host] = true
+		result = append(result, host)
+	}
+	if len(result) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "No hostnames given and none found in instance Ingress")
+	}
+	return result, nil
+}
+
+//Prepare spec of cert-manager Certificate
+func prepareCertificateSpec(uid string, hostnames []string, issuer string, kind v1.IssuerKind) map[string]interface{} {
+	return map[string]interface{}{
+		"secretName": getCertificateSecretName(uid),
+		"dnsNames": toInterfaceSlice(hostnames),
+		"issuerRef": map[string]interface{}{
+			"name": issuer,
+			"kind": issuerKindName(kind),
+			"group": certManagerGroup,
+		},
+	}
+}
+
+//Find condition of given type in status of cert-manager resource
+func findCondition(object *unstructured.Unstructured, conditionType string) map[string]interface{} {
+	conditions, _, _ := unstructured.NestedSlice(object.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && condition["type"] == conditionType {
+			return condition
+		}
+	}
+	return nil
+}
+
+func conditionField(condition map[string]interface{}, field string) string {
+	value, _ := condition[field].(string)
+	return value
+}
+
+//Delete Certificate, missing Certificate or missing cert-manager CRDs are not an error
+func (s *certManagerServiceServer) deleteCertificate(ctx context.Context, namespace string, name string) error {
+	err := s.dynamicAPI.Resource(certificateResource).Namespace(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err == nil {
+		logLine(fmt.Sprintf("Certificate %s deleted", name))
+		return nil
+	}
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+//Find reason of the last failure of most recent CertificateRequest issued for given Certificate
+func (s *certManagerServiceServer) lastFailureReason(ctx context.Context, certificate *unstructured.Unstructured) string {
+	requests, err := s.dynamicAPI.Resource(certificateRequestResource).Namespace(certificate.GetNamespace()).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		logLine(fmt.Sprintf("Could not list CertificateRequests: %s", err))
+		return ""
+	}
+
+	var latest *unstructured.Unstructured
+	for i := range requests.Items {
+		request := &requests.Items[i]
+		if request.GetAnnotations()[certificateNameAnnotation] != certificate.GetName() {
+			continue
+		}
+		if latest == nil || latest.GetCreationTimestamp().Time.Before(request.GetCreationTimestamp().Time) {
+			latest = request
+		}
+	}
+
+	if latest != nil {
+		for _, conditionType := range []string{"Denied", "InvalidRequest"} {
+			if c := findCondition(latest, conditionType); c != nil && conditionField(c, "status") == "True" {
+				return conditionField(c, "reason") + ": " + conditionField(c, "message")
+			}
+		}
+		if c := findCondition(latest, "Ready"); c != nil && conditionField(c, "status") == "False" && conditionField(c, "reason") == "Failed" {
+			return conditionField(c, "reason") + ": " + conditionField(c, "message")
+		}
+	}
+
+	//CertificateRequests may have been cleaned up already, fall back to Certificate status
+	if _, found, _ := unstructured.NestedString(certificate.Object, "status", "lastFailureTime"); found {
+		if c := findCondition(certificate, "Issuing"); c != nil && conditionField(c, "status") == "False" {
+			return conditionField(c, "reason") + ": " + conditionField(c, "message")
+		}
+	}
+	return ""
+}
+
+func (s *certManagerServiceServer) CreateOrReplace(ctx context.Context, req *v1.InstanceCertificateRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Instance
+	if len(req.Issuer) == 0 {
+		return prepareResponse(v1.Status_FAILED, "Issuer not provided"), status.Errorf(codes.InvalidArgument, "Issuer not provided")
+	}
+	logLine(fmt.Sprintf("> Requesting certificate from %s %s for instance:%s in namespace:%s", issuerKindName(req.IssuerKind), req.Issuer, depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	hostnames, err := s.certificateHostnames(ctx, depl, req.Hostnames)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Invalid hostnames"), err
+	}
+
+	name := getCertificateName(depl.Uid)
+	spec := prepareCertificateSpec(depl.Uid, hostnames, req.Issuer, req.IssuerKind)
+	certificate := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": certificateResource.GroupVersion().String(),
+		"kind": "Certificate",
+		"metadata": map[string]interface{}{
+			"name": name,
+			"namespace": depl.Namespace,
+			"labels": map[string]interface{}{
+				s.instanceLabel: depl.Uid,
+				componentLabel: certificateComponent,
+				managedByLabel: managedByJanitor,
+			},
+		},
+		"spec": spec,
+	}}
+
+	_, err = s.dynamicAPI.Resource(certificateResource).Namespace(depl.Namespace).Create(ctx, certificate, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		existing, err := s.dynamicAPI.Resource(certificateResource).Namespace(depl.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return prepareResponse(v1.Status_FAILED, "Error while retrieving certificate!"), err
+		}
+		existing.Object["spec"] = spec
+		_, err = s.dynamicAPI.Resource(certificateResource).Namespace(depl.Namespace).Update(ctx, existing, metav1.UpdateOptions{})
+		if err != nil {
+			return prepareResponse(v1.Status_FAILED, "Error while updating certificate!"), err
+		}
+		return prepareResponse(v1.Status_OK, "Certificate updated successfully"), nil
+	}
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while creating certificate!"), err
+	}
+	return prepareResponse(v1.Status_OK, "Certificate created successfully"), nil
+}
+
+func (s *certManagerServiceServer) Renew(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+	logLine(fmt.Sprintf("> Renewing certificate of instance:%s in namespace:%s", depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	certificate, err := s.dynamicAPI.Resource(certificateResource).Namespace(depl.Namespace).Get(ctx, getCertificateName(depl.Uid), metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Certificate does not exist"), err
+	}
+
+	if c := findCondition(certificate, "Issuing"); c != nil && conditionField(c, "status") == "True" {
+		return prepareResponse(v1.Status_OK, "Certificate issuance already in progress"), nil
+	}
+
+	//same as cmctl renew, cert-manager starts issuance once Issuing condition is set
+	conditions, _, _ := unstructured.NestedSlice(certificate.Object, "status", "conditions")
+	remaining := make([]interface{}, 0, len(conditions)+1)
+	for _, c := range conditions {
+		if condition, ok := c.(map[string]interface{}); ok && condition["type"] == "Issuing" {
+			continue
+		}
+		remaining = append(remaining, c)
+	}
+	remaining = append(remaining, map[string]interface{}{
+		"type": "Issuing",
+		"status": "True",
+		"reason": "ManuallyTriggered",
+		"message": "Certificate re-issuance manually triggered",
+		"lastTransitionTime": time.Now().UTC().Format(time.RFC3339),
+	})
+	if err = unstructured.SetNestedSlice(certificate.Object, remaining, "status", "conditions"); err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while triggering renewal!"), err
+	}
+
+	_, err = s.dynamicAPI.Resource(certificateResource).Namespace(depl.Namespace).UpdateStatus(ctx, certificate, metav1.UpdateOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while triggering renewal!"), err
+	}
+	return prepareResponse(v1.Status_OK, "Certificate renewal triggered"), nil
+}
+
+func (s *certManagerServiceServer) GetStatus(ctx context.Context, req *v1.InstanceRequest) (*v1.CertificateStatusResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareCertificateStatusResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	certificate, err := s.dynamicAPI.Resource(certificateResource).Namespace(depl.Namespace).Get(ctx, getCertificateName(depl.Uid), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return prepareCertificateStatusResponse(v1.Status_FAILED, "Certificate does not exist"), nil
+	}
+	if err != nil {
+		return prepareCertificateStatusResponse(v1.Status_FAILED, "Error while retrieving certificate!"), err
+	}
+
+	res := prepareCertificateStatusResponse(v1.Status_PENDING, "")
+	res.Issuer, _, _ = unstructured.NestedString(certificate.Object, "spec", "issuerRef", "name")
+	kind, _, _ := unstructured.NestedString(certificate.Object, "spec", "issuerRef", "kind")
+	res.IssuerKind = parseIssuerKind(kind)
+	if hostnames, found, _ := unstructured.NestedStringSlice(certificate.Object, "spec", "dnsNames"); found {
+		res.Hostnames = hostnames
+	}
+	res.NotAfter, _, _ = unstructured.NestedString(certificate.Object, "status", "notAfter")
+	res.RenewalTime, _, _ = unstructured.NestedString(certificate.Object, "status", "renewalTime")
+
+	if c := findCondition(certificate, "Ready"); c != nil {
+		res.Ready = conditionField(c, "status") == "True"
+		res.Message = conditionField(c, "message")
+	}
+	res.LastFailureReason = s.lastFailureReason(ctx, certificate)
+
+	if res.Ready {
+		res.Status = v1.Status_OK
+	} else if len(res.LastFailureReason) > 0 {
+		res.Status = v1.Status_FAILED
+	}
+	return res, nil
+}
+
+func (s *certManagerServiceServer) Upload(ctx context.Context, req *v1.InstanceCertificateUploadRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Instance
+	logLine(fmt.Sprintf("> Uploading certificate for instance:%s in namespace:%s", depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	hostnames, err := s.certificateHostnames(ctx, depl, req.Hostnames)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Invalid hostnames"), err
+	}
+
+	chain, err := parseCertificateChain([]byte(req.CertificateChain))
+	if err != nil {
+		return rejectCertificate(err)
+	}
+	key, err := parsePrivateKey([]byte(req.PrivateKey))
+	if err != nil {
+		return rejectCertificate(err)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		logLine(fmt.Sprintf("System certificate pool not available: %s", err))
+		roots = nil
+	}
+	if err = validateCertificateChain(chain, key, hostnames, roots, time.Now()); err != nil {
+		return rejectCertificate(err)
+	}
+
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return rejectCertificate(err)
+	}
+
+	//cert-manager would overwrite uploaded certificate
+	err = s.deleteCertificate(ctx, depl.Namespace, getCertificateName(depl.Uid))
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while removing certificate!"), err
+	}
+
+	secret := &apiv1.Secret{}
+	secret.SetNamespace(depl.Namespace)
+	secret.SetName(getCertificateSecretName(depl.Uid))
+	secret.SetLabels(map[string]string{s.instanceLabel: depl.Uid, componentLabel: certificateComponent})
+	secret.Type = apiv1.SecretTypeTLS
+	secret.Data = map[string][]byte{
+		apiv1.TLSCertKey: encodeCertificateChain(chain),
+		apiv1.TLSPrivateKeyKey: keyPEM,
+	}
+
+	existing, err := s.kubeAPI.CoreV1().Secrets(depl.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+	if err == nil {
+		if existing.Type == apiv1.SecretTypeTLS {
+			existing.Data = secret.Data
+			_, err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Update(ctx, existing, metav1.UpdateOptions{})
+			if err != nil {
+				return prepareResponse(v1.Status_FAILED, "Error while updating secret!"), err
+			}
+			return prepareResponse(v1.Status_OK, "Certificate updated successfully"), nil
+		}
+		//secret type is immutable
+		err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Delete(ctx, secret.Name, metav1.DeleteOptions{})
+		if err != nil {
+			return prepareResponse(v1.Status_FAILED, "Error while removing secret!"), err
+		}
+	}
+
+	_, err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while creating secret!"), err
+	}
+	return prepareResponse(v1.Status_OK, "Certificate uploaded successfully"), nil
+}
+
+//Reject uploaded certificate with specific reason
+func rejectCertificate(reason error) (*v1.ServiceResponse, error) {
+	logLine(fmt.Sprintf("< Certificate rejected: %s", reason))
+	return prepareResponse(v1.Status_FAILED, "Certificate rejected: " + reason.Error()),
+		status.Errorf(codes.InvalidArgument, "Certificate rejected: %s", reason)
+}
+
+func (s *certManagerServiceServer) ListCertificates(ctx context.Context, req *v1.CertificateListRequest) (*v1.CertificateListResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	logLine(fmt.Sprintf("> Listing certificates in namespace:'%s' for domain:'%s'", req.Namespace, req.Domain))
+
+	res := &v1.CertificateListResponse{Api: apiVersion, Status: v1.Status_OK, Certificates: make([]*v1.CertificateInfo, 0)}
+
+	secrets, err := findCertificateSecrets(ctx, s.kubeAPI, req.Namespace)
+	if err != nil {
+		res.Status = v1.Status_FAILED
+		res.Message = "Error while retrieving secrets"
+		return res, err
+	}
+
+	now := time.Now()
+	skipped := 0
+	for i := range secrets {
+		info, err := describeCertificateSecret(&secrets[i], now)
+		if err != nil {
+			logLine(fmt.Sprintf("Skipping secret %s/%s: %s", secrets[i].Namespace, secrets[i].Name, err))
+			skipped++
+			continue
+		}
+		if len(req.Domain) > 0 && !certificateInDomain(info, req.Domain) {
+			continue
+		}
+		res.Certificates = append(res.Certificates, info)
+	}
+
+	if skipped > 0 {
+		res.Message = fmt.Sprintf("%d secret(s) could not be parsed", skipped)
+	}
+	return res, nil
+}
@@ -0,0 +1,425 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFakeCertManagerClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			certificateResource: "CertificateList",
+			certificateRequestResource: "CertificateRequestList",
+		}, objects...)
+}
+
+func newFakeCertManagerServer() (*testclient.Clientset, *dynamicfake.FakeDynamicClient, v1.CertManagerServiceServer) {
+	client := testclient.NewSimpleClientset()
+	dynamicClient := newFakeCertManagerClient()
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+	return client, dynamicClient, NewCertManagerServiceServer(client, dynamicClient, "")
+}
+
+func TestCertManagerServiceServer_CreateOrReplace(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewCertManagerServiceServer(client, newFakeCertManagerClient(), "")
+	creq := v1.InstanceCertificateRequest{Api: apiVersion, Instance: &inst, Issuer: "letsencrypt"}
+
+	//Fail on API version check
+	res, err := server.CreateOrReplace(context.Background(), &v1.InstanceCertificateRequest{Api: "illegal", Instance: &inst})
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail without issuer
+	res, err = server.CreateOrReplace(context.Background(), &v1.InstanceCertificateRequest{Api: apiVersion, Instance: &inst})
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	res, err = server.CreateOrReplace(context.Background(), &creq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	client, dynamicClient, server := newFakeCertManagerServer()
+
+	//Fail without hostnames and ingress
+	res, err = server.CreateOrReplace(context.Background(), &creq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Fail on invalid hostname
+	res, err = server.CreateOrReplace(context.Background(), &v1.InstanceCertificateRequest{Api: apiVersion, Instance: &inst,
+		Issuer: "letsencrypt", Hostnames: []string{"not a hostname"}})
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Pass with hostnames taken from ingress
+	ing := networkingv1.Ingress{}
+	ing.Name = "test-uid"
+	ing.Spec.Rules = []networkingv1.IngressRule{{Host: "app.example.org"}, {Host: "App.example.org"}}
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &ing, metav1.CreateOptions{})
+
+	res, err = server.CreateOrReplace(context.Background(), &creq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+
+	certificate, err := dynamicClient.Resource(certificateResource).Namespace("test-namespace").Get(context.Background(), "test-uid-tls", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostnames, _, _ := unstructured.NestedStringSlice(certificate.Object, "spec", "dnsNames")
+	secretName, _, _ := unstructured.NestedString(certificate.Object, "spec", "secretName")
+	kind, _, _ := unstructured.NestedString(certificate.Object, "spec", "issuerRef", "kind")
+	if len(hostnames) != 1 || hostnames[0] != "app.example.org" || secretName != "test-uid-tls" || kind != "ClusterIssuer" {
+		t.Fail()
+	}
+
+	//Should replace spec of existing certificate
+	res, err = server.CreateOrReplace(context.Background(), &v1.InstanceCertificateRequest{Api: apiVersion, Instance: &inst,
+		Issuer: "internal-ca", IssuerKind: v1.IssuerKind_ISSUER, Hostnames: []string{"app.example.org", "*.app.example.org"}})
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	certificate, _ = dynamicClient.Resource(certificateResource).Namespace("test-namespace").Get(context.Background(), "test-uid-tls", metav1.GetOptions{})
+	hostnames, _, _ = unstructured.NestedStringSlice(certificate.Object, "spec", "dnsNames")
+	issuer, _, _ := unstructured.NestedString(certificate.Object, "spec", "issuerRef", "name")
+	kind, _, _ = unstructured.NestedString(certificate.Object, "spec", "issuerRef", "kind")
+	if len(hostnames) != 2 || issuer != "internal-ca" || kind != "Issuer" {
+		t.Fail()
+	}
+}
+
+func TestCertManagerServiceServer_Renew(t *testing.T) {
+	_, dynamicClient, server := newFakeCertManagerServer()
+
+	//Fail on API version check
+	res, err := server.Renew(context.Background(), &illegal_req)
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail without certificate
+	res, err = server.Renew(context.Background(), &req)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	_, _ = server.CreateOrReplace(context.Background(), &v1.InstanceCertificateRequest{Api: apiVersion, Instance: &inst,
+		Issuer: "letsencrypt", Hostnames: []string{"app.example.org"}})
+
+	//Pass
+	res, err = server.Renew(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+	certificate, _ := dynamicClient.Resource(certificateResource).Namespace("test-namespace").Get(context.Background(), "test-uid-tls", metav1.GetOptions{})
+	c := findCondition(certificate, "Issuing")
+	if c == nil || c["status"] != "True" || c["reason"] != "ManuallyTriggered" {
+		t.Fail()
+	}
+
+	//Pass when issuance already in progress
+	res, err = server.Renew(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || res.Message != "Certificate issuance already in progress" {
+		t.Fail()
+	}
+}
+
+func TestCertManagerServiceServer_GetStatus(t *testing.T) {
+	_, dynamicClient, server := newFakeCertManagerServer()
+
+	//Fail on API version check
+	res, err := server.GetStatus(context.Background(), &illegal_req)
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	freq := v1.InstanceRequest{Api: apiVersion, Deployment: &fake_ns_inst}
+	res, err = server.GetStatus(context.Background(), &freq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Fail without certificate
+	res, err = server.GetStatus(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	certificate := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cert-manager.io/v1",
+		"kind": "Certificate",
+		"metadata": map[string]interface{}{"name": "test-uid-tls", "namespace": "test-namespace"},
+		"spec": map[string]interface{}{
+			"secretName": "test-uid-tls",
+			"dnsNames": []interface{}{"app.example.org"},
+			"issuerRef": map[string]interface{}{"name": "letsencrypt", "kind": "ClusterIssuer"},
+		},
+		"status": map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Ready", "status": "False", "message": "Issuing certificate as Secret does not exist"},
+			},
+		},
+	}}
+	_, _ = dynamicClient.Resource(certificateResource).Namespace("test-namespace").Create(context.Background(), certificate, metav1.CreateOptions{})
+
+	//Pending while certificate is issued
+	res, err = server.GetStatus(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_PENDING || res.Ready || res.Issuer != "letsencrypt" ||
+		res.IssuerKind != v1.IssuerKind_CLUSTER_ISSUER || len(res.Hostnames) != 1 {
+		t.Fail()
+	}
+
+	//Failed CertificateRequest should be reported
+	request := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cert-manager.io/v1",
+		"kind": "CertificateRequest",
+		"metadata": map[string]interface{}{
+			"name": "test-uid-tls-1",
+			"namespace": "test-namespace",
+			"annotations": map[string]interface{}{"cert-manager.io/certificate-name": "test-uid-tls"},
+		},
+		"status": map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{"type": "Ready", "status": "False", "reason": "Failed", "message": "rate limited"},
+			},
+		},
+	}}
+	_, _ = dynamicClient.Resource(certificateRequestResource).Namespace("test-namespace").Create(context.Background(), request, metav1.CreateOptions{})
+
+	res, err = server.GetStatus(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_FAILED || !strings.Contains(res.LastFailureReason, "rate limited") {
+		t.Fail()
+	}
+
+	//Ready certificate
+	_ = unstructured.SetNestedSlice(certificate.Object, []interface{}{
+		map[string]interface{}{"type": "Ready", "status": "True", "message": "Certificate is up to date and has not expired"},
+	}, "status", "conditions")
+	_ = unstructured.SetNestedField(certificate.Object, "2030-01-01T00:00:00Z", "status", "notAfter")
+	_, _ = dynamicClient.Resource(certificateResource).Namespace("test-namespace").Update(context.Background(), certificate, metav1.UpdateOptions{})
+
+	res, err = server.GetStatus(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || !res.Ready || res.NotAfter != "2030-01-01T00:00:00Z" {
+		t.Fail()
+	}
+}
+
+func TestCertManagerServiceServer_DeleteIfExistsRemovesCertificate(t *testing.T) {
+	client, dynamicClient, server := newFakeCertManagerServer()
+
+	_, _ = server.CreateOrReplace(context.Background(), &v1.InstanceCertificateRequest{Api: apiVersion, Instance: &inst,
+		Issuer: "letsencrypt", Hostnames: []string{"app.example.org"}})
+	sec := corev1.Secret{}
+	sec.Name = "test-uid-tls"
+	_, _ = client.CoreV1().Secrets("test-namespace").Create(context.Background(), &sec, metav1.CreateOptions{})
+
+	res, err := server.DeleteIfExists(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	_, err = dynamicClient.Resource(certificateResource).Namespace("test-namespace").Get(context.Background(), "test-uid-tls", metav1.GetOptions{})
+	if err == nil {
+		t.Fail()
+	}
+	_, err = client.CoreV1().Secrets("test-namespace").Get(context.Background(), "test-uid-tls", metav1.GetOptions{})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestCertManagerServiceServer_Upload(t *testing.T) {
+	root := newTestCertificate(t, "Test Root CA", nil, time.Now().Add(24*time.Hour), nil)
+	leaf := newTestCertificate(t, "app.example.org", []string{"app.example.org"}, time.Now().Add(time.Hour), root)
+	other := newTestCertificate(t, "other.example.org", []string{"other.example.org"}, time.Now().Add(time.Hour), root)
+	ureq := v1.InstanceCertificateUploadRequest{Api: apiVersion, Instance: &inst, CertificateChain: encodeTestChain(leaf, root),
+		PrivateKey: encodeTestKey(t, leaf), Hostnames: []string{"app.example.org"}}
+
+	client := testclient.NewSimpleClientset()
+	server := NewCertManagerServiceServer(client, newFakeCertManagerClient(), "")
+
+	//Fail on API version check
+	res, err := server.Upload(context.Background(), &v1.InstanceCertificateUploadRequest{Api: "illegal", Instance: &inst})
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	res, err = server.Upload(context.Background(), &ureq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	client, dynamicClient, server := newFakeCertManagerServer()
+
+	//Fail with specific reasons
+	rejected := []v1.InstanceCertificateUploadRequest{
+		{Api: apiVersion, Instance: &inst, CertificateChain: "", PrivateKey: ureq.PrivateKey, Hostnames: ureq.Hostnames},
+		{Api: apiVersion, Instance: &inst, CertificateChain: ureq.CertificateChain, PrivateKey: encodeTestKey(t, other), Hostnames: ureq.Hostnames},
+		{Api: apiVersion, Instance: &inst, CertificateChain: encodeTestChain(leaf), PrivateKey: ureq.PrivateKey, Hostnames: ureq.Hostnames},
+		{Api: apiVersion, Instance: &inst, CertificateChain: ureq.CertificateChain, PrivateKey: ureq.PrivateKey, Hostnames: []string{"www.example.org"}},
+	}
+	reasons := []string{"no certificate found", "private key does not match", "chain is incomplete", "does not cover hostname"}
+	for i := range rejected {
+		res, err = server.Upload(context.Background(), &rejected[i])
+		if err == nil || res.Status != v1.Status_FAILED || !strings.Contains(res.Message, reasons[i]) {
+			t.Errorf("expected rejection '%s', got '%s'", reasons[i], res.Message)
+		}
+	}
+
+	//Pass replacing existing cert-manager certificate and opaque secret
+	_, _ = server.CreateOrReplace(context.Background(), &v1.InstanceCertificateRequest{Api: apiVersion, Instance: &inst,
+		Issuer: "letsencrypt", Hostnames: []string{"app.example.org"}})
+	sec := corev1.Secret{}
+	sec.Name = "test-uid-tls"
+	sec.Type = corev1.SecretTypeOpaque
+	_, _ = client.CoreV1().Secrets("test-namespace").Create(context.Background(), &sec, metav1.CreateOptions{})
+
+	res, err = server.Upload(context.Background(), &ureq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+
+	stored, err := client.CoreV1().Secrets("test-namespace").Get(context.Background(), "test-uid-tls", metav1.GetOptions{})
+	if err != nil || stored.Type != corev1.SecretTypeTLS {
+		t.Fatal(err)
+	}
+	chain, err := parseCertificateChain(stored.Data[corev1.TLSCertKey])
+	if err != nil || len(chain) != 2 || !chain[0].Equal(leaf.certificate) {
+		t.Fail()
+	}
+	if _, err = parsePrivateKey(stored.Data[corev1.TLSPrivateKeyKey]); err != nil {
+		t.Fail()
+	}
+	_, err = dynamicClient.Resource(certificateResource).Namespace("test-namespace").Get(context.Background(), "test-uid-tls", metav1.GetOptions{})
+	if err == nil {
+		t.Fail()
+	}
+
+	//Pass updating previously uploaded certificate
+	res, err = server.Upload(context.Background(), &ureq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+}
+
+//Store certificate in TLS secret as cert-manager would
+func createTestCertificateSecret(t *testing.T, client *testclient.Clientset, namespace string, name string, c *testCertificate) {
+	sec := corev1.Secret{}
+	sec.Name = name
+	sec.Type = corev1.SecretTypeTLS
+	sec.Data = map[string][]byte{corev1.TLSCertKey: []byte(encodeTestChain(c)), corev1.TLSPrivateKeyKey: []byte(encodeTestKey(t, c))}
+	_, err := client.CoreV1().Secrets(namespace).Create(context.Background(), &sec, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertManagerServiceServer_CustomLabel(t *testing.T) {
+	root := newTestCertificate(t, "Test Root CA", nil, time.Now().Add(24*time.Hour), nil)
+	leaf := newTestCertificate(t, "app.example.org", []string{"app.example.org"}, time.Now().Add(time.Hour), root)
+	client, dynamicClient, _ := newFakeCertManagerServer()
+	server := NewCertManagerServiceServer(client, dynamicClient, "nmaas.eu/instance")
+
+	res, err := server.CreateOrReplace(context.Background(), &v1.InstanceCertificateRequest{Api: apiVersion, Instance: &inst,
+		Issuer: "letsencrypt", Hostnames: []string{"app.example.org"}})
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+	certificate, err := dynamicClient.Resource(certificateResource).Namespace("test-namespace").Get(context.Background(), "test-uid-tls", metav1.GetOptions{})
+	if err != nil || certificate.GetLabels()["nmaas.eu/instance"] != "test-uid" || len(certificate.GetLabels()[instanceLabel]) != 0 {
+		t.Errorf("certificate not labelled with configured label %v, %v", certificate, err)
+	}
+
+	res, err = server.Upload(context.Background(), &v1.InstanceCertificateUploadRequest{Api: apiVersion, Instance: &inst,
+		CertificateChain: encodeTestChain(leaf, root), PrivateKey: encodeTestKey(t, leaf), Hostnames: []string{"app.example.org"}})
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+	secret, err := client.CoreV1().Secrets("test-namespace").Get(context.Background(), "test-uid-tls", metav1.GetOptions{})
+	if err != nil || secret.Labels["nmaas.eu/instance"] != "test-uid" || len(secret.Labels[instanceLabel]) != 0 {
+		t.Errorf("secret not labelled with configured label %v, %v", secret, err)
+	}
+}
+
+func TestCertManagerServiceServer_ListCertificates(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewCertManagerServiceServer(client, newFakeCertManagerClient(), "")
+
+	//Fail on API version check
+	res, err := server.ListCertificates(context.Background(), &v1.CertificateListRequest{Api: "illegal"})
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Pass with no certificates
+	res, err = server.ListCertificates(context.Background(), &v1.CertificateListRequest{Api: apiVersion})
+	if err != nil || res.Status != v1.Status_OK || len(res.Certificates) != 0 {
+		t.Fail()
+	}
+
+	root := newTestCertificate(t, "Test Root CA", nil, time.Now().Add(365*24*time.Hour), nil)
+	first := newTestCertificate(t, "app.first.example.org", []string{"app.first.example.org"}, time.Now().Add(10*24*time.Hour+time.Hour), root)
+	second := newTestCertificate(t, "app.second.example.org", []string{"app.second.example.org", "*.second.example.org"}, time.Now().Add(90*24*time.Hour+time.Hour), root)
+	createTestCertificateSecret(t, client, "first", "first-uid-tls", first)
+	createTestCertificateSecret(t, client, "second", "second-uid-tls", second)
+	//secrets not following instance naming convention or not holding certificate are skipped or reported
+	createTestCertificateSecret(t, client, "second", "webhook-cert", second)
+	broken := corev1.Secret{}
+	broken.Name = "broken-uid-tls"
+	broken.Type = corev1.SecretTypeTLS
+	_, _ = client.CoreV1().Secrets("second").Create(context.Background(), &broken, metav1.CreateOptions{})
+
+	res, err = server.ListCertificates(context.Background(), &v1.CertificateListRequest{Api: apiVersion})
+	if err != nil || len(res.Certificates) != 2 || !strings.Contains(res.Message, "1 secret") {
+		t.Fatal(err)
+	}
+	for _, c := range res.Certificates {
+		if c.SecretName == "first-uid-tls" && (c.ExpiresInDays != 10 || c.Namespace != "first" || c.Hostnames[0] != "app.first.example.org" ||
+			!strings.Contains(c.Subject, "CN=app.first.example.org") || !strings.Contains(c.Issuer, "CN=Test Root CA")) {
+			t.Errorf("unexpected certificate info %v", c)
+		}
+		if c.SecretName == "second-uid-tls" && (c.ExpiresInDays != 90 || len(c.Hostnames) != 2) {
+			t.Errorf("unexpected certificate info %v", c)
+		}
+		if _, err := time.Parse(time.RFC3339, c.NotAfter); err != nil {
+			t.Fail()
+		}
+	}
+
+	//Filter by namespace
+	res, err = server.ListCertificates(context.Background(), &v1.CertificateListRequest{Api: apiVersion, Namespace: "first"})
+	if err != nil || len(res.Certificates) != 1 || res.Certificates[0].SecretName != "first-uid-tls" {
+		t.Fail()
+	}
+
+	//Filter by domain
+	res, err = server.ListCertificates(context.Background(), &v1.CertificateListRequest{Api: apiVersion, Domain: "second.example.org"})
+	if err != nil || len(res.Certificates) != 1 || res.Certificates[0].SecretName != "second-uid-tls" {
+		t.Fail()
+	}
+	res, err = server.ListCertificates(context.Background(), &v1.CertificateListRequest{Api: apiVersion, Domain: "example.com"})
+	if err != nil || len(res.Certificates) != 0 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,198 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"math"
+	"strings"
+	"time"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+//Public key of every key type supported by crypto/x509 implements this interface
+type comparablePublicKey interface {
+	Equal(crypto.PublicKey) bool
+}
+
+//Parse all certificates from PEM data, leaf certificate is expected first
+func parseCertificateChain(data []byte) ([]*x509.Certificate, error) {
+	chain := make([]*x509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block '%s' in certificate chain", block.Type)
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %d of the chain could not be parsed: %s", len(chain)+1, err)
+		}
+		chain = append(chain, certificate)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate found in PEM data")
+	}
+	return chain, nil
+}
+
+//Parse private key in PKCS#1, SEC 1 or PKCS#8 format
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no private key found in PEM data")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		return nil, errors.New("private key must not be encrypted")
+	default:
+		return nil, fmt.Errorf("unexpected PEM block '%s' instead of private key", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("private key could not be parsed: %s", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+//Encode certificates and key in PEM format expected in kubernetes.io/tls secrets
+func encodeCertificateChain(chain []*x509.Certificate) []byte {
+	var buffer bytes.Buffer
+	for _, certificate := range chain {
+		_ = pem.Encode(&buffer, &pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+	}
+	return buffer.Bytes()
+}
+
+func encodePrivateKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+//Check that uploaded certificate chain and key are usable for given hostnames.
+//Chain is verified against system roots and self-signed certificates included in the chain,
+//which allows certificates issued by institutional CAs.
+func validateCertificateChain(chain []*x509.Certificate, key crypto.Signer, hostnames []string, roots *x509.CertPool, now time.Time) error {
+	leaf := chain[0]
+
+	publicKey, ok := leaf.PublicKey.(comparablePublicKey)
+	if !ok || !publicKey.Equal(key.Public()) {
+		return errors.New("private key does not match certificate")
+	}
+
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate is not valid before %s", leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired on %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	if roots == nil {
+		roots = x509.NewCertPool()
+	}
+	intermediates := x509.NewCertPool()
+	for _, certificate := range chain[1:] {
+		if bytes.Equal(certificate.RawIssuer, certificate.RawSubject) && certificate.CheckSignatureFrom(certificate) == nil {
+			roots.AddCert(certificate)
+		} else {
+			intermediates.AddCert(certificate)
+		}
+	}
+
+	options := x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: now}
+	if _, err := leaf.Verify(options); err != nil {
+		var unknownAuthority x509.UnknownAuthorityError
+		if errors.As(err, &unknownAuthority) {
+			return fmt.Errorf("certificate chain is incomplete, issuer '%s' of '%s' not found",
+				unknownAuthority.Cert.Issuer.String(), unknownAuthority.Cert.Subject.String())
+		}
+		return fmt.Errorf("certificate chain is invalid: %s", err)
+	}
+
+	for _, hostname := range hostnames {
+		if err := leaf.VerifyHostname(hostname); err != nil {
+			return fmt.Errorf("certificate does not cover hostname '%s'", hostname)
+		}
+	}
+	return nil
+}
+
+//Find TLS secrets following instance naming convention, in all namespaces if namespace is empty
+func findCertificateSecrets(ctx context.Context, kubeAPI kubernetes.Interface, namespace string) ([]apiv1.Secret, error) {
+	all, err := kubeAPI.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{FieldSelector: "type=" + string(apiv1.SecretTypeTLS)})
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make([]apiv1.Secret, 0)
+	for _, secret := range all.Items {
+		if secret.Type == apiv1.SecretTypeTLS && strings.HasSuffix(secret.Name, "-tls") {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets, nil
+}
+
+//Describe leaf certificate stored in TLS secret
+func describeCertificateSecret(secret *apiv1.Secret, now time.Time) (*v1.CertificateInfo, error) {
+	chain, err := parseCertificateChain(secret.Data[apiv1.TLSCertKey])
+	if err != nil {
+		return nil, err
+	}
+	leaf := chain[0]
+
+	hostnames := make([]string, 0, len(leaf.DNSNames)+len(leaf.IPAddresses))
+	hostnames = append(hostnames, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		hostnames = append(hostnames, ip.String())
+	}
+
+	return &v1.CertificateInfo{
+		Namespace: secret.Namespace,
+		SecretName: secret.Name,
+		Subject: leaf.Subject.String(),
+		Hostnames: hostnames,
+		Issuer: leaf.Issuer.String(),
+		NotAfter: leaf.NotAfter.UTC().Format(time.RFC3339),
+		ExpiresInDays: int32(math.Floor(leaf.NotAfter.Sub(now).Hours() / 24)),
+	}, nil
+}
+
+//Check if any of certificate hostnames belongs to given domain
+func certificateInDomain(info *v1.CertificateInfo, domain string) bool {
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	for _, host := range info.Hostnames {
+		host = strings.ToLower(strings.TrimPrefix(host, "*."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package v1
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key crypto.Signer
+}
+
+//Generate certificate signed by given parent, self-signed if parent is nil
+func newTestCertificate(t *testing.T, name string, hostnames []string, notAfter time.Time, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: name, Organization: []string{"NMaaS Test"}},
+		DNSNames: hostnames,
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: notAfter,
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA: len(hostnames) == 0,
+	}
+
+	issuer, signer := template, crypto.Signer(key)
+	if parent != nil {
+		issuer, signer = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	return &testCertificate{certificate: certificate, key: key}
+}
+
+func encodeTestChain(certificates ...*testCertificate) string {
+	var builder strings.Builder
+	for _, c := range certificates {
+		builder.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.certificate.Raw}))
+	}
+	return builder.String()
+}
+
+func encodeTestKey(t *testing.T, c *testCertificate) string {
+	key, err := encodePrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(key)
+}
+
+func TestParseCertificateChain(t *testing.T) {
+	root := newTestCertificate(t, "Test Root CA", nil, time.Now().Add(24*time.Hour), nil)
+	leaf := newTestCertificate(t, "app.example.org", []string{"app.example.org"}, time.Now().Add(time.Hour), root)
+
+	chain, err := parseCertificateChain([]byte(encodeTestChain(leaf, root)))
+	if err != nil || len(chain) != 2 || chain[0].Subject.CommonName != "app.example.org" {
+		t.Fail()
+	}
+
+	_, err = parseCertificateChain([]byte("garbage"))
+	if err == nil || !strings.Contains(err.Error(), "no certificate found") {
+		t.Fail()
+	}
+
+	_, err = parseCertificateChain([]byte(encodeTestKey(t, leaf)))
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	leaf := newTestCertificate(t, "app.example.org", []string{"app.example.org"}, time.Now().Add(time.Hour), nil)
+
+	key, err := parsePrivateKey([]byte(encodeTestKey(t, leaf)))
+	if err != nil || !key.Public().(*ecdsa.PublicKey).Equal(leaf.key.Public()) {
+		t.Fail()
+	}
+
+	der, _ := x509.MarshalECPrivateKey(leaf.key.(*ecdsa.PrivateKey))
+	_, err = parsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fail()
+	}
+
+	_, err = parsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}))
+	if err == nil || !strings.Contains(err.Error(), "encrypted") {
+		t.Fail()
+	}
+
+	_, err = parsePrivateKey([]byte(""))
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestValidateCertificateChain(t *testing.T) {
+	now := time.Now()
+	root := newTestCertificate(t, "Test Root CA", nil, now.Add(24*time.Hour), nil)
+	intermediate := newTestCertificate(t, "Test Intermediate CA", nil, now.Add(24*time.Hour), root)
+	leaf := newTestCertificate(t, "app.example.org", []string{"app.example.org"}, now.Add(time.Hour), intermediate)
+	other := newTestCertificate(t, "other.example.org", []string{"other.example.org"}, now.Add(time.Hour), intermediate)
+	expired := newTestCertificate(t, "app.example.org", []string{"app.example.org"}, now.Add(-time.Minute), intermediate)
+
+	tests := []struct {
+		name string
+		chain []*testCertificate
+		key *testCertificate
+		hostnames []string
+		reason string
+	}{
+		{"complete chain", []*testCertificate{leaf, intermediate, root}, leaf, []string{"app.example.org"}, ""},
+		{"key mismatch", []*testCertificate{leaf, intermediate, root}, other, []string{"app.example.org"}, "does not match"},
+		{"missing intermediate", []*testCertificate{leaf, root}, leaf, []string{"app.example.org"}, "chain is incomplete"},
+		{"hostname not covered", []*testCertificate{leaf, intermediate, root}, leaf, []string{"www.example.org"}, "does not cover hostname 'www.example.org'"},
+		{"expired", []*testCertificate{expired, intermediate, root}, expired, []string{"app.example.org"}, "expired"},
+	}
+
+	for _, test := range tests {
+		chain := make([]*x509.Certificate, 0)
+		for _, c := range test.chain {
+			chain = append(chain, c.certificate)
+		}
+		err := validateCertificateChain(chain, test.key.key, test.hostnames, nil, now)
+		if len(test.reason) == 0 && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if len(test.reason) > 0 && (err == nil || !strings.Contains(err.Error(), test.reason)) {
+			t.Errorf("%s: expected error containing '%s', got %v", test.name, test.reason, err)
+		}
+	}
+}
@@ -9,16 +9,15 @@ import (
 	apiv1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	metricsclient "k8s.io/metrics/pkg/client/clientset/versioned"
 	"log"
-	"math/rand"
 	"strings"
 	"fmt"
-	"bytes"
-	"io"
+	"time"
 
 	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
-	"github.com/johnaoss/htpasswd/apr1"
 )
 
 const (
@@ -33,22 +32,33 @@ type configServiceServer struct {
 
 type basicAuthServiceServer struct {
 	kubeAPI kubernetes.Interface
+	dynamicAPI dynamic.Interface
+	hashScheme v1.HashScheme
+	ingressController IngressController
+	instanceLabel string
 }
 
 type certManagerServiceServer struct {
 	kubeAPI kubernetes.Interface
+	dynamicAPI dynamic.Interface
+	instanceLabel string
 }
 
 type readinessServiceServer struct {
 	kubeAPI kubernetes.Interface
+	instanceLabel string
 }
 
 type informationServiceServer struct {
 	kubeAPI kubernetes.Interface
+	dynamicAPI dynamic.Interface
+	instanceLabel string
 }
 
 type podServiceServer struct {
 	kubeAPI kubernetes.Interface
+	metricsAPI metricsclient.Interface
+	instanceLabel string
 }
 
 type namespaceServiceServer struct {
@@ -59,24 +69,41 @@ func NewConfigServiceServer(kubeAPI kubernetes.Interface, gitAPI *gitlab.Client)
 	return &configServiceServer{kubeAPI: kubeAPI, gitAPI: gitAPI}
 }
 
-func NewBasicAuthServiceServer(kubeAPI kubernetes.Interface) v1.BasicAuthServiceServer {
-	return &basicAuthServiceServer{kubeAPI: kubeAPI}
+//Ingress objects of the instance are selected by given instance label or by instance name, empty label selects the default one
+func NewBasicAuthServiceServer(kubeAPI kubernetes.Interface, dynamicAPI dynamic.Interface, hashScheme v1.HashScheme, ingressController IngressController, label string) v1.BasicAuthServiceServer {
+	if len(label) == 0 {
+		label = instanceLabel
+	}
+	return &basicAuthServiceServer{kubeAPI: kubeAPI, dynamicAPI: dynamicAPI, hashScheme: hashScheme, ingressController: ingressController, instanceLabel: label}
 }
 
-func NewCertManagerServiceServer(kubeAPI kubernetes.Interface) v1.CertManagerServiceServer {
-	return &certManagerServiceServer{kubeAPI: kubeAPI}
+func NewCertManagerServiceServer(kubeAPI kubernetes.Interface, dynamicAPI dynamic.Interface, label string) v1.CertManagerServiceServer {
+	if len(label) == 0 {
+		label = instanceLabel
+	}
+	return &certManagerServiceServer{kubeAPI: kubeAPI, dynamicAPI: dynamicAPI, instanceLabel: label}
 }
 
-func NewReadinessServiceServer(kubeAPI kubernetes.Interface) v1.ReadinessServiceServer {
-	return &readinessServiceServer{kubeAPI: kubeAPI}
+func NewReadinessServiceServer(kubeAPI kubernetes.Interface, label string) v1.ReadinessServiceServer {
+	if len(label) == 0 {
+		label = instanceLabel
+	}
+	return &readinessServiceServer{kubeAPI: kubeAPI, instanceLabel: label}
 }
 
-func NewInformationServiceServer(kubeAPI kubernetes.Interface) v1.InformationServiceServer {
-	return &informationServiceServer{kubeAPI: kubeAPI}
+func NewInformationServiceServer(kubeAPI kubernetes.Interface, dynamicAPI dynamic.Interface, label string) v1.InformationServiceServer {
+	if len(label) == 0 {
+		label = instanceLabel
+	}
+	return &informationServiceServer{kubeAPI: kubeAPI, dynamicAPI: dynamicAPI, instanceLabel: label}
 }
 
-func NewPodServiceServer(kubeAPI kubernetes.Interface) v1.PodServiceServer {
-	return &podServiceServer{kubeAPI: kubeAPI}
+//Pods are discovered through selectors of instance workloads and given instance label, empty label selects the default one
+func NewPodServiceServer(kubeAPI kubernetes.Interface, metricsAPI metricsclient.Interface, label string) v1.PodServiceServer {
+	if len(label) == 0 {
+		label = instanceLabel
+	}
+	return &podServiceServer{kubeAPI: kubeAPI, metricsAPI: metricsAPI, instanceLabel: label}
 }
 
 func NewNamespaceServiceServer(kubeAPI kubernetes.Interface) v1.NamespaceServiceServer {
@@ -134,15 +161,35 @@ func preparePodLogsResponse(status v1.Status, message string, lines []string) *v
 	}
 }
 
+//Prepare user list response
+func prepareUserListResponse(status v1.Status, message string, users []string) *v1.UserListResponse {
+	return &v1.UserListResponse {
+		Api: apiVersion,
+		Status: status,
+		Message: message,
+		Users: users,
+	}
+}
+
 //Find proper project, given user namespace and instance uid
 func (s *configServiceServer) FindGitlabProjectId(api *gitlab.Client, uid string, domain string) (int, error) {
+	project, err := findGitlabProject(api, uid, domain)
+	if err != nil {
+		return -1, err
+	}
+
+    return project.ID, nil
+}
+
+//Find project in the GitLab group of given domain that belongs to instance uid
+func findGitlabProject(api *gitlab.Client, uid string, domain string) (*gitlab.Project, error) {
 	//Find exact group
 	logLine(fmt.Sprintf("Searching for GitLab Group by domain %s", domain))
 	groups, _, err := api.Groups.SearchGroup(domain)
 	if len(groups) != 1 || err != nil {
 		logLine(fmt.Sprintf("Found %d groups in domain %s", len(groups), domain))
 		log.Print(err)
-		return -1, status.Errorf(codes.NotFound, "Gitlab Group for given domain does not exist")
+		return nil, status.Errorf(codes.NotFound, "Gitlab Group for given domain does not exist")
 	}
 
     var projectName = "groups-" + domain + "/" + uid
@@ -151,10 +198,10 @@ func (s *configServiceServer) FindGitlabProjectId(api *gitlab.Client, uid string
     project, _, err := api.Projects.GetProject(projectName, &gitlab.GetProjectOptions{})
     if err != nil {
         log.Print(err)
-        return -1, status.Errorf(codes.NotFound, "Gitlab Project for given uid does not exist")
+        return nil, status.Errorf(codes.NotFound, "Gitlab Project for given uid does not exist")
     }
 
-    return project.ID, nil
+    return project, nil
 }
 
 //Parse repository files into string:string map for configmap creator
@@ -335,55 +382,53 @@ func (s *configServiceServer) DeleteIfExists(ctx context.Context, req *v1.Instan
 		}
 	}
 
-	return prepareResponse(v1.Status_OK, "ConfigMaps deleted successfully"), nil
-}
-
-func randomString(l int) string {
-	bytes := make([]byte, l)
-	for i := 0; i < l; i++ {
-		bytes[i] = byte(65 + rand.Intn(90-65))
-	}
-	return string(bytes)
-}
-
-func aprHashCredentials(user string, password string) (string, error) {
-	out, err := apr1.Hash(password, randomString(8))
+	//revoke repository deploy key or access token if one was issued for the instance
+	err = revokeRepositoryAccess(ctx, s.kubeAPI, s.gitAPI, depl.Namespace, depl.Uid)
 	if err != nil {
-		return "", status.Errorf(codes.Internal, "Failed to execute apr hashing")
+		logLine(fmt.Sprintf("Error occurred while revoking repository access for %s", depl.Uid))
 	}
-	return user + ":" + out, nil
-}
 
-func (s *basicAuthServiceServer) PrepareSecretDataFromCredentials(credentials *v1.Credentials) (map[string][]byte, error) {
-	hash, err := aprHashCredentials(credentials.User, credentials.Password)
-	if err != nil {
-		return nil, err
-	}
+	return prepareResponse(v1.Status_OK, "ConfigMaps deleted successfully"), nil
+}
 
+func (s *basicAuthServiceServer) PrepareSecretDataFromEntries(entries []htpasswdEntry) map[string][]byte {
 	resultMap := make(map[string][]byte)
-	resultMap["auth"] = []byte(hash)
+	resultMap[htpasswdSecretKey] = []byte(formatHtpasswd(entries))
+	//Traefik expects htpasswd content under different key
+	if s.ingressController == IngressControllerTraefik {
+		resultMap[traefikUsersSecretKey] = resultMap[htpasswdSecretKey]
+	}
 
-	return resultMap, nil
+	return resultMap
 }
 
-func (s *basicAuthServiceServer) PrepareSecretJsonFromCredentials(credentials *v1.Credentials) ([]byte, error) {
-	hash, err := aprHashCredentials(credentials.User, credentials.Password)
-
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to execute htpasswd executable")
+func (s *basicAuthServiceServer) PrepareSecretJsonFromEntries(entries []htpasswdEntry) []byte {
+	result := []byte("{\"data\": {")
+	separator := ""
+	for key, value := range s.PrepareSecretDataFromEntries(entries) {
+		result = append(result, separator + "\"" + key + "\": \""...)
+		result = append(result, base64.StdEncoding.EncodeToString(value)...)
+		result = append(result, "\""...)
+		separator = ", "
 	}
+	result = append(result, "}}"...)
 
-	result := []byte("{\"data\": {\"auth\": \"")
-	result = append(result, base64.StdEncoding.EncodeToString([]byte(hash))...)
-	result = append(result, "\"}}"...)
-
-	return result, nil
+	return result
 }
 
 func getAuthSecretName(uid string) string {
 	return uid + "-auth"
 }
 
+//Collect credentials given in the request, both the single entry and the list
+func requestedCredentials(req *v1.InstanceCredentialsRequest) []*v1.Credentials {
+	credentials := make([]*v1.Credentials, 0, len(req.CredentialsList)+1)
+	if req.Credentials != nil {
+		credentials = append(credentials, req.Credentials)
+	}
+	return append(credentials, req.CredentialsList...)
+}
+
 func (s *basicAuthServiceServer) CreateOrReplace(ctx context.Context, req *v1.InstanceCredentialsRequest) (*v1.ServiceResponse, error) {
 	// check if the API version requested by client is supported by server
 	if err := checkAPI(req.Api, apiVersion); err != nil {
@@ -391,6 +436,15 @@ func (s *basicAuthServiceServer) CreateOrReplace(ctx context.Context, req *v1.In
 	}
 
 	depl := req.Instance
+	credentials := requestedCredentials(req)
+	if len(credentials) == 0 {
+		return prepareResponse(v1.Status_FAILED, "No credentials provided"), status.Errorf(codes.InvalidArgument, "No credentials provided")
+	}
+	scheme := req.HashScheme
+	if scheme == v1.HashScheme_SERVER_DEFAULT {
+		scheme = s.hashScheme
+	}
+	logLine(fmt.Sprintf("> Applying %s of %d user(s) for instance:%s in namespace:%s", req.Operation.String(), len(credentials), depl.Uid, depl.Namespace))
 
 	//check if given k8s namespace exists
 	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
@@ -405,17 +459,22 @@ func (s *basicAuthServiceServer) CreateOrReplace(ctx context.Context, req *v1.In
 
 	secretName := getAuthSecretName(depl.Uid)
 
-	_, err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Get(ctx, secretName, metav1.GetOptions{})
+	existing, err := s.kubeAPI.CoreV1().Secrets(depl.Namespace).Get(ctx, secretName, metav1.GetOptions{})
 	//Secret does not exist, we have to create it
 	if err != nil {
+		entries, err := applyCredentialsOperation(nil, req.Operation, credentials, scheme)
+		if err != nil {
+			return prepareResponse(v1.Status_FAILED, "Error while preparing secret!"), err
+		}
+		if len(entries) == 0 {
+			return s.removeLastUser(ctx, depl)
+		}
+
 		//create secret
 		secret := apiv1.Secret{}
 		secret.SetNamespace(depl.Namespace)
 		secret.SetName(secretName)
-		secret.Data, err = s.PrepareSecretDataFromCredentials(req.Credentials)
-		if err != nil {
-			return prepareResponse(v1.Status_FAILED, "Error while preparing secret!"), err
-		}
+		secret.Data = s.PrepareSecretDataFromEntries(entries)
 
 		//commit secret
 		_, err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Create(ctx, &secret, metav1.CreateOptions{})
@@ -423,20 +482,80 @@ func (s *basicAuthServiceServer) CreateOrReplace(ctx context.Context, req *v1.In
 			return prepareResponse(v1.Status_FAILED, "Error while creating secret!"), err
 		}
 
-		return prepareResponse(v1.Status_OK, "Secret created successfully"), nil
+		return s.configureIngress(ctx, req, "Secret created successfully")
 	} else {
-		patch, err := s.PrepareSecretJsonFromCredentials(req.Credentials)
+		entries, err := applyCredentialsOperation(parseHtpasswd(string(existing.Data[htpasswdSecretKey])), req.Operation, credentials, scheme)
 		if err != nil {
 			return prepareResponse(v1.Status_FAILED, "Error while parsing configuration data"), err
 		}
+		if len(entries) == 0 {
+			return s.removeLastUser(ctx, depl)
+		}
+		patch := s.PrepareSecretJsonFromEntries(entries)
 
 		//patch secret
 		_, err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Patch(ctx, secretName, types.MergePatchType, patch, metav1.PatchOptions{})
 		if err != nil {
 			return prepareResponse(v1.Status_FAILED, "Error while patching secret!"), err
 		}
-		return prepareResponse(v1.Status_OK, "Secret updated successfully"), nil
+		return s.configureIngress(ctx, req, "Secret updated successfully")
+	}
+}
+
+//Remove basic auth once no users are left, empty htpasswd file would lock everyone out of the instance
+func (s *basicAuthServiceServer) removeLastUser(ctx context.Context, depl *v1.Instance) (*v1.ServiceResponse, error) {
+	logLine(fmt.Sprintf("No users left for instance %s, removing basic auth", depl.Uid))
+	res, err := s.removeBasicAuth(ctx, depl.Namespace, depl.Uid)
+	if err != nil {
+		return res, err
+	}
+	return prepareResponse(v1.Status_OK, "No users left, basic auth removed"), nil
+}
+
+//Enable basic auth on instance Ingress objects if requested, extending message of successful secret update.
+//Removing users never enables it.
+func (s *basicAuthServiceServer) configureIngress(ctx context.Context, req *v1.InstanceCredentialsRequest, message string) (*v1.ServiceResponse, error) {
+	if !req.ConfigureIngress || req.Operation == v1.CredentialsOperation_REMOVE {
+		return prepareResponse(v1.Status_OK, message), nil
+	}
+
+	depl := req.Instance
+	logLine(fmt.Sprintf("Configuring %s basic auth on Ingress of instance %s", s.ingressController, depl.Uid))
+	count, err := wireBasicAuth(ctx, s.kubeAPI, s.dynamicAPI, s.ingressController, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while configuring Ingress!"), err
+	}
+	if count == 0 {
+		return prepareResponse(v1.Status_OK, message + ", no Ingress found to configure"), nil
+	}
+	return prepareResponse(v1.Status_OK, fmt.Sprintf("%s, %d Ingress configured", message, count)), nil
+}
+
+func (s *basicAuthServiceServer) ListUsers(ctx context.Context, req *v1.InstanceRequest) (*v1.UserListResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareUserListResponse(v1.Status_FAILED, namespaceNotFound, nil), err
+	}
+
+	users := make([]string, 0)
+
+	secret, err := s.kubeAPI.CoreV1().Secrets(depl.Namespace).Get(ctx, getAuthSecretName(depl.Uid), metav1.GetOptions{})
+	if err != nil {
+		return prepareUserListResponse(v1.Status_OK, "Secret does not exist", users), nil
+	}
+
+	for _, entry := range parseHtpasswd(string(secret.Data[htpasswdSecretKey])) {
+		users = append(users, entry.user)
 	}
+	return prepareUserListResponse(v1.Status_OK, "", users), nil
 }
 
 func (s *basicAuthServiceServer) DeleteIfExists(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceResponse, error) {
@@ -453,22 +572,72 @@ func (s *basicAuthServiceServer) DeleteIfExists(ctx context.Context, req *v1.Ins
 		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
 	}
 
-	secretName := getAuthSecretName(depl.Uid)
+	return s.removeBasicAuth(ctx, depl.Namespace, depl.Uid)
+}
+
+//Remove basic auth configuration from instance Ingress objects and delete its secret
+func (s *basicAuthServiceServer) removeBasicAuth(ctx context.Context, namespace string, uid string) (*v1.ServiceResponse, error) {
+	//remove Ingress configuration first so that Ingress never references missing secret
+	err := unwireBasicAuth(ctx, s.kubeAPI, s.dynamicAPI, s.ingressController, namespace, uid, s.instanceLabel)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while removing Ingress configuration!"), err
+	}
+
+	secretName := getAuthSecretName(uid)
 
 	//check if secret exist
-	_, err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Get(ctx, secretName, metav1.GetOptions{})
+	_, err = s.kubeAPI.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
 	if err != nil {
 		return prepareResponse(v1.Status_OK, "Secret does not exist"), nil
 	}
 
 	//delete secret
-	err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Delete(ctx, secretName, metav1.DeleteOptions{})
+	err = s.kubeAPI.CoreV1().Secrets(namespace).Delete(ctx, secretName, metav1.DeleteOptions{})
 	if err != nil {
 		return prepareResponse(v1.Status_FAILED, "Error while removing secret!"), err
 	}
 	return prepareResponse(v1.Status_OK, "Secret deleted successfully"), nil
 }
 
+func (s *basicAuthServiceServer) VerifyCredentials(ctx context.Context, req *v1.InstanceCredentialsRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Instance
+	if req.Credentials == nil {
+		return prepareResponse(v1.Status_FAILED, "No credentials provided"), status.Errorf(codes.InvalidArgument, "No credentials provided")
+	}
+	logLine(fmt.Sprintf("> Verifying credentials for instance:%s in namespace:%s", depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	secret, err := s.kubeAPI.CoreV1().Secrets(depl.Namespace).Get(ctx, getAuthSecretName(depl.Uid), metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Secret does not exist"), nil
+	}
+
+	//unknown user is checked against dummy hash so that both cases take the same time and give the same answer
+	hash := dummyBcryptHash
+	entries := parseHtpasswd(string(secret.Data[htpasswdSecretKey]))
+	i := findHtpasswdUser(entries, req.Credentials.User)
+	if i >= 0 {
+		hash = entries[i].hash
+	}
+
+	if verifyPassword(hash, req.Credentials.Password) && i >= 0 {
+		logLine("< Credentials verified")
+		return prepareResponse(v1.Status_OK, "Credentials are valid"), nil
+	}
+	logLine("< Credentials rejected")
+	return prepareResponse(v1.Status_FAILED, "Credentials are invalid"), nil
+}
+
 func (s *certManagerServiceServer) DeleteIfExists(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceResponse, error) {
 	// check if the API version requested by client is supported by server
 	if err := checkAPI(req.Api, apiVersion); err != nil {
@@ -483,7 +652,13 @@ func (s *certManagerServiceServer) DeleteIfExists(ctx context.Context, req *v1.I
 		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
 	}
 
-	secretName := depl.Uid + "-tls"
+	secretName := getCertificateSecretName(depl.Uid)
+
+	//certificate is removed first, otherwise cert-manager would recreate the secret right away
+	err = s.deleteCertificate(ctx, depl.Namespace, getCertificateName(depl.Uid))
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while removing certificate!"), err
+	}
 
 	//check if secret exist
 	_, err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Get(ctx, secretName, metav1.GetOptions{})
@@ -499,7 +674,7 @@ func (s *certManagerServiceServer) DeleteIfExists(ctx context.Context, req *v1.I
 	return prepareResponse(v1.Status_OK, "Secret deleted successfully"), nil
 }
 
-func (s *readinessServiceServer) CheckIfReady(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceResponse, error) {
+func (s *readinessServiceServer) CheckIfReady(ctx context.Context, req *v1.InstanceRequest) (*v1.ReadinessResponse, error) {
 	// check if the API version requested by client is supported by server
 	if err := checkAPI(req.Api, apiVersion); err != nil {
 		return nil, err
@@ -511,36 +686,53 @@ func (s *readinessServiceServer) CheckIfReady(ctx context.Context, req *v1.Insta
 	//check if given k8s namespace exists
 	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
 	if err != nil {
-		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+		return prepareReadinessResponse(v1.Status_FAILED, namespaceNotFound, nil), err
 	}
 
-	logLine("looking for deployment and checking its status")
-	dep, err := s.kubeAPI.AppsV1().Deployments(depl.Namespace).Get(ctx, depl.Uid, metav1.GetOptions{})
+	res, found, err := s.evaluateReadiness(ctx, depl)
 	if err != nil {
-		logLine("deployment not found, looking for statefulset and checking its status")
-		sts, err2 := s.kubeAPI.AppsV1().StatefulSets(depl.Namespace).Get(ctx, depl.Uid, metav1.GetOptions{})
-		if err2 != nil {
-			logLine("statefulset not found as well")
-			return prepareResponse(v1.Status_FAILED, "Neither Deployment nor StatefulSet found!"), err2
-		} else {
-			logLine("statefulset found, verifying status")
-			if *sts.Spec.Replicas == sts.Status.ReadyReplicas {
-		        logLine("ready")
-				return prepareResponse(v1.Status_OK, "StatefulSet is ready"), nil
-			}
-			logLine("not yet ready")
-			return prepareResponse(v1.Status_PENDING, "Waiting for statefulset"), nil
-		}
-	} else {
-		logLine("deployment found, verifying status")
-		if *dep.Spec.Replicas == dep.Status.ReadyReplicas {
-		    logLine("ready")
-			return prepareResponse(v1.Status_OK, "Deployment is ready"), nil
-		}
-		logLine("not yet ready")
-		return prepareResponse(v1.Status_PENDING, "Waiting for deployment"), nil
+		return res, err
+	}
+	if !found {
+		return res, status.Errorf(codes.NotFound, "no workloads found for instance %s", depl.Uid)
+	}
+	return res, nil
+}
+
+//Evaluate readiness of instance workloads, with diagnostics if instance is not ready
+func (s *readinessServiceServer) evaluateReadiness(ctx context.Context, depl *v1.Instance) (*v1.ReadinessResponse, bool, error) {
+	logLine("looking for instance workloads and checking their status")
+	workloads, err := collectWorkloadStatuses(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareReadinessResponse(v1.Status_FAILED, "Error while retrieving workloads!", nil), false, err
+	}
+	if len(workloads) == 0 {
+		logLine("no workloads found")
+		return prepareReadinessResponse(v1.Status_FAILED, "No workloads found!", workloads), false, nil
 	}
 
+	result, message := aggregateWorkloadStatuses(workloads)
+	logLine(message)
+	res := prepareReadinessResponse(result, message, workloads)
+	//suspended instance is not expected to run, so its pods and events need no explanation
+	if result == v1.Status_OK || result == v1.Status_SUSPENDED {
+		return res, true, nil
+	}
+
+	//diagnostics are only gathered when something needs explanation
+	pods, err := findInstancePodsBySelector(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		logLine(fmt.Sprintf("Could not retrieve pods: %s", err))
+	} else {
+		res.PodProblems = diagnosePods(pods)
+	}
+	events, err := recentWarningEvents(ctx, s.kubeAPI, depl.Namespace, time.Now())
+	if err != nil {
+		logLine(fmt.Sprintf("Could not retrieve events: %s", err))
+	} else {
+		res.WarningEvents = events
+	}
+	return res, true, nil
 }
 
 func (s *informationServiceServer) RetrieveServiceIp(ctx context.Context, req *v1.InstanceRequest) (*v1.InfoServiceResponse, error) {
@@ -625,25 +817,16 @@ func (s *podServiceServer) RetrievePodList(ctx context.Context, req *v1.Instance
 		return preparePodListResponse(v1.Status_FAILED, namespaceNotFound, nil), err
 	}
 
-    //collecting all pods from given namespace
-	logLine(fmt.Sprintf("Collecting pods from namespace %s", depl.Namespace))
-	allPods, err := s.kubeAPI.CoreV1().Pods(depl.Namespace).List(ctx, metav1.ListOptions{})
+    //collecting pods selected by instance workloads or labelled with the instance
+	logLine(fmt.Sprintf("Collecting pods of instance %s from namespace %s", depl.Uid, depl.Namespace))
+	pods, err := findInstancePodsBySelector(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
 	if err != nil {
 		return preparePodListResponse(v1.Status_FAILED, "Issue with collecting pods", nil), err
 	}
 
 	matchingPods := make([]*v1.PodInfo, 0)
-
-    //filtering only those pods that match the deployment name
- 	logLine(fmt.Sprintf("Filtering pods by deployment %s", depl.Uid))
-	for _, pod := range allPods.Items {
-	    if (strings.HasPrefix(pod.Name, depl.Uid + "-")) {
-	        newPod := &v1.PodInfo{Name: pod.Name, DisplayName: pod.Name, Containers: make([]string, 0)}
-	        for container := range pod.Spec.Containers {
-                newPod.Containers = append(newPod.Containers, pod.Spec.Containers[container].Name)
-            }
-	        matchingPods = append(matchingPods, newPod)
-	    }
+	for i := range pods {
+	    matchingPods = append(matchingPods, describePod(&pods[i]))
 	}
 
     logLine(fmt.Sprintf("< Found %d matching pods", len(matchingPods)))
@@ -666,38 +849,29 @@ func (s *podServiceServer) RetrievePodLogs(ctx context.Context, req *v1.PodReque
 		return preparePodLogsResponse(v1.Status_FAILED, namespaceNotFound, nil), err
 	}
 
+    opts, err := podLogOptions(req.LogOptions)
+    if err != nil {
+        return preparePodLogsResponse(v1.Status_FAILED, "Invalid log options: " + err.Error(), nil), status.Errorf(codes.InvalidArgument, "invalid log options: %s", err)
+    }
+    all := req.LogOptions.GetAllContainers()
+
     //check if given pod exists
-    _, err = s.kubeAPI.CoreV1().Pods(depl.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+    existing, err := s.kubeAPI.CoreV1().Pods(depl.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
     if err != nil {
         return preparePodLogsResponse(v1.Status_FAILED, "Pod not found", nil), err
     }
 
     //collecting logs from given pod
-    var opts apiv1.PodLogOptions
-    if len(pod.Containers) == 0 {
-        opts = apiv1.PodLogOptions{}
-    } else {
-        opts = apiv1.PodLogOptions{Container: pod.Containers[0]}
-    }
-	logLine(fmt.Sprintf("Collecting logs from pod/container %s/%s in namespace %s", pod.Name, opts.Container, depl.Namespace))
-
-	logsRequest := s.kubeAPI.CoreV1().Pods(depl.Namespace).GetLogs(pod.Name, &opts)
-
-    podLogs, err := logsRequest.Stream(ctx)
-	if err != nil {
-		return preparePodLogsResponse(v1.Status_FAILED, "Issue with opening stream with logs", nil), err
-	}
-    defer podLogs.Close()
+    containers := logContainers(existing, pod.Containers, all)
+	logLine(fmt.Sprintf("Collecting logs from pod/container(s) %s/%s in namespace %s", pod.Name, strings.Join(containers, ","), depl.Namespace))
 
-    logBuffer := new(bytes.Buffer)
-    _, err = io.Copy(logBuffer, podLogs)
+    lines, err := s.readPodLogs(ctx, depl.Namespace, pod.Name, containers, opts, all)
 	if err != nil {
-		return preparePodLogsResponse(v1.Status_FAILED, "Issue with copying data from stream to string", nil), err
+		return preparePodLogsResponse(v1.Status_FAILED, "Issue with retrieving logs", nil), err
 	}
-    logs := logBuffer.String()
 
-    logLine(fmt.Sprintf("< Returning %d characters", len(logs)))
-	return preparePodLogsResponse(v1.Status_OK, "", []string{logs}), err
+    logLine(fmt.Sprintf("< Returning %d lines", len(lines)))
+	return preparePodLogsResponse(v1.Status_OK, "", lines), err
 }
 
 func (s *namespaceServiceServer) CreateNamespace(ctx context.Context, req *v1.NamespaceRequest) (*v1.ServiceResponse, error) {
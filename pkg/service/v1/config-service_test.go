@@ -6,10 +6,16 @@ import (
 	"github.com/xanzy/go-gitlab"
 	corev1 "k8s.io/api/core/v1"
 	appsv1 "k8s.io/api/apps/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"testing"
 	testclient "k8s.io/client-go/kubernetes/fake"
 	"fmt"
+	"strings"
 )
 
 func TestCheckAPI(t *testing.T) {
@@ -35,7 +41,7 @@ var illegal_req = v1.InstanceRequest{Api: "illegal", Deployment: &inst}
 
 func TestReadinessServiceServer_CheckIfReady(t *testing.T) {
 	client := testclient.NewSimpleClientset()
-	server := NewReadinessServiceServer(client)
+	server := NewReadinessServiceServer(client, "")
 
 	//Fail on API version check
 	res, err := server.CheckIfReady(context.Background(), &illegal_req)
@@ -66,7 +72,10 @@ func TestReadinessServiceServer_CheckIfReady(t *testing.T) {
 	depl.Name = "test-uid"
 	q := int32(5)
 	depl.Spec.Replicas = &q
+	depl.Status.Replicas = q
+	depl.Status.UpdatedReplicas = q
 	depl.Status.ReadyReplicas = q
+	depl.Status.AvailableReplicas = q
 	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &depl, metav1.CreateOptions{})
 
 	res, err = server.CheckIfReady(context.Background(), &req)
@@ -77,6 +86,7 @@ func TestReadinessServiceServer_CheckIfReady(t *testing.T) {
 	//modify mock deployment to be partially deployed
 	p := int32(3)
 	depl.Status.ReadyReplicas = p
+	depl.Status.AvailableReplicas = p
 	_, _ = client.AppsV1().Deployments("test-namespace").Update(context.Background(), &depl, metav1.UpdateOptions{})
 
 	res, err = server.CheckIfReady(context.Background(), &req)
@@ -87,7 +97,7 @@ func TestReadinessServiceServer_CheckIfReady(t *testing.T) {
 
 func TestReadinessServiceServer_CheckIfReadyWithStatefulSet(t *testing.T) {
 	client := testclient.NewSimpleClientset()
-	server := NewReadinessServiceServer(client)
+	server := NewReadinessServiceServer(client, "")
 
 	//Fail on API version check
 	res, err := server.CheckIfReady(context.Background(), &illegal_req)
@@ -129,7 +139,7 @@ func TestReadinessServiceServer_CheckIfReadyWithStatefulSet(t *testing.T) {
 
 func TestInformationServiceServer_RetrieveServiceIp(t *testing.T) {
 	client := testclient.NewSimpleClientset()
-	server := NewInformationServiceServer(client)
+	server := NewInformationServiceServer(client, nil, "")
 
 	//Fail on API version check
 	res, err := server.RetrieveServiceIp(context.Background(), &illegal_req)
@@ -200,7 +210,7 @@ func TestInformationServiceServer_RetrieveServiceIp(t *testing.T) {
 
 func TestInformationServiceServer_CheckServiceExists(t *testing.T) {
 	client := testclient.NewSimpleClientset()
-	server := NewInformationServiceServer(client)
+	server := NewInformationServiceServer(client, nil, "")
 
 	//Fail on API version check
 	res, err := server.CheckServiceExists(context.Background(), &illegal_req)
@@ -240,7 +250,7 @@ func TestInformationServiceServer_CheckServiceExists(t *testing.T) {
 
 func TestCertManagerServiceServer_DeleteIfExists(t *testing.T) {
 	client := testclient.NewSimpleClientset()
-	server := NewCertManagerServiceServer(client)
+	server := NewCertManagerServiceServer(client, newFakeCertManagerClient(), "")
 
 	//Fail on API version check
 	res, err := server.DeleteIfExists(context.Background(), &illegal_req)
@@ -277,7 +287,7 @@ func TestCertManagerServiceServer_DeleteIfExists(t *testing.T) {
 
 func TestBasicAuthServiceServer_DeleteIfExists(t *testing.T) {
 	client := testclient.NewSimpleClientset()
-	server := NewBasicAuthServiceServer(client)
+	server := NewBasicAuthServiceServer(client, nil, v1.HashScheme_BCRYPT, IngressControllerNginx, "")
 
 	res, err := server.DeleteIfExists(context.Background(), &illegal_req)
 	if err == nil || res != nil {
@@ -313,7 +323,7 @@ func TestBasicAuthServiceServer_DeleteIfExists(t *testing.T) {
 
 func TestBasicAuthServiceServer_CreateOrReplace(t *testing.T) {
 	client := testclient.NewSimpleClientset()
-	server := NewBasicAuthServiceServer(client)
+	server := NewBasicAuthServiceServer(client, nil, v1.HashScheme_BCRYPT, IngressControllerNginx, "")
 
 	creds := v1.Credentials{User: "test-user", Password: "test-password"}
 
@@ -343,6 +353,363 @@ func TestBasicAuthServiceServer_CreateOrReplace(t *testing.T) {
 	}
 }
 
+func TestBasicAuthServiceServer_CreateOrReplaceMultipleUsers(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewBasicAuthServiceServer(client, nil, v1.HashScheme_BCRYPT, IngressControllerNginx, "")
+
+	users := func() []string {
+		res, err := server.ListUsers(context.Background(), &req)
+		if err != nil || res.Status != v1.Status_OK {
+			t.Fatal(err)
+		}
+		return res.Users
+	}
+
+	//Fail when no credentials given
+	emptyReq := v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst}
+	res, err := server.CreateOrReplace(context.Background(), &emptyReq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Fail on invalid user name
+	invalidReq := v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst,
+		CredentialsList: []*v1.Credentials{{User: "user:1", Password: "pass"}}}
+	res, err = server.CreateOrReplace(context.Background(), &invalidReq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Should create secret with two users
+	replaceReq := v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst,
+		CredentialsList: []*v1.Credentials{{User: "user1", Password: "pass1"}, {User: "user2", Password: "pass2"}}}
+	res, err = server.CreateOrReplace(context.Background(), &replaceReq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	if u := users(); len(u) != 2 || u[0] != "user1" || u[1] != "user2" {
+		t.Fail()
+	}
+
+	sec, _ := client.CoreV1().Secrets("test-namespace").Get(context.Background(), getAuthSecretName("test-uid"), metav1.GetOptions{})
+	if len(strings.Split(strings.TrimSpace(string(sec.Data["auth"])), "\n")) != 2 {
+		t.Fail()
+	}
+
+	//Should add new user and keep existing ones
+	addReq := v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst, Operation: v1.CredentialsOperation_ADD,
+		Credentials: &v1.Credentials{User: "user3", Password: "pass3"}}
+	res, err = server.CreateOrReplace(context.Background(), &addReq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	if u := users(); len(u) != 3 || u[2] != "user3" {
+		t.Fail()
+	}
+
+	//Should remove user
+	removeReq := v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst, Operation: v1.CredentialsOperation_REMOVE,
+		CredentialsList: []*v1.Credentials{{User: "user1"}}}
+	res, err = server.CreateOrReplace(context.Background(), &removeReq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	if u := users(); len(u) != 2 || u[0] != "user2" || u[1] != "user3" {
+		t.Fail()
+	}
+
+	//Should replace all users using requested hashing scheme
+	res, err = server.CreateOrReplace(context.Background(), &v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst,
+		Credentials: &v1.Credentials{User: "user4", Password: "pass4"}, HashScheme: v1.HashScheme_SHA512_CRYPT})
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	if u := users(); len(u) != 1 || u[0] != "user4" {
+		t.Fail()
+	}
+
+	sec, _ = client.CoreV1().Secrets("test-namespace").Get(context.Background(), getAuthSecretName("test-uid"), metav1.GetOptions{})
+	if !strings.HasPrefix(string(sec.Data["auth"]), "user4:$6$") {
+		t.Fail()
+	}
+}
+
+func TestBasicAuthServiceServer_ListUsers(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewBasicAuthServiceServer(client, nil, v1.HashScheme_BCRYPT, IngressControllerNginx, "")
+
+	//Fail on API version check
+	res, err := server.ListUsers(context.Background(), &illegal_req)
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	res, err = server.ListUsers(context.Background(), &req)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//create mock namespace
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Pass with no users if secret does not exist
+	res, err = server.ListUsers(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || len(res.Users) != 0 {
+		t.Fail()
+	}
+
+	//Create mock secret
+	sec := corev1.Secret{}
+	sec.Name = getAuthSecretName("test-uid")
+	sec.Data = map[string][]byte{"auth": []byte("# comment\nalice:$apr1$abc$hash\n\nbob:$2y$10$hash\n")}
+	_, _ = client.CoreV1().Secrets("test-namespace").Create(context.Background(), &sec, metav1.CreateOptions{})
+
+	//Pass without exposing hashes
+	res, err = server.ListUsers(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || len(res.Users) != 2 || res.Users[0] != "alice" || res.Users[1] != "bob" {
+		t.Fail()
+	}
+}
+
+func TestBasicAuthServiceServer_VerifyCredentials(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewBasicAuthServiceServer(client, nil, v1.HashScheme_BCRYPT, IngressControllerNginx, "")
+
+	verify := func(user string, password string) *v1.ServiceResponse {
+		res, err := server.VerifyCredentials(context.Background(), &v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst,
+			Credentials: &v1.Credentials{User: user, Password: password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	//Fail on API version check
+	res, err := server.VerifyCredentials(context.Background(), &v1.InstanceCredentialsRequest{Api: "illegal", Instance: &inst})
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	res, err = server.VerifyCredentials(context.Background(), &v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst,
+		Credentials: &v1.Credentials{User: "alice", Password: "myPassword"}})
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//create mock namespace
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Fail if secret does not exist
+	if verify("alice", "myPassword").Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Create mock secret with users hashed using different schemes
+	sec := corev1.Secret{}
+	sec.Name = getAuthSecretName("test-uid")
+	sec.Data = map[string][]byte{"auth": []byte("alice:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n" +
+		"bob:$2y$05$abcdefghijklmnopqrstuugwV8qBBvnFAgKU/1lAQTjzoU4mNz2BW\n")}
+	_, _ = client.CoreV1().Secrets("test-namespace").Create(context.Background(), &sec, metav1.CreateOptions{})
+
+	//Pass for both users
+	if verify("alice", "myPassword").Status != v1.Status_OK || verify("bob", "myPassword").Status != v1.Status_OK {
+		t.Fail()
+	}
+
+	//Unknown user and wrong password should not be distinguishable
+	wrongPassword := verify("alice", "otherPassword")
+	unknownUser := verify("carol", "myPassword")
+	if wrongPassword.Status != v1.Status_FAILED || unknownUser.Status != v1.Status_FAILED || wrongPassword.Message != unknownUser.Message {
+		t.Fail()
+	}
+	if strings.Contains(wrongPassword.Message, "$apr1$") {
+		t.Fail()
+	}
+}
+
+func TestBasicAuthServiceServer_ConfigureIngressNginx(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewBasicAuthServiceServer(client, nil, v1.HashScheme_BCRYPT, IngressControllerNginx, "")
+
+	//create mock namespace with instance ingress and ingress of another instance
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+	i1 := networkingv1.Ingress{}
+	i1.Name = "test-uid"
+	i1.Annotations = map[string]string{"kubernetes.io/ingress.class": "nginx"}
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &i1, metav1.CreateOptions{})
+	i2 := networkingv1.Ingress{}
+	i2.Name = "test-uid2"
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &i2, metav1.CreateOptions{})
+
+	//Should create secret and annotate instance ingress only
+	creq := v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst, ConfigureIngress: true,
+		Credentials: &v1.Credentials{User: "test-user", Password: "test-password"}}
+	res, err := server.CreateOrReplace(context.Background(), &creq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+
+	ing, _ := client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if ing.Annotations["nginx.ingress.kubernetes.io/auth-type"] != "basic" ||
+		ing.Annotations["nginx.ingress.kubernetes.io/auth-secret"] != "test-uid-auth" ||
+		ing.Annotations["nginx.ingress.kubernetes.io/auth-realm"] == "" {
+		t.Fail()
+	}
+	ing, _ = client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid2", metav1.GetOptions{})
+	if len(ing.Annotations) != 0 {
+		t.Fail()
+	}
+
+	//Should remove annotations together with secret, leaving other annotations in place
+	res, err = server.DeleteIfExists(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	ing, _ = client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if len(ing.Annotations) != 1 || ing.Annotations["kubernetes.io/ingress.class"] != "nginx" {
+		t.Fail()
+	}
+}
+
+func TestBasicAuthServiceServer_RemoveUsers(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewBasicAuthServiceServer(client, nil, v1.HashScheme_BCRYPT, IngressControllerNginx, "")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+	i1 := networkingv1.Ingress{}
+	i1.Name = "test-uid"
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &i1, metav1.CreateOptions{})
+
+	creq := v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst,
+		CredentialsList: []*v1.Credentials{{User: "user1", Password: "pass1"}, {User: "user2", Password: "pass2"}}}
+	res, err := server.CreateOrReplace(context.Background(), &creq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+
+	//Should never enable basic auth when removing users
+	removeReq := v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst, Operation: v1.CredentialsOperation_REMOVE, ConfigureIngress: true,
+		Credentials: &v1.Credentials{User: "user1"}}
+	res, err = server.CreateOrReplace(context.Background(), &removeReq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	ing, _ := client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if len(ing.Annotations) != 0 {
+		t.Errorf("ingress configured on remove %v", ing.Annotations)
+	}
+
+	creq = v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst, Operation: v1.CredentialsOperation_ADD, ConfigureIngress: true,
+		Credentials: &v1.Credentials{User: "user3", Password: "pass3"}}
+	_, _ = server.CreateOrReplace(context.Background(), &creq)
+	ing, _ = client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if ing.Annotations["nginx.ingress.kubernetes.io/auth-type"] != "basic" {
+		t.Fatal("ingress not configured")
+	}
+
+	//Should remove Ingress configuration and secret together with the last user
+	removeReq = v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst, Operation: v1.CredentialsOperation_REMOVE,
+		CredentialsList: []*v1.Credentials{{User: "user2"}, {User: "user3"}}}
+	res, err = server.CreateOrReplace(context.Background(), &removeReq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	ing, _ = client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if len(ing.Annotations) != 0 {
+		t.Errorf("ingress still configured %v", ing.Annotations)
+	}
+	_, err = client.CoreV1().Secrets("test-namespace").Get(context.Background(), getAuthSecretName("test-uid"), metav1.GetOptions{})
+	if err == nil {
+		t.Error("secret not deleted")
+	}
+
+	//Should not create empty secret when removing from nonexistent one
+	res, err = server.CreateOrReplace(context.Background(), &removeReq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	_, err = client.CoreV1().Secrets("test-namespace").Get(context.Background(), getAuthSecretName("test-uid"), metav1.GetOptions{})
+	if err == nil {
+		t.Error("empty secret created")
+	}
+}
+
+func TestBasicAuthServiceServer_ConfigureIngressTraefik(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{traefikMiddlewareResource: "MiddlewareList"})
+	server := NewBasicAuthServiceServer(client, dynamicClient, v1.HashScheme_BCRYPT, IngressControllerTraefik, "")
+
+	//create mock namespace with instance ingress already using a middleware
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+	i1 := networkingv1.Ingress{}
+	i1.Name = "test-uid-web"
+	i1.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	i1.Annotations = map[string]string{"traefik.ingress.kubernetes.io/router.middlewares": "test-namespace-redirect@kubernetescrd"}
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &i1, metav1.CreateOptions{})
+
+	//Should create secret with users key, middleware and append it to ingress
+	creq := v1.InstanceCredentialsRequest{Api: apiVersion, Instance: &inst, ConfigureIngress: true,
+		Credentials: &v1.Credentials{User: "test-user", Password: "test-password"}}
+	res, err := server.CreateOrReplace(context.Background(), &creq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+
+	sec, _ := client.CoreV1().Secrets("test-namespace").Get(context.Background(), "test-uid-auth", metav1.GetOptions{})
+	if len(sec.Data["users"]) == 0 || string(sec.Data["users"]) != string(sec.Data["auth"]) {
+		t.Fail()
+	}
+	mw, err := dynamicClient.Resource(traefikMiddlewareResource).Namespace("test-namespace").Get(context.Background(), "test-uid-basic-auth", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretName, _, _ := unstructured.NestedString(mw.Object, "spec", "basicAuth", "secret")
+	if secretName != "test-uid-auth" {
+		t.Fail()
+	}
+	ing, _ := client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid-web", metav1.GetOptions{})
+	if ing.Annotations["traefik.ingress.kubernetes.io/router.middlewares"] != "test-namespace-redirect@kubernetescrd,test-namespace-test-uid-basic-auth@kubernetescrd" {
+		t.Fail()
+	}
+
+	//Should update secret keeping single middleware reference
+	res, err = server.CreateOrReplace(context.Background(), &creq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	ing, _ = client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid-web", metav1.GetOptions{})
+	if strings.Count(ing.Annotations["traefik.ingress.kubernetes.io/router.middlewares"], "basic-auth") != 1 {
+		t.Fail()
+	}
+
+	//Should remove middleware and its reference
+	res, err = server.DeleteIfExists(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	ing, _ = client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid-web", metav1.GetOptions{})
+	if ing.Annotations["traefik.ingress.kubernetes.io/router.middlewares"] != "test-namespace-redirect@kubernetescrd" {
+		t.Fail()
+	}
+	_, err = dynamicClient.Resource(traefikMiddlewareResource).Namespace("test-namespace").Get(context.Background(), "test-uid-basic-auth", metav1.GetOptions{})
+	if err == nil {
+		t.Fail()
+	}
+}
+
 func TestConfigServiceServer_DeleteIfExists(t *testing.T) {
 	client := testclient.NewSimpleClientset()
 	gitclient := gitlab.Client{}
@@ -385,7 +752,7 @@ func TestConfigServiceServer_DeleteIfExists(t *testing.T) {
 
 func TestPodServiceServer_RetrievePodList(t *testing.T) {
 	client := testclient.NewSimpleClientset()
-	server := NewPodServiceServer(client)
+	server := NewPodServiceServer(client, nil, "")
 
 	//Fail on API version check
 	res, err := server.RetrievePodList(context.Background(), &illegal_req)
@@ -411,15 +778,18 @@ func TestPodServiceServer_RetrievePodList(t *testing.T) {
 		t.Fail()
 	}
 
-	//create mock pods (2 out of 3 should match the deployment name)
+	//create mock pods (2 out of 3 should match the instance)
 	p1 := corev1.Pod{}
 	p1.Name = "test-uid-pod"
+	p1.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
 	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &p1, metav1.CreateOptions{})
 	p2 := corev1.Pod{}
 	p2.Name = "test-uid-pod2"
+	p2.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
 	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &p2, metav1.CreateOptions{})
     p3 := corev1.Pod{}
     p3.Name = "test-uid2-pod1"
+    p3.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid2"}
     _, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &p3, metav1.CreateOptions{})
 
 	//Pass
@@ -431,7 +801,7 @@ func TestPodServiceServer_RetrievePodList(t *testing.T) {
 
 func TestPodServiceServer_RetrievePodLogs(t *testing.T) {
 	client := testclient.NewSimpleClientset()
-	server := NewPodServiceServer(client)
+	server := NewPodServiceServer(client, nil, "")
 
 	//Fail on namespace check
 	fPodReq := v1.PodRequest{Api:apiVersion, Pod:nil, Deployment:&fake_ns_inst}
@@ -0,0 +1,409 @@
+package v1
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"path"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+const (
+	//Size of archive data carried by single stream message
+	diagnosticsChunkSize = 64 * 1024
+	//Only the end of longer logs is included in the bundle
+	maxDiagnosticsLogBytes = int64(10 * 1024 * 1024)
+)
+
+type diagnosticsServiceServer struct {
+	kubeAPI kubernetes.Interface
+	instanceLabel string
+}
+
+func NewDiagnosticsServiceServer(kubeAPI kubernetes.Interface, label string) v1.DiagnosticsServiceServer {
+	if len(label) == 0 {
+		label = instanceLabel
+	}
+	return &diagnosticsServiceServer{kubeAPI: kubeAPI, instanceLabel: label}
+}
+
+//Prepare diagnostics chunk
+func prepareDiagnosticsChunk(status v1.Status, message string, data []byte) *v1.DiagnosticsChunk {
+	return &v1.DiagnosticsChunk{
+		Api: apiVersion,
+		Status: status,
+		Message: message,
+		Data: data,
+	}
+}
+
+//Writer cutting written data into chunks of fixed size, the last chunk is sent on Flush
+type chunkWriter struct {
+	send func(data []byte) error
+	buffer []byte
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+	for len(w.buffer) >= diagnosticsChunkSize {
+		chunk := make([]byte, diagnosticsChunkSize)
+		copy(chunk, w.buffer)
+		w.buffer = w.buffer[diagnosticsChunkSize:]
+		if err := w.send(chunk); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *chunkWriter) Flush() error {
+	if len(w.buffer) == 0 {
+		return nil
+	}
+	chunk := w.buffer
+	w.buffer = nil
+	return w.send(chunk)
+}
+
+//Tar archive with diagnostic files of single instance, collecting problems that did not prevent creating it
+type diagnosticsBundle struct {
+	tar *tar.Writer
+	root string
+	created time.Time
+	problems []string
+}
+
+func (b *diagnosticsBundle) addFile(name string, data []byte) error {
+	header := &tar.Header{
+		Name: path.Join(b.root, name),
+		Mode: 0644,
+		Size: int64(len(data)),
+		ModTime: b.created,
+		Typeflag: tar.TypeReg,
+	}
+	if err := b.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := b.tar.Write(data)
+	return err
+}
+
+func (b *diagnosticsBundle) addYAML(name string, object interface{}) error {
+	data, err := yaml.Marshal(object)
+	if err != nil {
+		b.problem("%s could not be serialized: %s", name, err)
+		return nil
+	}
+	return b.addFile(name, data)
+}
+
+func (b *diagnosticsBundle) problem(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	logLine("Diagnostics: " + message)
+	b.problems = append(b.problems, message)
+}
+
+//ConfigMap identified by hash of its content, which allows comparing configuration without disclosing it
+type configMapDigest struct {
+	Name string `json:"name"`
+	Keys []string `json:"keys"`
+	Sha256 string `json:"sha256"`
+}
+
+func digestConfigMap(configMap *apiv1.ConfigMap) configMapDigest {
+	keys := make([]string, 0, len(configMap.Data)+len(configMap.BinaryData))
+	for key := range configMap.Data {
+		keys = append(keys, key)
+	}
+	for key := range configMap.BinaryData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		value, ok := configMap.Data[key]
+		if !ok {
+			value = string(configMap.BinaryData[key])
+		}
+		//length prefixes keep different splits of key and value from producing the same hash
+		_, _ = fmt.Fprintf(hash, "%d:%s%d:%s", len(key), key, len(value), value)
+	}
+	return configMapDigest{Name: configMap.Name, Keys: keys, Sha256: hex.EncodeToString(hash.Sum(nil))}
+}
+
+//Secret reduced to its key names, values never leave the cluster
+type redactedSecret struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Keys []string `json:"keys"`
+}
+
+func redactSecret(secret *apiv1.Secret) redactedSecret {
+	keys := make([]string, 0, len(secret.Data)+len(secret.StringData))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	for key := range secret.StringData {
+		if _, ok := secret.Data[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return redactedSecret{Name: secret.Name, Type: string(secret.Type), Keys: keys}
+}
+
+//Read data keeping only its last limit bytes, cut to start at a full line when anything was dropped
+func tailBytes(r io.Reader, limit int64) ([]byte, error) {
+	buffer := make([]byte, 0, diagnosticsChunkSize)
+	chunk := make([]byte, diagnosticsChunkSize)
+	dropped := false
+	for {
+		n, err := r.Read(chunk)
+		buffer = append(buffer, chunk[:n]...)
+		//data is dropped only after twice the limit is buffered, to avoid moving it on every read
+		if int64(len(buffer)) > 2*limit {
+			buffer = append(buffer[:0], buffer[int64(len(buffer))-limit:]...)
+			dropped = true
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if int64(len(buffer)) > limit {
+		buffer = buffer[int64(len(buffer))-limit:]
+		dropped = true
+	}
+	if dropped {
+		if i := bytes.IndexByte(buffer, '\n'); i >= 0 {
+			buffer = buffer[i+1:]
+		}
+	}
+	return buffer, nil
+}
+
+//Read the end of container logs, logs are streamed so that longer logs are never held in memory as a whole
+func readPodLogTail(ctx context.Context, kubeAPI kubernetes.Interface, namespace string, pod string, opts apiv1.PodLogOptions) ([]byte, error) {
+	podLogs, err := kubeAPI.CoreV1().Pods(namespace).GetLogs(pod, &opts).Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer podLogs.Close()
+	return tailBytes(podLogs, maxDiagnosticsLogBytes)
+}
+
+//Add pod descriptions with current and previous logs of every container
+func (s *diagnosticsServiceServer) collectPods(ctx context.Context, bundle *diagnosticsBundle, namespace string, uid string) (int, error) {
+	pods, err := findInstancePodsBySelector(ctx, s.kubeAPI, namespace, uid, s.instanceLabel)
+	if err != nil {
+		bundle.problem("pods could not be listed: %s", err)
+		return 0, nil
+	}
+
+	for i := range pods {
+		pod := &pods[i]
+		pod.APIVersion, pod.Kind = "v1", "Pod"
+		pod.ManagedFields = nil
+		if err := bundle.addYAML(path.Join("pods", pod.Name+".yaml"), pod); err != nil {
+			return 0, err
+		}
+
+		restarted := make(map[string]bool)
+		for _, statuses := range [][]apiv1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+			for _, containerStatus := range statuses {
+				restarted[containerStatus.Name] = containerStatus.RestartCount > 0
+			}
+		}
+
+		for _, container := range logContainers(pod, nil, true) {
+			opts := apiv1.PodLogOptions{Container: container, Timestamps: true}
+			logs, err := readPodLogTail(ctx, s.kubeAPI, namespace, pod.Name, opts)
+			if err != nil {
+				bundle.problem("logs of %s/%s could not be read: %s", pod.Name, container, err)
+			} else if err := bundle.addFile(path.Join("logs", pod.Name, container+".log"), logs); err != nil {
+				return 0, err
+			}
+
+			//previous logs exist only for restarted containers
+			if !restarted[container] {
+				continue
+			}
+			opts.Previous = true
+			logs, err = readPodLogTail(ctx, s.kubeAPI, namespace, pod.Name, opts)
+			if err != nil {
+				bundle.problem("previous logs of %s/%s could not be read: %s", pod.Name, container, err)
+			} else if err := bundle.addFile(path.Join("logs", pod.Name, container+".previous.log"), logs); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(pods), nil
+}
+
+//Names of secrets Janitor creates for the instance, not all of them carry the instance label
+func janitorSecretNames(uid string) map[string]bool {
+	return map[string]bool{
+		getAuthSecretName(uid): true,
+		getRepositoryAccessSecretName(uid): true,
+		getCertificateSecretName(uid): true,
+		getOAuth2ProxyName(uid): true,
+	}
+}
+
+//Add namespace events, Services, Ingresses, ConfigMap digests and redacted Secrets of the instance
+func (s *diagnosticsServiceServer) collectObjects(ctx context.Context, bundle *diagnosticsBundle, namespace string, uid string) error {
+	events, err := s.kubeAPI.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		bundle.problem("events could not be listed: %s", err)
+	} else {
+		sort.SliceStable(events.Items, func(i, j int) bool {
+			return eventTime(&events.Items[i]).Before(eventTime(&events.Items[j]))
+		})
+		for i := range events.Items {
+			events.Items[i].APIVersion, events.Items[i].Kind = "v1", "Event"
+			events.Items[i].ManagedFields = nil
+		}
+		if err := bundle.addYAML("events.yaml", events.Items); err != nil {
+			return err
+		}
+	}
+
+	services, err := findInstanceServices(ctx, s.kubeAPI, namespace, uid, s.instanceLabel)
+	if err != nil {
+		bundle.problem("services could not be listed: %s", err)
+	}
+	for i := range services {
+		services[i].APIVersion, services[i].Kind = "v1", "Service"
+		services[i].ManagedFields = nil
+		if err := bundle.addYAML(path.Join("services", services[i].Name+".yaml"), &services[i]); err != nil {
+			return err
+		}
+	}
+
+	ingresses, err := findInstanceIngresses(ctx, s.kubeAPI, namespace, uid, s.instanceLabel)
+	if err != nil {
+		bundle.problem("ingresses could not be listed: %s", err)
+	}
+	for i := range ingresses {
+		ingresses[i].APIVersion, ingresses[i].Kind = networkingv1.SchemeGroupVersion.String(), "Ingress"
+		ingresses[i].ManagedFields = nil
+		if err := bundle.addYAML(path.Join("ingresses", ingresses[i].Name+".yaml"), &ingresses[i]); err != nil {
+			return err
+		}
+	}
+
+	configMaps, err := s.kubeAPI.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		bundle.problem("config maps could not be listed: %s", err)
+	} else {
+		digests := make([]configMapDigest, 0)
+		for i := range configMaps.Items {
+			//ConfigMaps created by ConfigService are named after the instance and repository directory, without labels
+			if belongsToInstance(&configMaps.Items[i], uid, s.instanceLabel) || strings.HasPrefix(configMaps.Items[i].Name, uid+"-") {
+				digests = append(digests, digestConfigMap(&configMaps.Items[i]))
+			}
+		}
+		if err := bundle.addYAML("configmaps.yaml", digests); err != nil {
+			return err
+		}
+	}
+
+	secrets, err := s.kubeAPI.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		bundle.problem("secrets could not be listed: %s", err)
+	} else {
+		redacted := make([]redactedSecret, 0)
+		janitorSecrets := janitorSecretNames(uid)
+		for i := range secrets.Items {
+			if belongsToInstance(&secrets.Items[i], uid, s.instanceLabel) || janitorSecrets[secrets.Items[i].Name] {
+				redacted = append(redacted, redactSecret(&secrets.Items[i]))
+			}
+		}
+		if err := bundle.addYAML("secrets.yaml", redacted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *diagnosticsServiceServer) CollectDiagnostics(req *v1.InstanceRequest, stream v1.DiagnosticsService_CollectDiagnosticsServer) error {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	depl := req.Deployment
+	logLine(fmt.Sprintf("> Collecting diagnostics of instance %s in namespace %s", depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	writer := &chunkWriter{send: func(data []byte) error {
+		return stream.Send(prepareDiagnosticsChunk(v1.Status_OK, "", data))
+	}}
+	compressed := gzip.NewWriter(writer)
+	created := time.Now().UTC()
+	bundle := &diagnosticsBundle{
+		tar: tar.NewWriter(compressed),
+		root: fmt.Sprintf("%s-diagnostics-%s", depl.Uid, created.Format("20060102T150405Z")),
+		created: created,
+		problems: make([]string, 0),
+	}
+
+	pods, err := s.collectPods(ctx, bundle, depl.Namespace, depl.Uid)
+	if err == nil {
+		err = s.collectObjects(ctx, bundle, depl.Namespace, depl.Uid)
+	}
+	if err == nil && len(bundle.problems) > 0 {
+		var problems bytes.Buffer
+		for _, problem := range bundle.problems {
+			problems.WriteString(problem + "\n")
+		}
+		err = bundle.addFile("problems.txt", problems.Bytes())
+	}
+	if err == nil {
+		err = bundle.tar.Close()
+	}
+	if err == nil {
+		err = compressed.Close()
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return status.Errorf(codes.Canceled, "diagnostics collection cancelled by client")
+		}
+		return err
+	}
+
+	message := fmt.Sprintf("Collected diagnostics of %d pod(s)", pods)
+	if len(bundle.problems) > 0 {
+		message += fmt.Sprintf(", %d item(s) could not be collected: %s", len(bundle.problems), strings.Join(bundle.problems, "; "))
+	}
+	logLine("< " + message)
+	return stream.Send(prepareDiagnosticsChunk(v1.Status_OK, message, nil))
+}
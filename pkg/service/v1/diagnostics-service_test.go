@@ -0,0 +1,227 @@
+package v1
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"google.golang.org/grpc"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"path"
+	"strings"
+	"testing"
+)
+
+type diagnosticsStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	sent []*v1.DiagnosticsChunk
+}
+
+func (s *diagnosticsStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *diagnosticsStream) Send(chunk *v1.DiagnosticsChunk) error {
+	s.sent = append(s.sent, chunk)
+	return nil
+}
+
+//Unpack streamed archive into map of file contents keyed by path relative to archive root
+func unpackDiagnostics(t *testing.T, chunks []*v1.DiagnosticsChunk) map[string]string {
+	var archive bytes.Buffer
+	for _, chunk := range chunks {
+		archive.Write(chunk.Data)
+	}
+	compressed, err := gzip.NewReader(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	reader := tar.NewReader(compressed)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(reader)
+		parts := strings.SplitN(header.Name, "/", 2)
+		if !strings.HasPrefix(parts[0], "test-uid-diagnostics-") {
+			t.Errorf("unexpected archive root %s", parts[0])
+		}
+		files[parts[1]] = string(data)
+	}
+	return files
+}
+
+func TestChunkWriter(t *testing.T) {
+	chunks := make([][]byte, 0)
+	writer := &chunkWriter{send: func(data []byte) error {
+		chunks = append(chunks, data)
+		return nil
+	}}
+	_, _ = writer.Write(bytes.Repeat([]byte("a"), diagnosticsChunkSize-1))
+	_, _ = writer.Write([]byte("bc"))
+	if len(chunks) != 1 || len(chunks[0]) != diagnosticsChunkSize || chunks[0][diagnosticsChunkSize-1] != 'b' {
+		t.Errorf("unexpected chunks after write %d", len(chunks))
+	}
+	_ = writer.Flush()
+	if len(chunks) != 2 || string(chunks[1]) != "c" {
+		t.Errorf("unexpected chunks after flush %d", len(chunks))
+	}
+}
+
+func TestTailBytes(t *testing.T) {
+	//short data is kept whole
+	data, err := tailBytes(strings.NewReader("first\nsecond\n"), 64)
+	if err != nil || string(data) != "first\nsecond\n" {
+		t.Errorf("unexpected data '%s'", data)
+	}
+
+	//longer data keeps its end starting at a full line
+	lines := make([]string, 0)
+	for i := 0; i < 10000; i++ {
+		lines = append(lines, strings.Repeat("x", 20))
+	}
+	lines = append(lines, "last line")
+	data, err = tailBytes(strings.NewReader(strings.Join(lines, "\n")), 100)
+	if err != nil || len(data) > 100 || !strings.HasSuffix(string(data), "\nlast line") || !strings.HasPrefix(string(data), "xxx") ||
+		len(strings.Split(string(data), "\n")[0]) != 20 {
+		t.Errorf("unexpected data '%s'", data)
+	}
+}
+
+func TestDigestConfigMap(t *testing.T) {
+	cm := corev1.ConfigMap{}
+	cm.Name = "test-uid-config"
+	cm.Data = map[string]string{"b": "2", "a": "1"}
+	digest := digestConfigMap(&cm)
+	if strings.Join(digest.Keys, ",") != "a,b" || len(digest.Sha256) != 64 {
+		t.Errorf("unexpected digest %v", digest)
+	}
+
+	//the same content split differently between keys and values gives different hash
+	other := corev1.ConfigMap{}
+	other.Data = map[string]string{"b": "2", "a1": ""}
+	if digestConfigMap(&other).Sha256 == digest.Sha256 {
+		t.Fail()
+	}
+	cm.Data["a"] = "changed"
+	if digestConfigMap(&cm).Sha256 == digest.Sha256 {
+		t.Fail()
+	}
+}
+
+func TestDiagnosticsServiceServer_CollectDiagnostics(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewDiagnosticsServiceServer(client, "")
+	stream := &diagnosticsStream{ctx: context.Background()}
+
+	//Fail on API version check
+	if err := server.CollectDiagnostics(&v1.InstanceRequest{Api: "invalid"}, stream); err == nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	if err := server.CollectDiagnostics(&v1.InstanceRequest{Api: apiVersion, Deployment: &fake_ns_inst}, stream); err == nil || len(stream.sent) != 0 {
+		t.Fail()
+	}
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	pod := corev1.Pod{}
+	pod.Name = "test-uid-web"
+	pod.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	pod.Spec.Containers = []corev1.Container{{Name: "app"}, {Name: "proxy"}}
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "app", RestartCount: 2}, {Name: "proxy"}}
+	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &pod, metav1.CreateOptions{})
+
+	event := corev1.Event{}
+	event.Name = "test-uid-web.1"
+	event.Reason = "BackOff"
+	_, _ = client.CoreV1().Events("test-namespace").Create(context.Background(), &event, metav1.CreateOptions{})
+
+	svc := corev1.Service{}
+	svc.Name = "test-uid-web"
+	svc.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	_, _ = client.CoreV1().Services("test-namespace").Create(context.Background(), &svc, metav1.CreateOptions{})
+	otherSvc := corev1.Service{}
+	otherSvc.Name = "other-web"
+	_, _ = client.CoreV1().Services("test-namespace").Create(context.Background(), &otherSvc, metav1.CreateOptions{})
+
+	cm := corev1.ConfigMap{}
+	cm.Name = "test-uid-config"
+	cm.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	cm.Data = map[string]string{"app.conf": "listen 80"}
+	_, _ = client.CoreV1().ConfigMaps("test-namespace").Create(context.Background(), &cm, metav1.CreateOptions{})
+
+	secret := corev1.Secret{}
+	secret.Name = "test-uid-credentials"
+	secret.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	secret.Data = map[string][]byte{"password": []byte("s3cr3t-value")}
+	_, _ = client.CoreV1().Secrets("test-namespace").Create(context.Background(), &secret, metav1.CreateOptions{})
+
+	//objects created by Janitor without instance label
+	dirCm := corev1.ConfigMap{}
+	dirCm.Name = "test-uid-nginx"
+	dirCm.Data = map[string]string{"nginx.conf": "worker_processes 1"}
+	_, _ = client.CoreV1().ConfigMaps("test-namespace").Create(context.Background(), &dirCm, metav1.CreateOptions{})
+	authSecret := corev1.Secret{}
+	authSecret.Name = "test-uid-auth"
+	authSecret.Data = map[string][]byte{"auth": []byte("admin:hash")}
+	_, _ = client.CoreV1().Secrets("test-namespace").Create(context.Background(), &authSecret, metav1.CreateOptions{})
+	otherSecret := corev1.Secret{}
+	otherSecret.Name = "test-uid-2-auth"
+	_, _ = client.CoreV1().Secrets("test-namespace").Create(context.Background(), &otherSecret, metav1.CreateOptions{})
+
+	if err := server.CollectDiagnostics(&req, stream); err != nil {
+		t.Fatal(err)
+	}
+	last := stream.sent[len(stream.sent)-1]
+	if last.Status != v1.Status_OK || len(last.Data) != 0 || !strings.Contains(last.Message, "1 pod(s)") {
+		t.Errorf("unexpected final message %v", last)
+	}
+
+	files := unpackDiagnostics(t, stream.sent)
+	for _, name := range []string{"pods/test-uid-web.yaml", "logs/test-uid-web/app.log", "logs/test-uid-web/app.previous.log",
+		"logs/test-uid-web/proxy.log", "events.yaml", "services/test-uid-web.yaml", "configmaps.yaml", "secrets.yaml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("file %s missing in archive", name)
+		}
+	}
+	if _, ok := files["logs/test-uid-web/proxy.previous.log"]; ok {
+		t.Error("previous log of container without restarts collected")
+	}
+	if _, ok := files[path.Join("services", "other-web.yaml")]; ok {
+		t.Error("service of other instance collected")
+	}
+	if !strings.Contains(files["pods/test-uid-web.yaml"], "kind: Pod") || !strings.Contains(files["events.yaml"], "BackOff") {
+		t.Error("unexpected pod or events content")
+	}
+	if !strings.Contains(files["configmaps.yaml"], digestConfigMap(&cm).Sha256) || strings.Contains(files["configmaps.yaml"], "listen 80") {
+		t.Errorf("unexpected config maps content %s", files["configmaps.yaml"])
+	}
+	for name, content := range files {
+		if strings.Contains(content, "s3cr3t-value") || strings.Contains(content, "czNjcjN0LXZhbHVl") {
+			t.Errorf("secret value disclosed in %s", name)
+		}
+	}
+	if !strings.Contains(files["secrets.yaml"], "password") {
+		t.Errorf("unexpected secrets content %s", files["secrets.yaml"])
+	}
+	if !strings.Contains(files["configmaps.yaml"], "test-uid-nginx") || !strings.Contains(files["secrets.yaml"], "test-uid-auth") {
+		t.Errorf("unlabelled Janitor objects missing %s %s", files["configmaps.yaml"], files["secrets.yaml"])
+	}
+	if strings.Contains(files["secrets.yaml"], "test-uid-2-auth") {
+		t.Error("secret of other instance collected")
+	}
+}
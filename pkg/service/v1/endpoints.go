@@ -0,0 +1,654 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strings"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+var (
+	gatewayResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "gateways"}
+	httpRouteResource = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"}
+)
+
+//Prepare service endpoints response
+func prepareServiceEndpointsResponse(status v1.Status, message string, services []*v1.ServiceEndpoint, hosts []*v1.HostEndpoint) *v1.ServiceEndpointsResponse {
+	if services == nil {
+		services = make([]*v1.ServiceEndpoint, 0)
+	}
+	if hosts == nil {
+		hosts = make([]*v1.HostEndpoint, 0)
+	}
+	return &v1.ServiceEndpointsResponse{
+		Api: apiVersion,
+		Status: status,
+		Message: message,
+		Services: services,
+		Hosts: hosts,
+	}
+}
+
+//Check if hostname matches pattern, which may contain a leading wildcard label. Empty pattern matches any hostname.
+func hostnameMatches(pattern string, hostname string) bool {
+	pattern = strings.ToLower(pattern)
+	hostname = strings.ToLower(hostname)
+	if len(pattern) == 0 || pattern == hostname {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return strings.HasSuffix(hostname, suffix) && !strings.Contains(strings.TrimSuffix(hostname, suffix), ".")
+	}
+	return false
+}
+
+//Find all Services of the instance in given namespace
+func findInstanceServices(ctx context.Context, kubeAPI kubernetes.Interface, namespace string, uid string, label string) ([]apiv1.Service, error) {
+	all, err := kubeAPI.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	services := make([]apiv1.Service, 0)
+	for _, service := range all.Items {
+		if belongsToInstance(&service, uid, label) {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+//Describe addresses and ports of Service reachable from outside the cluster, returns false for internal services
+func serviceEndpoint(service *apiv1.Service) (*v1.ServiceEndpoint, bool) {
+	external := service.Spec.Type == apiv1.ServiceTypeLoadBalancer || service.Spec.Type == apiv1.ServiceTypeNodePort || len(service.Spec.ExternalIPs) > 0
+	if !external {
+		return nil, false
+	}
+
+	endpoint := &v1.ServiceEndpoint{
+		Name: service.Name,
+		Type: string(service.Spec.Type),
+		Ips: make([]string, 0),
+		Hostnames: make([]string, 0),
+		Ports: make([]*v1.ServicePort, 0, len(service.Spec.Ports)),
+	}
+	//dual-stack load balancers report separate entries for IPv4 and IPv6 addresses
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if len(ingress.IP) > 0 {
+			endpoint.Ips = append(endpoint.Ips, ingress.IP)
+		}
+		if len(ingress.Hostname) > 0 {
+			endpoint.Hostnames = append(endpoint.Hostnames, ingress.Hostname)
+		}
+	}
+	endpoint.Ips = append(endpoint.Ips, service.Spec.ExternalIPs...)
+
+	for _, port := range service.Spec.Ports {
+		servicePort := &v1.ServicePort{
+			Name: port.Name,
+			Port: port.Port,
+			Protocol: string(port.Protocol),
+			NodePort: port.NodePort,
+		}
+		if len(servicePort.Protocol) == 0 {
+			servicePort.Protocol = string(apiv1.ProtocolTCP)
+		}
+		if port.AppProtocol != nil {
+			servicePort.AppProtocol = *port.AppProtocol
+		}
+		endpoint.Ports = append(endpoint.Ports, servicePort)
+	}
+	return endpoint, true
+}
+
+//Check if hostname is covered by TLS section of Ingress
+func ingressHostTLS(ingress *networkingv1.Ingress, hostname string) bool {
+	for _, tls := range ingress.Spec.TLS {
+		for _, host := range tls.Hosts {
+			if len(host) > 0 && hostnameMatches(host, hostname) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Addresses assigned to Ingress by the ingress controller
+func ingressAddresses(ingress *networkingv1.Ingress) []string {
+	addresses := make([]string, 0)
+	for _, lb := range ingress.Status.LoadBalancer.Ingress {
+		if len(lb.IP) > 0 {
+			addresses = append(addresses, lb.IP)
+		}
+		if len(lb.Hostname) > 0 {
+			addresses = append(addresses, lb.Hostname)
+		}
+	}
+	return addresses
+}
+
+//Describe hostnames served by Ingress, rules without host are reported with empty hostname
+func ingressHostEndpoints(ingress *networkingv1.Ingress) []*v1.HostEndpoint {
+	hosts := make([]*v1.HostEndpoint, 0)
+	seen := make(map[string]bool)
+	addresses := ingressAddresses(ingress)
+	for _, rule := range ingress.Spec.Rules {
+		if seen[rule.Host] {
+			continue
+		}
+		seen[rule.Host] = true
+		hosts = append(hosts, &v1.HostEndpoint{
+			Hostname: rule.Host,
+			Tls: len(rule.Host) > 0 && ingressHostTLS(ingress, rule.Host),
+			Kind: "Ingress",
+			Name: ingress.Name,
+			Addresses: addresses,
+		})
+	}
+	return hosts
+}
+
+//Listener of Gateway API Gateway
+type gatewayListener struct {
+	name string
+	hostname string
+	protocol string
+	port int64
+}
+
+//Gateway listeners and addresses relevant for routes attached to it
+type gatewayInfo struct {
+	listeners []gatewayListener
+	addresses []string
+}
+
+func parseGateway(gateway *unstructured.Unstructured) *gatewayInfo {
+	info := &gatewayInfo{listeners: make([]gatewayListener, 0), addresses: make([]string, 0)}
+	listeners, _, _ := unstructured.NestedSlice(gateway.Object, "spec", "listeners")
+	for _, item := range listeners {
+		listener, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(listener, "name")
+		hostname, _, _ := unstructured.NestedString(listener, "hostname")
+		protocol, _, _ := unstructured.NestedString(listener, "protocol")
+		port, _, _ := unstructured.NestedInt64(listener, "port")
+		info.listeners = append(info.listeners, gatewayListener{name: name, hostname: hostname, protocol: protocol, port: port})
+	}
+	addresses, _, _ := unstructured.NestedSlice(gateway.Object, "status", "addresses")
+	for _, item := range addresses {
+		address, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if value, _, _ := unstructured.NestedString(address, "value"); len(value) > 0 {
+			info.addresses = append(info.addresses, value)
+		}
+	}
+	return info
+}
+
+//Reference from HTTPRoute to its parent Gateway, optionally restricted to single listener
+type routeParent struct {
+	namespace string
+	name string
+	sectionName string
+}
+
+func routeParents(route *unstructured.Unstructured) []routeParent {
+	parents := make([]routeParent, 0)
+	refs, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+	for _, item := range refs {
+		ref, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		group, found, _ := unstructured.NestedString(ref, "group")
+		kind, _, _ := unstructured.NestedString(ref, "kind")
+		if (found && group != gatewayResource.Group) || (len(kind) > 0 && kind != "Gateway") {
+			continue
+		}
+		parent := routeParent{namespace: route.GetNamespace()}
+		parent.name, _, _ = unstructured.NestedString(ref, "name")
+		parent.sectionName, _, _ = unstructured.NestedString(ref, "sectionName")
+		if namespace, _, _ := unstructured.NestedString(ref, "namespace"); len(namespace) > 0 {
+			parent.namespace = namespace
+		}
+		parents = append(parents, parent)
+	}
+	return parents
+}
+
+//Hostname under which HTTPRoute is exposed through one of its parent Gateway listeners
+type routeHostname struct {
+	hostname string
+	tls bool
+	port int64
+	addresses []string
+}
+
+//Resolves HTTPRoute hostnames against parent Gateways, caching Gateways fetched during single request
+type gatewayResolver struct {
+	dynamicAPI dynamic.Interface
+	gateways map[string]*gatewayInfo
+}
+
+func newGatewayResolver(dynamicAPI dynamic.Interface) *gatewayResolver {
+	return &gatewayResolver{dynamicAPI: dynamicAPI, gateways: make(map[string]*gatewayInfo)}
+}
+
+func (r *gatewayResolver) gateway(ctx context.Context, namespace string, name string) (*gatewayInfo, error) {
+	key := namespace + "/" + name
+	if info, ok := r.gateways[key]; ok {
+		return info, nil
+	}
+	gateway, err := r.dynamicAPI.Resource(gatewayResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		//route attached to missing Gateway is reported without addresses
+		r.gateways[key] = nil
+		return nil, nil
+	}
+	r.gateways[key] = parseGateway(gateway)
+	return r.gateways[key], nil
+}
+
+//List hostnames of HTTPRoute. Route without hostnames inherits hostnames of the listeners it is attached to.
+func (r *gatewayResolver) hostnames(ctx context.Context, route *unstructured.Unstructured) ([]routeHostname, error) {
+	routeHosts, _, _ := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+	hosts := make([]routeHostname, 0)
+	index := make(map[string]int)
+	add := func(host routeHostname) {
+		i, ok := index[host.hostname]
+		if !ok {
+			index[host.hostname] = len(hosts)
+			hosts = append(hosts, host)
+			return
+		}
+		//prefer TLS listener when hostname is served by both HTTP and HTTPS listeners
+		if host.tls && !hosts[i].tls {
+			hosts[i].tls = true
+			hosts[i].port = host.port
+		}
+	}
+
+	for _, parent := range routeParents(route) {
+		gateway, err := r.gateway(ctx, parent.namespace, parent.name)
+		if err != nil {
+			return nil, err
+		}
+		if gateway == nil {
+			for _, host := range routeHosts {
+				add(routeHostname{hostname: host, addresses: make([]string, 0)})
+			}
+			continue
+		}
+		for _, listener := range gateway.listeners {
+			if len(parent.sectionName) > 0 && parent.sectionName != listener.name {
+				continue
+			}
+			tls := listener.protocol == "HTTPS"
+			if len(routeHosts) == 0 {
+				add(routeHostname{hostname: listener.hostname, tls: tls, port: listener.port, addresses: gateway.addresses})
+				continue
+			}
+			for _, host := range routeHosts {
+				if hostnameMatches(listener.hostname, host) || hostnameMatches(host, listener.hostname) {
+					add(routeHostname{hostname: host, tls: tls, port: listener.port, addresses: gateway.addresses})
+				}
+			}
+		}
+	}
+	return hosts, nil
+}
+
+//Find all HTTPRoutes of the instance, returns empty list when Gateway API is not installed in the cluster
+func findInstanceHTTPRoutes(ctx context.Context, dynamicAPI dynamic.Interface, namespace string, uid string, label string) ([]unstructured.Unstructured, error) {
+	routes := make([]unstructured.Unstructured, 0)
+	if dynamicAPI == nil {
+		return routes, nil
+	}
+	all, err := dynamicAPI.Resource(httpRouteResource).Namespace(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return routes, nil
+		}
+		return nil, err
+	}
+	for i := range all.Items {
+		if belongsToInstance(&all.Items[i], uid, label) {
+			routes = append(routes, all.Items[i])
+		}
+	}
+	return routes, nil
+}
+
+//Collect hostnames under which instance is exposed through Ingresses and Gateway API HTTPRoutes
+func (s *informationServiceServer) instanceHostEndpoints(ctx context.Context, namespace string, uid string) ([]*v1.HostEndpoint, error) {
+	hosts := make([]*v1.HostEndpoint, 0)
+
+	ingresses, err := findInstanceIngresses(ctx, s.kubeAPI, namespace, uid, s.instanceLabel)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ingresses {
+		hosts = append(hosts, ingressHostEndpoints(&ingresses[i])...)
+	}
+
+	routes, err := findInstanceHTTPRoutes(ctx, s.dynamicAPI, namespace, uid, s.instanceLabel)
+	if err != nil {
+		return nil, err
+	}
+	resolver := newGatewayResolver(s.dynamicAPI)
+	for i := range routes {
+		routeHosts, err := resolver.hostnames(ctx, &routes[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range routeHosts {
+			hosts = append(hosts, &v1.HostEndpoint{
+				Hostname: host.hostname,
+				Tls: host.tls,
+				Kind: "HTTPRoute",
+				Name: routes[i].GetName(),
+				Addresses: host.addresses,
+			})
+		}
+	}
+
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return hosts[i].Hostname < hosts[j].Hostname
+	})
+	return hosts, nil
+}
+
+func (s *informationServiceServer) RetrieveServiceEndpoints(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceEndpointsResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+	logLine(fmt.Sprintf("> Retrieving endpoints of instance %s in namespace %s", depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareServiceEndpointsResponse(v1.Status_FAILED, namespaceNotFound, nil, nil), err
+	}
+
+	services, err := findInstanceServices(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareServiceEndpointsResponse(v1.Status_FAILED, "Failed to retrieve services", nil, nil), err
+	}
+	endpoints := make([]*v1.ServiceEndpoint, 0)
+	waiting := make([]string, 0)
+	for i := range services {
+		endpoint, external := serviceEndpoint(&services[i])
+		if !external {
+			continue
+		}
+		endpoints = append(endpoints, endpoint)
+		if services[i].Spec.Type == apiv1.ServiceTypeLoadBalancer && len(services[i].Status.LoadBalancer.Ingress) == 0 {
+			waiting = append(waiting, services[i].Name)
+		}
+	}
+
+	hosts, err := s.instanceHostEndpoints(ctx, depl.Namespace, depl.Uid)
+	if err != nil {
+		return prepareServiceEndpointsResponse(v1.Status_FAILED, "Failed to retrieve ingresses and routes", endpoints, nil), err
+	}
+
+	if len(endpoints) == 0 && len(hosts) == 0 {
+		logLine("No externally reachable endpoints found")
+		return prepareServiceEndpointsResponse(v1.Status_FAILED, "No externally reachable endpoints found!", endpoints, hosts), nil
+	}
+	if len(waiting) > 0 {
+		message := fmt.Sprintf("Waiting for load balancer address of service(s) %s", strings.Join(waiting, ", "))
+		return prepareServiceEndpointsResponse(v1.Status_PENDING, message, endpoints, hosts), nil
+	}
+	message := fmt.Sprintf("Found %d service(s) and %d host(s)", len(endpoints), len(hosts))
+	logLine(message)
+	return prepareServiceEndpointsResponse(v1.Status_OK, message, endpoints, hosts), nil
+}
+
+//Prepare instance URLs response
+func prepareInstanceUrlsResponse(status v1.Status, message string, urls []*v1.InstanceUrl) *v1.InstanceUrlsResponse {
+	if urls == nil {
+		urls = make([]*v1.InstanceUrl, 0)
+	}
+	return &v1.InstanceUrlsResponse{
+		Api: apiVersion,
+		Status: status,
+		Message: message,
+		Urls: urls,
+	}
+}
+
+//Build URL, omitting port when it is the default one for the scheme
+func instanceUrl(tls bool, host string, port int64, path string) string {
+	scheme := "http"
+	defaultPort := int64(80)
+	if tls {
+		scheme = "https"
+		defaultPort = 443
+	}
+	if port > 0 && port != defaultPort {
+		host = fmt.Sprintf("%s:%d", host, port)
+	}
+	if len(path) == 0 || !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return scheme + "://" + host + path
+}
+
+//Format port of Service backend, which may be given either by number or by name
+func backendPort(number int64, name string) string {
+	if number > 0 {
+		return fmt.Sprintf("%d", number)
+	}
+	return name
+}
+
+//List URLs served by Ingress. Rules without host are reachable through address assigned by ingress controller.
+func ingressUrls(ingress *networkingv1.Ingress) []*v1.InstanceUrl {
+	urls := make([]*v1.InstanceUrl, 0)
+	addresses := ingressAddresses(ingress)
+	add := func(host string, path string, backend *networkingv1.IngressBackend) {
+		if len(host) == 0 {
+			if len(addresses) == 0 {
+				return
+			}
+			host = addresses[0]
+		}
+		tls := ingressHostTLS(ingress, host)
+		url := &v1.InstanceUrl{
+			Url: instanceUrl(tls, host, 0, path),
+			Hostname: host,
+			Path: path,
+			Tls: tls,
+			Kind: "Ingress",
+			Name: ingress.Name,
+		}
+		if backend != nil && backend.Service != nil {
+			url.ServiceName = backend.Service.Name
+			url.ServicePort = backendPort(int64(backend.Service.Port.Number), backend.Service.Port.Name)
+		}
+		urls = append(urls, url)
+	}
+
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil || len(rule.HTTP.Paths) == 0 {
+			add(rule.Host, "/", ingress.Spec.DefaultBackend)
+			continue
+		}
+		for i := range rule.HTTP.Paths {
+			path := rule.HTTP.Paths[i].Path
+			if len(path) == 0 {
+				path = "/"
+			}
+			add(rule.Host, path, &rule.HTTP.Paths[i].Backend)
+		}
+	}
+	if len(ingress.Spec.Rules) == 0 && ingress.Spec.DefaultBackend != nil {
+		add("", "/", ingress.Spec.DefaultBackend)
+	}
+	return urls
+}
+
+//Service backend referenced by HTTPRoute rule
+type routeBackend struct {
+	name string
+	port string
+}
+
+//Paths and backends of HTTPRoute rule, rule without path matches serves all paths
+func routeRule(rule map[string]interface{}) ([]string, []routeBackend) {
+	paths := make([]string, 0)
+	matches, _, _ := unstructured.NestedSlice(rule, "matches")
+	for _, item := range matches {
+		match, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if path, _, _ := unstructured.NestedString(match, "path", "value"); len(path) > 0 {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		paths = append(paths, "/")
+	}
+
+	backends := make([]routeBackend, 0)
+	refs, _, _ := unstructured.NestedSlice(rule, "backendRefs")
+	for _, item := range refs {
+		ref, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if kind, _, _ := unstructured.NestedString(ref, "kind"); len(kind) > 0 && kind != "Service" {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(ref, "name")
+		port, _, _ := unstructured.NestedInt64(ref, "port")
+		backends = append(backends, routeBackend{name: name, port: backendPort(port, "")})
+	}
+	return paths, backends
+}
+
+//List URLs served by HTTPRoute through its parent Gateways, one per hostname, path and backend
+func (r *gatewayResolver) urls(ctx context.Context, route *unstructured.Unstructured) ([]*v1.InstanceUrl, error) {
+	hosts, err := r.hostnames(ctx, route)
+	if err != nil {
+		return nil, err
+	}
+	rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+	if len(rules) == 0 {
+		//route without rules forwards all requests, backend is not known
+		rules = []interface{}{map[string]interface{}{}}
+	}
+
+	urls := make([]*v1.InstanceUrl, 0)
+	for _, host := range hosts {
+		hostname := host.hostname
+		//wildcard hostnames can not be turned into URL, route without hostname is reachable by Gateway address
+		if strings.HasPrefix(hostname, "*") {
+			continue
+		}
+		if len(hostname) == 0 {
+			if len(host.addresses) == 0 {
+				continue
+			}
+			hostname = host.addresses[0]
+		}
+		for _, item := range rules {
+			rule, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			paths, backends := routeRule(rule)
+			if len(backends) == 0 {
+				backends = append(backends, routeBackend{})
+			}
+			for _, path := range paths {
+				for _, backend := range backends {
+					urls = append(urls, &v1.InstanceUrl{
+						Url: instanceUrl(host.tls, hostname, host.port, path),
+						Hostname: hostname,
+						Path: path,
+						Tls: host.tls,
+						Kind: "HTTPRoute",
+						Name: route.GetName(),
+						ServiceName: backend.name,
+						ServicePort: backend.port,
+					})
+				}
+			}
+		}
+	}
+	return urls, nil
+}
+
+func (s *informationServiceServer) RetrieveInstanceUrls(ctx context.Context, req *v1.InstanceRequest) (*v1.InstanceUrlsResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+	logLine(fmt.Sprintf("> Retrieving URLs of instance %s in namespace %s", depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareInstanceUrlsResponse(v1.Status_FAILED, namespaceNotFound, nil), err
+	}
+
+	ingresses, err := findInstanceIngresses(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareInstanceUrlsResponse(v1.Status_FAILED, "Failed to retrieve ingresses", nil), err
+	}
+	routes, err := findInstanceHTTPRoutes(ctx, s.dynamicAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareInstanceUrlsResponse(v1.Status_FAILED, "Failed to retrieve routes", nil), err
+	}
+	if len(ingresses) == 0 && len(routes) == 0 {
+		logLine("No ingresses or routes found")
+		return prepareInstanceUrlsResponse(v1.Status_FAILED, "No ingresses or routes found!", nil), nil
+	}
+
+	urls := make([]*v1.InstanceUrl, 0)
+	for i := range ingresses {
+		urls = append(urls, ingressUrls(&ingresses[i])...)
+	}
+	resolver := newGatewayResolver(s.dynamicAPI)
+	for i := range routes {
+		routeUrls, err := resolver.urls(ctx, &routes[i])
+		if err != nil {
+			return prepareInstanceUrlsResponse(v1.Status_FAILED, "Failed to retrieve gateways", urls), err
+		}
+		urls = append(urls, routeUrls...)
+	}
+
+	//Ingress or route exists, but controller has not assigned an address to it yet
+	if len(urls) == 0 {
+		return prepareInstanceUrlsResponse(v1.Status_PENDING, "Waiting for ingress or gateway address", urls), nil
+	}
+	message := fmt.Sprintf("Found %d URL(s)", len(urls))
+	logLine(message)
+	return prepareInstanceUrlsResponse(v1.Status_OK, message, urls), nil
+}
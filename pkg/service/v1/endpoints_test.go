@@ -0,0 +1,337 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+//Fake client seeded through Create, since objects of kinds unknown to the scheme are not tracked when passed to the constructor
+func newFakeGatewayClient(objects ...*unstructured.Unstructured) *dynamicfake.FakeDynamicClient {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		gatewayResource: "GatewayList",
+		httpRouteResource: "HTTPRouteList",
+	})
+	for _, object := range objects {
+		resource := httpRouteResource
+		if object.GetKind() == "Gateway" {
+			resource = gatewayResource
+		}
+		_, _ = client.Resource(resource).Namespace(object.GetNamespace()).Create(context.Background(), object, metav1.CreateOptions{})
+	}
+	return client
+}
+
+func newTestGateway(namespace string, name string, listeners []interface{}, address string) *unstructured.Unstructured {
+	gateway := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"gatewayClassName": "test", "listeners": listeners},
+		"status": map[string]interface{}{"addresses": []interface{}{map[string]interface{}{"type": "IPAddress", "value": address}}},
+	}}
+	gateway.SetAPIVersion("gateway.networking.k8s.io/v1")
+	gateway.SetKind("Gateway")
+	gateway.SetNamespace(namespace)
+	gateway.SetName(name)
+	return gateway
+}
+
+func newTestHTTPRoute(namespace string, name string, hostnames []interface{}, parentRefs []interface{}, rules []interface{}) *unstructured.Unstructured {
+	spec := map[string]interface{}{"parentRefs": parentRefs, "rules": rules}
+	if hostnames != nil {
+		spec["hostnames"] = hostnames
+	}
+	route := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	route.SetAPIVersion("gateway.networking.k8s.io/v1")
+	route.SetKind("HTTPRoute")
+	route.SetNamespace(namespace)
+	route.SetName(name)
+	route.SetLabels(map[string]string{"app.kubernetes.io/instance": "test-uid"})
+	return route
+}
+
+func TestHostnameMatches(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		hostname string
+		expected bool
+	}{
+		{"", "app.example.com", true},
+		{"app.example.com", "APP.example.com", true},
+		{"*.example.com", "app.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.app.example.com", false},
+		{"other.example.com", "app.example.com", false},
+	}
+	for _, test := range tests {
+		if hostnameMatches(test.pattern, test.hostname) != test.expected {
+			t.Errorf("unexpected result for pattern '%s' and hostname '%s'", test.pattern, test.hostname)
+		}
+	}
+}
+
+func TestInformationServiceServer_RetrieveServiceEndpoints(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	gateways := []interface{}{
+		map[string]interface{}{"name": "http", "protocol": "HTTP", "port": int64(80)},
+		map[string]interface{}{"name": "https", "protocol": "HTTPS", "port": int64(443), "hostname": "*.example.com"},
+	}
+	dynamicClient := newFakeGatewayClient(
+		newTestGateway("gateways", "public", gateways, "192.0.2.10"),
+		newTestHTTPRoute("test-namespace", "test-uid-api", []interface{}{"api.example.com"},
+			[]interface{}{map[string]interface{}{"name": "public", "namespace": "gateways"}}, nil),
+		newTestHTTPRoute("test-namespace", "test-uid-plain", []interface{}{"plain.example.org"},
+			[]interface{}{map[string]interface{}{"name": "public", "namespace": "gateways", "sectionName": "http"}}, nil),
+	)
+	server := NewInformationServiceServer(client, dynamicClient, "")
+
+	//Fail on API version check
+	res, err := server.RetrieveServiceEndpoints(context.Background(), &illegal_req)
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	freq := v1.InstanceRequest{Api: apiVersion, Deployment: &fake_ns_inst}
+	res, err = server.RetrieveServiceEndpoints(context.Background(), &freq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//ClusterIP services are not reachable from outside
+	internal := corev1.Service{}
+	internal.Name = "test-uid-db"
+	internal.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	internal.Spec.Type = corev1.ServiceTypeClusterIP
+	internal.Spec.Ports = []corev1.ServicePort{{Port: 5432}}
+	_, _ = client.CoreV1().Services("test-namespace").Create(context.Background(), &internal, metav1.CreateOptions{})
+
+	//load balancer still waiting for address
+	lb := corev1.Service{}
+	lb.Name = "test-uid"
+	lb.Spec.Type = corev1.ServiceTypeLoadBalancer
+	lb.Spec.Ports = []corev1.ServicePort{{Name: "syslog", Port: 514, Protocol: corev1.ProtocolUDP, NodePort: 30514}, {Name: "web", Port: 80, NodePort: 30080}}
+	_, _ = client.CoreV1().Services("test-namespace").Create(context.Background(), &lb, metav1.CreateOptions{})
+
+	res, err = server.RetrieveServiceEndpoints(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_PENDING || len(res.Services) != 1 {
+		t.Fatal(err, res)
+	}
+
+	//dual-stack load balancer reporting both addresses and hostname
+	lb.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.10.1.1"}, {IP: "2001:db8::1"}, {Hostname: "lb.example.net"}}
+	_, _ = client.CoreV1().Services("test-namespace").UpdateStatus(context.Background(), &lb, metav1.UpdateOptions{})
+
+	ingress := networkingv1.Ingress{}
+	ingress.Name = "test-uid"
+	ingress.Spec.Rules = []networkingv1.IngressRule{{Host: "app.example.com"}, {Host: "other.example.com"}}
+	ingress.Spec.TLS = []networkingv1.IngressTLS{{Hosts: []string{"app.example.com"}, SecretName: "test-uid-tls"}}
+	ingress.Status.LoadBalancer.Ingress = []networkingv1.IngressLoadBalancerIngress{{IP: "10.10.1.2"}}
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &ingress, metav1.CreateOptions{})
+
+	res, err = server.RetrieveServiceEndpoints(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || len(res.Services) != 1 || len(res.Hosts) != 4 {
+		t.Fatal(err, res)
+	}
+
+	service := res.Services[0]
+	if service.Name != "test-uid" || service.Type != "LoadBalancer" || len(service.Ips) != 2 || service.Ips[1] != "2001:db8::1" ||
+		len(service.Hostnames) != 1 || service.Hostnames[0] != "lb.example.net" {
+		t.Errorf("unexpected service %v", service)
+	}
+	if len(service.Ports) != 2 || service.Ports[0].Protocol != "UDP" || service.Ports[0].NodePort != 30514 || service.Ports[1].Protocol != "TCP" {
+		t.Errorf("unexpected ports %v", service.Ports)
+	}
+
+	expected := []struct {
+		hostname string
+		tls      bool
+		kind     string
+		address  string
+	}{
+		{"api.example.com", true, "HTTPRoute", "192.0.2.10"},
+		{"app.example.com", true, "Ingress", "10.10.1.2"},
+		{"other.example.com", false, "Ingress", "10.10.1.2"},
+		{"plain.example.org", false, "HTTPRoute", "192.0.2.10"},
+	}
+	for i, e := range expected {
+		host := res.Hosts[i]
+		if host.Hostname != e.hostname || host.Tls != e.tls || host.Kind != e.kind || len(host.Addresses) != 1 || host.Addresses[0] != e.address {
+			t.Errorf("unexpected host %v", host)
+		}
+	}
+}
+
+func TestInformationServiceServer_RetrieveServiceEndpointsWithoutEndpoints(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewInformationServiceServer(client, nil, "")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	res, err := server.RetrieveServiceEndpoints(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_FAILED || len(res.Services) != 0 || len(res.Hosts) != 0 {
+		t.Fail()
+	}
+}
+
+func TestInformationServiceServer_RetrieveServiceEndpointsCustomLabel(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewInformationServiceServer(client, nil, "nmaas.eu/instance")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//services selected by configured label, default label and name prefix are ignored
+	for name, labels := range map[string]map[string]string{
+		"web": {"nmaas.eu/instance": "test-uid"},
+		"test-uid-api": {"app.kubernetes.io/instance": "test-uid"},
+		"test-uid-2": {"nmaas.eu/instance": "test-uid-2"},
+	} {
+		svc := corev1.Service{}
+		svc.Name = name
+		svc.Labels = labels
+		svc.Spec.Type = corev1.ServiceTypeNodePort
+		svc.Spec.Ports = []corev1.ServicePort{{Port: 80, NodePort: 30080}}
+		_, _ = client.CoreV1().Services("test-namespace").Create(context.Background(), &svc, metav1.CreateOptions{})
+	}
+
+	res, err := server.RetrieveServiceEndpoints(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || len(res.Services) != 1 || res.Services[0].Name != "web" {
+		t.Fatal(err, res)
+	}
+}
+
+func TestInstanceUrl(t *testing.T) {
+	if instanceUrl(true, "app.example.com", 443, "/api") != "https://app.example.com/api" {
+		t.Fail()
+	}
+	if instanceUrl(false, "app.example.com", 8080, "") != "http://app.example.com:8080/" {
+		t.Fail()
+	}
+}
+
+func TestInformationServiceServer_RetrieveInstanceUrls(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	listeners := []interface{}{
+		map[string]interface{}{"name": "https", "protocol": "HTTPS", "port": int64(443), "hostname": "*.example.com"},
+		map[string]interface{}{"name": "alt", "protocol": "HTTP", "port": int64(8080)},
+	}
+	dynamicClient := newFakeGatewayClient(
+		newTestGateway("test-namespace", "shared", listeners, "192.0.2.10"),
+		newTestHTTPRoute("test-namespace", "test-uid-api", []interface{}{"api.example.com"},
+			[]interface{}{map[string]interface{}{"name": "shared", "sectionName": "https"}},
+			[]interface{}{map[string]interface{}{
+				"matches": []interface{}{map[string]interface{}{"path": map[string]interface{}{"type": "PathPrefix", "value": "/v1"}}},
+				"backendRefs": []interface{}{map[string]interface{}{"name": "test-uid-api", "port": int64(8000)}},
+			}}),
+		newTestHTTPRoute("test-namespace", "test-uid-metrics", nil,
+			[]interface{}{map[string]interface{}{"name": "shared", "sectionName": "alt"}},
+			[]interface{}{map[string]interface{}{
+				"backendRefs": []interface{}{map[string]interface{}{"name": "test-uid-metrics", "port": int64(9090)}},
+			}}),
+	)
+	server := NewInformationServiceServer(client, dynamicClient, "")
+
+	//Fail on API version check
+	res, err := server.RetrieveInstanceUrls(context.Background(), &illegal_req)
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	freq := v1.InstanceRequest{Api: apiVersion, Deployment: &fake_ns_inst}
+	res, err = server.RetrieveInstanceUrls(context.Background(), &freq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	pathType := networkingv1.PathTypePrefix
+	ingress := networkingv1.Ingress{}
+	ingress.Name = "test-uid"
+	ingress.Spec.Rules = []networkingv1.IngressRule{{
+		Host: "app.example.com",
+		IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{Paths: []networkingv1.HTTPIngressPath{
+			{Path: "/", PathType: &pathType, Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{
+				Name: "test-uid", Port: networkingv1.ServiceBackendPort{Number: 80}}}},
+			{Path: "/admin", PathType: &pathType, Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{
+				Name: "test-uid-admin", Port: networkingv1.ServiceBackendPort{Name: "http"}}}},
+		}}},
+	}}
+	ingress.Spec.TLS = []networkingv1.IngressTLS{{Hosts: []string{"app.example.com"}, SecretName: "test-uid-tls"}}
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &ingress, metav1.CreateOptions{})
+
+	res, err = server.RetrieveInstanceUrls(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || len(res.Urls) != 4 {
+		t.Fatal(err, res)
+	}
+
+	expected := []struct {
+		url         string
+		tls         bool
+		kind        string
+		serviceName string
+		servicePort string
+	}{
+		{"https://app.example.com/", true, "Ingress", "test-uid", "80"},
+		{"https://app.example.com/admin", true, "Ingress", "test-uid-admin", "http"},
+		{"https://api.example.com/v1", true, "HTTPRoute", "test-uid-api", "8000"},
+		{"http://192.0.2.10:8080/", false, "HTTPRoute", "test-uid-metrics", "9090"},
+	}
+	for i, e := range expected {
+		url := res.Urls[i]
+		if url.Url != e.url || url.Tls != e.tls || url.Kind != e.kind || url.ServiceName != e.serviceName || url.ServicePort != e.servicePort {
+			t.Errorf("unexpected url %v", url)
+		}
+	}
+}
+
+func TestInformationServiceServer_RetrieveInstanceUrlsWithoutGatewayAPI(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewInformationServiceServer(client, nil, "")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	res, err := server.RetrieveInstanceUrls(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_FAILED || len(res.Urls) != 0 {
+		t.Fail()
+	}
+
+	//Ingress without host is reachable only once controller assigns an address
+	ingress := networkingv1.Ingress{}
+	ingress.Name = "test-uid"
+	ingress.Spec.DefaultBackend = &networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{
+		Name: "test-uid", Port: networkingv1.ServiceBackendPort{Number: 80}}}
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &ingress, metav1.CreateOptions{})
+
+	res, err = server.RetrieveInstanceUrls(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_PENDING {
+		t.Fail()
+	}
+
+	ingress.Status.LoadBalancer.Ingress = []networkingv1.IngressLoadBalancerIngress{{IP: "10.10.1.2"}}
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").UpdateStatus(context.Background(), &ingress, metav1.UpdateOptions{})
+
+	res, err = server.RetrieveInstanceUrls(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || len(res.Urls) != 1 || res.Urls[0].Url != "http://10.10.1.2/" || res.Urls[0].ServiceName != "test-uid" {
+		t.Errorf("unexpected response %v", res)
+	}
+}
@@ -0,0 +1,484 @@
+package v1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+const (
+	//Only the newest events are listed when more match the request
+	maxListedEvents = 500
+	//Objects of the instance are looked up again for unknown involved objects, but not more often than this.
+	//Events of unknown objects arriving in between are checked again after the next refresh.
+	instanceObjectsRefreshPeriod = 5 * time.Second
+)
+
+type eventServiceServer struct {
+	kubeAPI kubernetes.Interface
+	instanceLabel string
+}
+
+func NewEventServiceServer(kubeAPI kubernetes.Interface, label string) v1.EventServiceServer {
+	if len(label) == 0 {
+		label = instanceLabel
+	}
+	return &eventServiceServer{kubeAPI: kubeAPI, instanceLabel: label}
+}
+
+//Prepare events response
+func prepareEventsResponse(status v1.Status, message string, events []*v1.EventInfo) *v1.EventsResponse {
+	if events == nil {
+		events = make([]*v1.EventInfo, 0)
+	}
+	return &v1.EventsResponse{
+		Api: apiVersion,
+		Status: status,
+		Message: message,
+		Events: events,
+	}
+}
+
+//Event criteria requested by client, empty criteria match every event
+type eventFilter struct {
+	eventType string
+	reasons map[string]bool
+	since *time.Time
+	until *time.Time
+}
+
+func newEventFilter(req *v1.EventsRequest, now time.Time) (*eventFilter, error) {
+	filter := &eventFilter{reasons: make(map[string]bool)}
+	switch {
+	case len(req.Type) == 0:
+	case strings.EqualFold(req.Type, apiv1.EventTypeNormal):
+		filter.eventType = apiv1.EventTypeNormal
+	case strings.EqualFold(req.Type, apiv1.EventTypeWarning):
+		filter.eventType = apiv1.EventTypeWarning
+	default:
+		return nil, fmt.Errorf("type must be either %s or %s", apiv1.EventTypeNormal, apiv1.EventTypeWarning)
+	}
+	for _, reason := range req.Reasons {
+		filter.reasons[reason] = true
+	}
+
+	if req.SinceSeconds < 0 {
+		return nil, errors.New("sinceSeconds must not be negative")
+	}
+	if req.SinceSeconds > 0 && len(req.SinceTime) > 0 {
+		return nil, errors.New("only one of sinceSeconds and sinceTime may be given")
+	}
+	if req.SinceSeconds > 0 {
+		since := now.Add(-time.Duration(req.SinceSeconds) * time.Second)
+		filter.since = &since
+	}
+	if len(req.SinceTime) > 0 {
+		since, err := time.Parse(time.RFC3339, req.SinceTime)
+		if err != nil {
+			return nil, fmt.Errorf("sinceTime '%s' is not a valid RFC 3339 timestamp", req.SinceTime)
+		}
+		filter.since = &since
+	}
+	if len(req.UntilTime) > 0 {
+		until, err := time.Parse(time.RFC3339, req.UntilTime)
+		if err != nil {
+			return nil, fmt.Errorf("untilTime '%s' is not a valid RFC 3339 timestamp", req.UntilTime)
+		}
+		if filter.since != nil && until.Before(*filter.since) {
+			return nil, errors.New("untilTime must not be before the start of time window")
+		}
+		filter.until = &until
+	}
+	return filter, nil
+}
+
+//List options narrowing events on API server side, the filter is applied again to listed events
+func (f *eventFilter) listOptions() metav1.ListOptions {
+	if len(f.eventType) == 0 {
+		return metav1.ListOptions{}
+	}
+	return metav1.ListOptions{FieldSelector: "type=" + f.eventType}
+}
+
+func (f *eventFilter) matches(event *apiv1.Event) bool {
+	if len(f.eventType) > 0 && event.Type != f.eventType {
+		return false
+	}
+	if len(f.reasons) > 0 && !f.reasons[event.Reason] {
+		return false
+	}
+	last := eventTime(event)
+	if f.since != nil && last.Before(*f.since) {
+		return false
+	}
+	return f.until == nil || !last.After(*f.until)
+}
+
+//Objects of the instance which events may involve, identified by kind and name
+type instanceObjects struct {
+	kubeAPI kubernetes.Interface
+	namespace string
+	uid string
+	label string
+	names map[string]bool
+	refreshed time.Time
+}
+
+func objectKey(kind string, name string) string {
+	return kind + "/" + name
+}
+
+//Collect instance pods with their owners and labelled workloads and volume claims
+func (o *instanceObjects) refresh(ctx context.Context) error {
+	names := make(map[string]bool)
+	pods, err := findInstancePodsBySelector(ctx, o.kubeAPI, o.namespace, o.uid, o.label)
+	if err != nil {
+		return err
+	}
+	replicaSets := make(map[string]bool)
+	for _, pod := range pods {
+		names[objectKey("Pod", pod.Name)] = true
+		for _, owner := range pod.OwnerReferences {
+			names[objectKey(owner.Kind, owner.Name)] = true
+			if owner.Kind == "ReplicaSet" {
+				replicaSets[owner.Name] = true
+			}
+		}
+	}
+	//Deployments are found as owners of replica sets running instance pods
+	for name := range replicaSets {
+		rs, err := o.kubeAPI.AppsV1().ReplicaSets(o.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			continue
+		}
+		for _, owner := range rs.OwnerReferences {
+			names[objectKey(owner.Kind, owner.Name)] = true
+		}
+	}
+
+	options := metav1.ListOptions{LabelSelector: o.label + "=" + o.uid}
+	deployments, err := o.kubeAPI.AppsV1().Deployments(o.namespace).List(ctx, options)
+	if err != nil {
+		return err
+	}
+	for _, deployment := range deployments.Items {
+		names[objectKey("Deployment", deployment.Name)] = true
+	}
+	statefulSets, err := o.kubeAPI.AppsV1().StatefulSets(o.namespace).List(ctx, options)
+	if err != nil {
+		return err
+	}
+	for _, statefulSet := range statefulSets.Items {
+		names[objectKey("StatefulSet", statefulSet.Name)] = true
+	}
+	daemonSets, err := o.kubeAPI.AppsV1().DaemonSets(o.namespace).List(ctx, options)
+	if err != nil {
+		return err
+	}
+	for _, daemonSet := range daemonSets.Items {
+		names[objectKey("DaemonSet", daemonSet.Name)] = true
+	}
+	jobs, err := o.kubeAPI.BatchV1().Jobs(o.namespace).List(ctx, options)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs.Items {
+		names[objectKey("Job", job.Name)] = true
+	}
+	claims, err := o.kubeAPI.CoreV1().PersistentVolumeClaims(o.namespace).List(ctx, options)
+	if err != nil {
+		return err
+	}
+	for _, claim := range claims.Items {
+		names[objectKey("PersistentVolumeClaim", claim.Name)] = true
+	}
+
+	o.names = names
+	o.refreshed = time.Now()
+	return nil
+}
+
+//Check if event involves object named after the instance or one of collected instance objects
+func (o *instanceObjects) involves(event *apiv1.Event) bool {
+	name := event.InvolvedObject.Name
+	return name == o.uid || o.names[objectKey(event.InvolvedObject.Kind, name)]
+}
+
+//Effective number of occurrences, series count is used by events created through events.k8s.io API
+func eventCount(event *apiv1.Event) int32 {
+	count := event.Count
+	if event.Series != nil && event.Series.Count > count {
+		count = event.Series.Count
+	}
+	if count < 1 {
+		count = 1
+	}
+	return count
+}
+
+//Merge events repeating the same occurrence into single entry with summed count, ordered from the oldest
+func dedupeEvents(events []apiv1.Event) []*v1.EventInfo {
+	type entry struct {
+		info *v1.EventInfo
+		first time.Time
+		last time.Time
+	}
+	entries := make(map[string]*entry)
+	order := make([]string, 0)
+	for i := range events {
+		event := &events[i]
+		key := strings.Join([]string{event.Type, event.InvolvedObject.Kind, event.InvolvedObject.Name, event.Reason, event.Message}, "\x00")
+		info := eventInfo(event)
+		info.Count = eventCount(event)
+		first, last := event.FirstTimestamp.Time, eventTime(event)
+		if first.IsZero() {
+			first = last
+		}
+
+		existing, found := entries[key]
+		if !found {
+			entries[key] = &entry{info: info, first: first, last: last}
+			order = append(order, key)
+			continue
+		}
+		existing.info.Count += info.Count
+		if first.Before(existing.first) {
+			existing.first = first
+			existing.info.FirstTimestamp = info.FirstTimestamp
+		}
+		if last.After(existing.last) {
+			existing.last = last
+			existing.info.LastTimestamp = info.LastTimestamp
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return entries[order[i]].last.Before(entries[order[j]].last)
+	})
+	infos := make([]*v1.EventInfo, 0, len(order))
+	for _, key := range order {
+		infos = append(infos, entries[key].info)
+	}
+	return infos
+}
+
+func (s *eventServiceServer) ListEvents(ctx context.Context, req *v1.EventsRequest) (*v1.EventsResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Instance
+	logLine(fmt.Sprintf("> Listing events of instance %s in namespace %s", depl.Uid, depl.Namespace))
+
+	filter, err := newEventFilter(req, time.Now())
+	if err != nil {
+		return prepareEventsResponse(v1.Status_FAILED, err.Error(), nil), status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+
+	//check if given k8s namespace exists
+	_, err = s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareEventsResponse(v1.Status_FAILED, namespaceNotFound, nil), err
+	}
+
+	objects := &instanceObjects{kubeAPI: s.kubeAPI, namespace: depl.Namespace, uid: depl.Uid, label: s.instanceLabel}
+	if err = objects.refresh(ctx); err != nil {
+		return prepareEventsResponse(v1.Status_FAILED, "Issue with collecting instance objects", nil), err
+	}
+	list, err := s.kubeAPI.CoreV1().Events(depl.Namespace).List(ctx, filter.listOptions())
+	if err != nil {
+		return prepareEventsResponse(v1.Status_FAILED, "Issue with listing events", nil), err
+	}
+
+	events := make([]apiv1.Event, 0)
+	for i := range list.Items {
+		if filter.matches(&list.Items[i]) && objects.involves(&list.Items[i]) {
+			events = append(events, list.Items[i])
+		}
+	}
+	infos := dedupeEvents(events)
+	message := fmt.Sprintf("Found %d event(s)", len(infos))
+	if len(infos) > maxListedEvents {
+		infos = infos[len(infos)-maxListedEvents:]
+		message += fmt.Sprintf(", only the newest %d are listed", maxListedEvents)
+	}
+	logLine("< " + message)
+	return prepareEventsResponse(v1.Status_OK, message, infos), nil
+}
+
+//Events of the instance sent to watching client, repeated occurrences are sent only when their count grows
+type eventWatch struct {
+	filter *eventFilter
+	objects *instanceObjects
+	counts map[string]int32
+	//events of unknown objects received too soon after the last refresh, by event key
+	unmatched map[string]apiv1.Event
+}
+
+//Select events not sent before or occurring again since they were sent
+func (w *eventWatch) process(ctx context.Context, events []apiv1.Event) []apiv1.Event {
+	selected := make([]apiv1.Event, 0)
+	for i := range events {
+		event := &events[i]
+		if !w.filter.matches(event) {
+			continue
+		}
+		key := event.Namespace + "/" + event.Name
+		if !w.objects.involves(event) {
+			//event may involve object created after the last refresh
+			if time.Since(w.objects.refreshed) < instanceObjectsRefreshPeriod {
+				w.unmatched[key] = *event
+				continue
+			}
+			if w.objects.refresh(ctx) != nil || !w.objects.involves(event) {
+				continue
+			}
+		}
+		delete(w.unmatched, key)
+		if count := eventCount(event); count > w.counts[key] {
+			w.counts[key] = count
+			selected = append(selected, *event)
+		}
+	}
+	return selected
+}
+
+//Refresh instance objects and select pending events of unknown objects that turned out to belong to the instance
+func (w *eventWatch) recheck(ctx context.Context) []apiv1.Event {
+	selected := make([]apiv1.Event, 0)
+	if len(w.unmatched) == 0 {
+		return selected
+	}
+	pending := w.unmatched
+	w.unmatched = make(map[string]apiv1.Event)
+	if err := w.objects.refresh(ctx); err != nil {
+		return selected
+	}
+	for key, event := range pending {
+		if !w.objects.involves(&event) {
+			continue
+		}
+		if count := eventCount(&event); count > w.counts[key] {
+			w.counts[key] = count
+			selected = append(selected, event)
+		}
+	}
+	return selected
+}
+
+func (s *eventServiceServer) WatchEvents(req *v1.EventsRequest, stream v1.EventService_WatchEventsServer) error {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return err
+	}
+
+	depl := req.Instance
+	timeout := watchTimeout(req.TimeoutSeconds)
+	logLine(fmt.Sprintf("> Watching events of instance %s in namespace %s for %s", depl.Uid, depl.Namespace, timeout))
+
+	filter, err := newEventFilter(req, time.Now())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(stream.Context(), timeout)
+	defer cancel()
+
+	//check if given k8s namespace exists
+	_, err = s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	objects := &instanceObjects{kubeAPI: s.kubeAPI, namespace: depl.Namespace, uid: depl.Uid, label: s.instanceLabel}
+	if err = objects.refresh(ctx); err != nil {
+		return eventWatchEndError(ctx, err)
+	}
+	w := &eventWatch{filter: filter, objects: objects, counts: make(map[string]int32), unmatched: make(map[string]apiv1.Event)}
+	recheck := time.NewTicker(instanceObjectsRefreshPeriod)
+	defer recheck.Stop()
+	initial := true
+	for {
+		//watch is started before listing so that no event is missed in between
+		watcher, err := s.kubeAPI.CoreV1().Events(depl.Namespace).Watch(ctx, filter.listOptions())
+		if err != nil {
+			return eventWatchEndError(ctx, err)
+		}
+		list, err := s.kubeAPI.CoreV1().Events(depl.Namespace).List(ctx, filter.listOptions())
+		if err != nil {
+			watcher.Stop()
+			return eventWatchEndError(ctx, err)
+		}
+
+		//events which occurred before the watch are sent in first message, also when there are none
+		events := dedupeEvents(w.process(ctx, list.Items))
+		if initial || len(events) > 0 {
+			message := fmt.Sprintf("Found %d event(s)", len(events))
+			if err = stream.Send(prepareEventsResponse(v1.Status_OK, message, events)); err != nil {
+				watcher.Stop()
+				return eventWatchEndError(ctx, err)
+			}
+			initial = false
+		}
+
+		watching := true
+		for watching && err == nil {
+			select {
+			case change, ok := <-watcher.ResultChan():
+				if !ok {
+					logLine("watch closed, restarting")
+					watching = false
+					continue
+				}
+				if change.Type != watch.Added && change.Type != watch.Modified {
+					continue
+				}
+				event, isEvent := change.Object.(*apiv1.Event)
+				if !isEvent {
+					continue
+				}
+				for _, info := range dedupeEvents(w.process(ctx, []apiv1.Event{*event})) {
+					if err = stream.Send(prepareEventsResponse(v1.Status_OK, "", []*v1.EventInfo{info})); err != nil {
+						break
+					}
+				}
+			case <-recheck.C:
+				for _, info := range dedupeEvents(w.recheck(ctx)) {
+					if err = stream.Send(prepareEventsResponse(v1.Status_OK, "", []*v1.EventInfo{info})); err != nil {
+						break
+					}
+				}
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		watcher.Stop()
+		if err != nil {
+			return eventWatchEndError(ctx, err)
+		}
+	}
+}
+
+//Translate error ending event watch into gRPC status, reaching watch timeout ends it normally
+func eventWatchEndError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		logLine("< event watch finished")
+		return nil
+	case context.Canceled:
+		return status.Errorf(codes.Canceled, "watch cancelled by client")
+	}
+	return err
+}
@@ -0,0 +1,314 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+type eventsStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	sent chan *v1.EventsResponse
+}
+
+func (s *eventsStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *eventsStream) Send(res *v1.EventsResponse) error {
+	s.sent <- res
+	return nil
+}
+
+func (s *eventsStream) next(t *testing.T) *v1.EventsResponse {
+	select {
+	case res := <-s.sent:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("no events received")
+	}
+	return nil
+}
+
+func createTestEvent(name string, eventType string, reason string, kind string, object string, count int32, last time.Time) *corev1.Event {
+	event := &corev1.Event{}
+	event.Name = name
+	event.Namespace = "test-namespace"
+	event.Type = eventType
+	event.Reason = reason
+	event.Message = reason + " of " + object
+	event.InvolvedObject = corev1.ObjectReference{Kind: kind, Name: object, Namespace: "test-namespace"}
+	event.Count = count
+	event.FirstTimestamp = metav1.NewTime(last.Add(-time.Minute))
+	event.LastTimestamp = metav1.NewTime(last)
+	return event
+}
+
+func TestNewEventFilter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	filter, err := newEventFilter(&v1.EventsRequest{Type: "warning", Reasons: []string{"BackOff"}, SinceSeconds: 600}, now)
+	if err != nil || filter.eventType != corev1.EventTypeWarning || filter.listOptions().FieldSelector != "type=Warning" {
+		t.Fatal(err, filter)
+	}
+	if !filter.matches(createTestEvent("e", "Warning", "BackOff", "Pod", "p", 1, now.Add(-time.Minute))) {
+		t.Error("matching event rejected")
+	}
+	for _, event := range []*corev1.Event{
+		createTestEvent("e", "Normal", "BackOff", "Pod", "p", 1, now.Add(-time.Minute)),
+		createTestEvent("e", "Warning", "FailedMount", "Pod", "p", 1, now.Add(-time.Minute)),
+		createTestEvent("e", "Warning", "BackOff", "Pod", "p", 1, now.Add(-time.Hour)),
+	} {
+		if filter.matches(event) {
+			t.Errorf("event %v should be rejected", event)
+		}
+	}
+
+	filter, _ = newEventFilter(&v1.EventsRequest{SinceTime: "2024-05-01T09:00:00Z", UntilTime: "2024-05-01T09:30:00Z"}, now)
+	if filter.matches(createTestEvent("e", "Normal", "Pulled", "Pod", "p", 1, now)) ||
+		!filter.matches(createTestEvent("e", "Normal", "Pulled", "Pod", "p", 1, now.Add(-45*time.Minute))) {
+		t.Error("time window not applied")
+	}
+
+	for _, invalid := range []*v1.EventsRequest{
+		{Type: "Error"},
+		{SinceSeconds: -1},
+		{SinceSeconds: 60, SinceTime: "2024-05-01T09:00:00Z"},
+		{UntilTime: "tomorrow"},
+		{SinceTime: "2024-05-01T09:00:00Z", UntilTime: "2024-05-01T08:00:00Z"},
+	} {
+		if _, err = newEventFilter(invalid, now); err == nil {
+			t.Errorf("request %v should be rejected", invalid)
+		}
+	}
+}
+
+func TestDedupeEvents(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	infos := dedupeEvents([]corev1.Event{
+		*createTestEvent("a", "Warning", "BackOff", "Pod", "test-uid-web", 5, now),
+		*createTestEvent("b", "Normal", "Pulled", "Pod", "test-uid-web", 0, now.Add(-time.Hour)),
+		*createTestEvent("c", "Warning", "BackOff", "Pod", "test-uid-web", 3, now.Add(-10*time.Minute)),
+	})
+	if len(infos) != 2 || infos[0].Reason != "Pulled" || infos[0].Count != 1 {
+		t.Fatalf("unexpected events %v", infos)
+	}
+	if infos[1].Count != 8 || infos[1].LastTimestamp != "2024-05-01T10:00:00Z" || infos[1].FirstTimestamp != "2024-05-01T09:49:00Z" {
+		t.Errorf("unexpected merged event %v", infos[1])
+	}
+}
+
+func TestEventServiceServer_ListEvents(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewEventServiceServer(client, "")
+	now := time.Now()
+
+	//Fail on API version check
+	res, err := server.ListEvents(context.Background(), &v1.EventsRequest{Api: "invalid"})
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on invalid filter
+	res, err = server.ListEvents(context.Background(), &v1.EventsRequest{Api: apiVersion, Instance: &inst, Type: "Error"})
+	if status.Code(err) != codes.InvalidArgument || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	res, err = server.ListEvents(context.Background(), &v1.EventsRequest{Api: apiVersion, Instance: &fake_ns_inst})
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//pod of the instance discovered through its label despite unrelated name
+	pod := corev1.Pod{}
+	pod.Name = "web-7d9f8-abcde"
+	pod.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	pod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-7d9f8"}}
+	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &pod, metav1.CreateOptions{})
+	claim := corev1.PersistentVolumeClaim{}
+	claim.Name = "test-uid-data"
+	claim.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	_, _ = client.CoreV1().PersistentVolumeClaims("test-namespace").Create(context.Background(), &claim, metav1.CreateOptions{})
+
+	for _, event := range []*corev1.Event{
+		createTestEvent("e1", "Warning", "FailedScheduling", "Pod", "web-7d9f8-abcde", 2, now.Add(-5*time.Minute)),
+		createTestEvent("e2", "Normal", "SuccessfulCreate", "ReplicaSet", "web-7d9f8", 1, now.Add(-6*time.Minute)),
+		createTestEvent("e3", "Warning", "FailedMount", "PersistentVolumeClaim", "test-uid-data", 1, now.Add(-2*time.Hour)),
+		createTestEvent("e4", "Warning", "BackOff", "Pod", "other-uid-web", 4, now),
+		//object of another instance whose uid starts with the same characters
+		createTestEvent("e5", "Warning", "BackOff", "Pod", "test-uid-2-web", 4, now),
+	} {
+		_, _ = client.CoreV1().Events("test-namespace").Create(context.Background(), event, metav1.CreateOptions{})
+	}
+
+	ereq := v1.EventsRequest{Api: apiVersion, Instance: &inst}
+	res, err = server.ListEvents(context.Background(), &ereq)
+	if err != nil || res.Status != v1.Status_OK || len(res.Events) != 3 || res.Events[0].Reason != "FailedMount" || res.Events[2].Reason != "FailedScheduling" {
+		t.Fatalf("unexpected response %v, %v", res, err)
+	}
+
+	ereq.Type = "Warning"
+	ereq.SinceSeconds = 3600
+	res, err = server.ListEvents(context.Background(), &ereq)
+	if err != nil || len(res.Events) != 1 || res.Events[0].InvolvedName != "web-7d9f8-abcde" || res.Events[0].Count != 2 {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	ereq.Reasons = []string{"BackOff"}
+	res, err = server.ListEvents(context.Background(), &ereq)
+	if err != nil || res.Status != v1.Status_OK || len(res.Events) != 0 {
+		t.Errorf("unexpected response %v", res)
+	}
+}
+
+func TestEventServiceServer_WatchEvents(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewEventServiceServer(client, "")
+	now := time.Now()
+
+	//Fail on API version check
+	if err := server.WatchEvents(&v1.EventsRequest{Api: "invalid"}, &eventsStream{ctx: context.Background()}); err == nil {
+		t.Fail()
+	}
+
+	//Fail on invalid filter
+	wreq := v1.EventsRequest{Api: apiVersion, Instance: &inst, Type: "Error"}
+	if err := server.WatchEvents(&wreq, &eventsStream{ctx: context.Background()}); status.Code(err) != codes.InvalidArgument {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	wreq = v1.EventsRequest{Api: apiVersion, Instance: &fake_ns_inst, Type: "Warning", TimeoutSeconds: 10}
+	if err := server.WatchEvents(&wreq, &eventsStream{ctx: context.Background()}); err == nil {
+		t.Fail()
+	}
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+	for _, name := range []string{"test-uid-web", "test-uid-db"} {
+		pod := corev1.Pod{}
+		pod.Name = name
+		pod.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+		_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &pod, metav1.CreateOptions{})
+	}
+	backOff := createTestEvent("e1", "Warning", "BackOff", "Pod", "test-uid-web", 1, now)
+	_, _ = client.CoreV1().Events("test-namespace").Create(context.Background(), backOff, metav1.CreateOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &eventsStream{ctx: ctx, sent: make(chan *v1.EventsResponse, 100)}
+	done := make(chan error, 1)
+	wreq.Instance = &inst
+	go func() {
+		done <- server.WatchEvents(&wreq, stream)
+	}()
+
+	//existing events are sent first
+	res := stream.next(t)
+	if res.Status != v1.Status_OK || len(res.Events) != 1 || res.Events[0].Reason != "BackOff" {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	//events of other instances or other types are not sent
+	_, _ = client.CoreV1().Events("test-namespace").Create(context.Background(),
+		createTestEvent("e2", "Warning", "BackOff", "Pod", "other-uid-web", 1, now), metav1.CreateOptions{})
+	_, _ = client.CoreV1().Events("test-namespace").Create(context.Background(),
+		createTestEvent("e3", "Normal", "Pulled", "Pod", "test-uid-web", 1, now), metav1.CreateOptions{})
+
+	//update without new occurrence is not sent again
+	backOff.Message = "Back-off restarting failed container"
+	_, _ = client.CoreV1().Events("test-namespace").Update(context.Background(), backOff, metav1.UpdateOptions{})
+	backOff.Count = 3
+	_, _ = client.CoreV1().Events("test-namespace").Update(context.Background(), backOff, metav1.UpdateOptions{})
+	res = stream.next(t)
+	if len(res.Events) != 1 || res.Events[0].InvolvedName != "test-uid-web" || res.Events[0].Count != 3 {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	_, _ = client.CoreV1().Events("test-namespace").Create(context.Background(),
+		createTestEvent("e4", "Warning", "FailedMount", "Pod", "test-uid-db", 1, now), metav1.CreateOptions{})
+	res = stream.next(t)
+	if len(res.Events) != 1 || res.Events[0].Reason != "FailedMount" {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Canceled {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not stop")
+	}
+}
+
+func TestEventServiceServer_WatchEventsOfNewObjects(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewEventServiceServer(client, "")
+	now := time.Now()
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &eventsStream{ctx: ctx, sent: make(chan *v1.EventsResponse, 100)}
+	done := make(chan error, 1)
+	go func() {
+		done <- server.WatchEvents(&v1.EventsRequest{Api: apiVersion, Instance: &inst, Type: "Warning"}, stream)
+	}()
+	if res := stream.next(t); len(res.Events) != 0 {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	//pods created after the watch started emit events sooner than objects may be refreshed
+	for _, name := range []string{"test-uid-web", "test-uid-db"} {
+		pod := corev1.Pod{}
+		pod.Name = name
+		pod.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+		_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &pod, metav1.CreateOptions{})
+		_, _ = client.CoreV1().Events("test-namespace").Create(context.Background(),
+			createTestEvent("e-"+name, "Warning", "FailedScheduling", "Pod", name, 1, now), metav1.CreateOptions{})
+		time.Sleep(100 * time.Millisecond)
+	}
+	_, _ = client.CoreV1().Events("test-namespace").Create(context.Background(),
+		createTestEvent("other", "Warning", "FailedScheduling", "Pod", "other-uid-web", 1, now), metav1.CreateOptions{})
+
+	involved := make(map[string]bool)
+	timeout := time.After(3 * instanceObjectsRefreshPeriod)
+	for len(involved) < 2 {
+		select {
+		case res := <-stream.sent:
+			for _, event := range res.Events {
+				involved[event.InvolvedName] = true
+			}
+		case <-timeout:
+			t.Fatalf("events of new pods not sent, got %v", involved)
+		}
+	}
+	if involved["other-uid-web"] {
+		t.Error("event of other instance sent")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not stop")
+	}
+}
@@ -0,0 +1,203 @@
+package v1
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/GehirnInc/crypt/apr1_crypt"
+	"github.com/GehirnInc/crypt/md5_crypt"
+	"github.com/GehirnInc/crypt/sha256_crypt"
+	"github.com/GehirnInc/crypt/sha512_crypt"
+	"github.com/johnaoss/htpasswd/apr1"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"strings"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+const (
+	//Key of the basic auth secret holding htpasswd file, as expected by ingress controllers
+	htpasswdSecretKey = "auth"
+	//Alphabet used by crypt(3) for salts
+	saltAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	aprSaltLength = 8
+	sha512SaltLength = 16
+	//Hash compared against when user is unknown, so that response time does not reveal existing users
+	dummyBcryptHash = "$2a$10$kL4hGm5ywznHkw3fusi6de1Sx2JNtARYggKigfFUD8z36mGeXArz2"
+)
+
+//Single line of htpasswd file
+type htpasswdEntry struct {
+	user string
+	hash string
+}
+
+//Parse htpasswd file content skipping empty lines and comments
+func parseHtpasswd(content string) []htpasswdEntry {
+	entries := make([]htpasswdEntry, 0)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		entries = append(entries, htpasswdEntry{user: user, hash: hash})
+	}
+	return entries
+}
+
+//Render htpasswd entries as file content, one user per line
+func formatHtpasswd(entries []htpasswdEntry) string {
+	var sb strings.Builder
+	for _, entry := range entries {
+		sb.WriteString(entry.user + ":" + entry.hash + "\n")
+	}
+	return sb.String()
+}
+
+//Map scheme name given in configuration to hash scheme, empty name selects bcrypt
+func ParseHashScheme(name string) (v1.HashScheme, error) {
+	switch strings.ToLower(name) {
+	case "", "bcrypt":
+		return v1.HashScheme_BCRYPT, nil
+	case "sha512", "sha512_crypt":
+		return v1.HashScheme_SHA512_CRYPT, nil
+	case "apr1", "md5":
+		return v1.HashScheme_APR1, nil
+	}
+	return v1.HashScheme_SERVER_DEFAULT, fmt.Errorf("unsupported password hashing scheme '%s'", name)
+}
+
+//Draw random salt of given length from crypt(3) alphabet using cryptographically secure source
+func randomSalt(l int) (string, error) {
+	bytes := make([]byte, l)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	for i := range bytes {
+		//alphabet has 64 characters so masking keeps the distribution uniform
+		bytes[i] = saltAlphabet[bytes[i]&63]
+	}
+	return string(bytes), nil
+}
+
+//Hash password with given scheme and salt, salt is ignored for bcrypt which generates its own
+func hashPasswordWithSalt(scheme v1.HashScheme, password string, salt string) (string, error) {
+	switch scheme {
+	case v1.HashScheme_BCRYPT:
+		out, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(out), err
+	case v1.HashScheme_SHA512_CRYPT:
+		return sha512_crypt.New().Generate([]byte(password), []byte("$6$"+salt))
+	case v1.HashScheme_APR1:
+		return apr1.Hash(password, salt)
+	}
+	return "", fmt.Errorf("unsupported password hashing scheme %s", scheme.String())
+}
+
+//Hash password with given scheme using fresh random salt
+func hashPassword(scheme v1.HashScheme, password string) (string, error) {
+	saltLength := aprSaltLength
+	if scheme == v1.HashScheme_SHA512_CRYPT {
+		saltLength = sha512SaltLength
+	}
+	salt, err := randomSalt(saltLength)
+	if err != nil {
+		log.Print(err)
+		return "", status.Errorf(codes.Internal, "Failed to generate salt")
+	}
+
+	out, err := hashPasswordWithSalt(scheme, password, salt)
+	if err != nil {
+		log.Print(err)
+		return "", status.Errorf(codes.Internal, "Failed to execute %s hashing", scheme.String())
+	}
+	return out, nil
+}
+
+//Check password against htpasswd hash of any supported scheme
+func verifyPassword(hash string, password string) bool {
+	var err error
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	case strings.HasPrefix(hash, "$6$"):
+		err = sha512_crypt.New().Verify(hash, []byte(password))
+	case strings.HasPrefix(hash, "$5$"):
+		err = sha256_crypt.New().Verify(hash, []byte(password))
+	case strings.HasPrefix(hash, "$apr1$"):
+		err = apr1_crypt.New().Verify(hash, []byte(password))
+	case strings.HasPrefix(hash, "$1$"):
+		err = md5_crypt.New().Verify(hash, []byte(password))
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+	default:
+		return false
+	}
+	return err == nil
+}
+
+//Find position of given user in htpasswd entries, -1 if not present
+func findHtpasswdUser(entries []htpasswdEntry, user string) int {
+	for i, entry := range entries {
+		if entry.user == user {
+			return i
+		}
+	}
+	return -1
+}
+
+//Check that credentials can be safely stored in htpasswd file
+func validateCredentials(credentials *v1.Credentials, requirePassword bool) error {
+	if len(credentials.User) == 0 || strings.ContainsAny(credentials.User, ":\r\n") {
+		return status.Errorf(codes.InvalidArgument, "Invalid user name '%s'", credentials.User)
+	}
+	if requirePassword && len(credentials.Password) == 0 {
+		return status.Errorf(codes.InvalidArgument, "Missing password for user '%s'", credentials.User)
+	}
+	return nil
+}
+
+//Apply requested operation on the existing htpasswd entries, hashing passwords of added users
+func applyCredentialsOperation(entries []htpasswdEntry, operation v1.CredentialsOperation, credentials []*v1.Credentials, scheme v1.HashScheme) ([]htpasswdEntry, error) {
+	result := make([]htpasswdEntry, 0, len(entries)+len(credentials))
+	if operation != v1.CredentialsOperation_REPLACE {
+		result = append(result, entries...)
+	}
+
+	for _, c := range credentials {
+		if err := validateCredentials(c, operation != v1.CredentialsOperation_REMOVE); err != nil {
+			return nil, err
+		}
+
+		i := findHtpasswdUser(result, c.User)
+		if operation == v1.CredentialsOperation_REMOVE {
+			if i >= 0 {
+				result = append(result[:i], result[i+1:]...)
+			}
+			continue
+		}
+
+		hash, err := hashPassword(scheme, c.Password)
+		if err != nil {
+			return nil, err
+		}
+		if i >= 0 {
+			result[i].hash = hash
+		} else {
+			result = append(result, htpasswdEntry{user: c.User, hash: hash})
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,134 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"github.com/GehirnInc/crypt/apr1_crypt"
+	"github.com/GehirnInc/crypt/sha512_crypt"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+func TestRandomSalt(t *testing.T) {
+	s1, err := randomSalt(16)
+	if err != nil || len(s1) != 16 {
+		t.Fail()
+	}
+	for _, c := range s1 {
+		if !strings.ContainsRune(saltAlphabet, c) {
+			t.Fail()
+		}
+	}
+
+	s2, _ := randomSalt(16)
+	if s1 == s2 {
+		t.Fail()
+	}
+}
+
+func TestParseHashScheme(t *testing.T) {
+	tests := map[string]v1.HashScheme{
+		"": v1.HashScheme_BCRYPT,
+		"bcrypt": v1.HashScheme_BCRYPT,
+		"SHA512": v1.HashScheme_SHA512_CRYPT,
+		"apr1": v1.HashScheme_APR1,
+	}
+	for name, expected := range tests {
+		scheme, err := ParseHashScheme(name)
+		if err != nil || scheme != expected {
+			t.Errorf("unexpected scheme %s for '%s'", scheme.String(), name)
+		}
+	}
+
+	_, err := ParseHashScheme("plain")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	password := "test-password"
+
+	//bcrypt hash should verify with reference implementation
+	hash, err := hashPassword(v1.HashScheme_BCRYPT, password)
+	if err != nil || !strings.HasPrefix(hash, "$2a$") {
+		t.Fail()
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		t.Fail()
+	}
+
+	//SHA-512 crypt hash should verify with reference implementation
+	hash, err = hashPassword(v1.HashScheme_SHA512_CRYPT, password)
+	if err != nil || !strings.HasPrefix(hash, "$6$") {
+		t.Fail()
+	}
+	if sha512_crypt.New().Verify(hash, []byte(password)) != nil {
+		t.Fail()
+	}
+
+	//APR1 hash should verify with independent implementation
+	hash, err = hashPassword(v1.HashScheme_APR1, password)
+	if err != nil || !strings.HasPrefix(hash, "$apr1$") {
+		t.Fail()
+	}
+	if apr1_crypt.New().Verify(hash, []byte(password)) != nil {
+		t.Fail()
+	}
+
+	//Same password should never produce the same hash
+	h1, _ := hashPassword(v1.HashScheme_APR1, password)
+	h2, _ := hashPassword(v1.HashScheme_APR1, password)
+	if h1 == h2 {
+		t.Fail()
+	}
+
+	_, err = hashPassword(v1.HashScheme_SERVER_DEFAULT, password)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestHashPasswordWithSaltKnownVectors(t *testing.T) {
+	//Reference vector from the SHA-crypt specification
+	hash, err := hashPasswordWithSalt(v1.HashScheme_SHA512_CRYPT, "Hello world!", "saltstring")
+	if err != nil || hash != "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1" {
+		t.Errorf("unexpected SHA-512 crypt hash %s", hash)
+	}
+
+	//Reference vector generated with Apache htpasswd
+	hash, err = hashPasswordWithSalt(v1.HashScheme_APR1, "myPassword", "r31.....")
+	if err != nil || hash != "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/" {
+		t.Errorf("unexpected APR1 hash %s", hash)
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("myPassword"), bcrypt.MinCost)
+	//Apart from the first one, hashes generated with libxcrypt crypt(3) and openssl passwd
+	hashes := []string{
+		string(bcryptHash),
+		"$2y$05$abcdefghijklmnopqrstuugwV8qBBvnFAgKU/1lAQTjzoU4mNz2BW",
+		"$6$nmaasSalt$gX1G0Ffvdpu555JxYjpZ46e.1dkfLPIZE1OcoM6O0bGQdeXB5IomLDV4wxl..11p/tUi5CB2vvYUTmJ.SSGJO1",
+		"$5$nmaasSalt$AlpVzHpOcLlDgha6PvrBD3UTTwqVGff4kn1rSPdBMwC",
+		"$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/",
+		"{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE=",
+	}
+	for _, hash := range hashes {
+		if !verifyPassword(hash, "myPassword") {
+			t.Errorf("password not verified against %s", hash)
+		}
+		if verifyPassword(hash, "otherPassword") {
+			t.Errorf("wrong password verified against %s", hash)
+		}
+	}
+
+	if !verifyPassword("$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!") {
+		t.Fail()
+	}
+
+	//Plain text passwords are not accepted
+	if verifyPassword("myPassword", "myPassword") {
+		t.Fail()
+	}
+}
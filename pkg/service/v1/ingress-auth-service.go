@@ -0,0 +1,481 @@
+package v1
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"net/url"
+	"strings"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+const (
+	oauth2ProxyComponent = "oauth2-proxy"
+	oauth2ProxyPort = 4180
+	oauth2ProxyPathPrefix = "/oauth2"
+	nginxAuthUrlAnnotation = "nginx.ingress.kubernetes.io/auth-url"
+	nginxAuthSigninAnnotation = "nginx.ingress.kubernetes.io/auth-signin"
+	nginxAuthResponseHeadersAnnotation = "nginx.ingress.kubernetes.io/auth-response-headers"
+	oauth2ProxyResponseHeaders = "X-Auth-Request-User,X-Auth-Request-Email,X-Auth-Request-Groups"
+	defaultOAuth2Scope = "openid email profile"
+	defaultOAuth2GroupsClaim = "groups"
+)
+
+type ingressAuthServiceServer struct {
+	kubeAPI kubernetes.Interface
+	dynamicAPI dynamic.Interface
+	ingressController IngressController
+	oauth2ProxyImage string
+	instanceLabel string
+}
+
+func NewIngressAuthServiceServer(kubeAPI kubernetes.Interface, dynamicAPI dynamic.Interface, ingressController IngressController, oauth2ProxyImage string, label string) v1.IngressAuthServiceServer {
+	if len(label) == 0 {
+		label = instanceLabel
+	}
+	return &ingressAuthServiceServer{kubeAPI: kubeAPI, dynamicAPI: dynamicAPI, ingressController: ingressController, oauth2ProxyImage: oauth2ProxyImage, instanceLabel: label}
+}
+
+//Prepare ingress auth status response
+func prepareIngressAuthStatusResponse(status v1.Status, message string) *v1.IngressAuthStatusResponse {
+	return &v1.IngressAuthStatusResponse {
+		Api: apiVersion,
+		Status: status,
+		Message: message,
+		Ingresses: make([]*v1.IngressAuthInfo, 0),
+	}
+}
+
+//Name shared by all oauth2-proxy objects of the instance
+func getOAuth2ProxyName(uid string) string {
+	return uid + "-oauth2-proxy"
+}
+
+//Labels of oauth2-proxy objects created for the instance
+func oauth2ProxyLabels(uid string, label string) map[string]string {
+	return map[string]string{
+		label: uid,
+		componentLabel: oauth2ProxyComponent,
+		managedByLabel: managedByJanitor,
+	}
+}
+
+//Address at which oauth2-proxy of the instance is reachable inside the cluster
+func oauth2ProxyServiceUrl(namespace string, uid string) string {
+	return fmt.Sprintf("http://%s.%s.svc.cluster.local:%d", getOAuth2ProxyName(uid), namespace, oauth2ProxyPort)
+}
+
+//Check that provided OAuth2 configuration is complete
+func validateOAuth2Config(config *v1.OAuth2Config) error {
+	if config == nil {
+		return status.Errorf(codes.InvalidArgument, "Missing OAuth2 configuration")
+	}
+	issuer, err := url.Parse(config.IssuerUrl)
+	if err != nil || issuer.Scheme != "https" || len(issuer.Host) == 0 {
+		return status.Errorf(codes.InvalidArgument, "Issuer URL must be an absolute https URL")
+	}
+	if len(config.ClientId) == 0 || len(config.ClientSecret) == 0 {
+		return status.Errorf(codes.InvalidArgument, "Client id and client secret are required")
+	}
+	for _, group := range config.AllowedGroups {
+		if len(strings.TrimSpace(group)) == 0 {
+			return status.Errorf(codes.InvalidArgument, "Allowed group name cannot be empty")
+		}
+	}
+	return nil
+}
+
+//Store client credentials in secret, keeping cookie secret of existing proxy so that user sessions survive
+func (s *ingressAuthServiceServer) createOrUpdateOAuth2ProxySecret(ctx context.Context, namespace string, uid string, config *v1.OAuth2Config) error {
+	name := getOAuth2ProxyName(uid)
+	secret := apiv1.Secret{}
+	secret.SetNamespace(namespace)
+	secret.SetName(name)
+	secret.SetLabels(oauth2ProxyLabels(uid, s.instanceLabel))
+	secret.Data = map[string][]byte{
+		"client-id": []byte(config.ClientId),
+		"client-secret": []byte(config.ClientSecret),
+	}
+
+	existing, err := s.kubeAPI.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		//oauth2-proxy requires cookie secret of 16, 24 or 32 bytes
+		cookieSecret := make([]byte, 16)
+		if _, err = rand.Read(cookieSecret); err != nil {
+			return err
+		}
+		secret.Data["cookie-secret"] = []byte(hex.EncodeToString(cookieSecret))
+		_, err = s.kubeAPI.CoreV1().Secrets(namespace).Create(ctx, &secret, metav1.CreateOptions{})
+		return err
+	}
+
+	secret.Data["cookie-secret"] = existing.Data["cookie-secret"]
+	_, err = s.kubeAPI.CoreV1().Secrets(namespace).Update(ctx, &secret, metav1.UpdateOptions{})
+	return err
+}
+
+//Environment variable of oauth2-proxy container read from instance secret
+func oauth2ProxySecretEnv(name string, secretName string, key string) apiv1.EnvVar {
+	return apiv1.EnvVar{
+		Name: name,
+		ValueFrom: &apiv1.EnvVarSource{SecretKeyRef: &apiv1.SecretKeySelector{
+			LocalObjectReference: apiv1.LocalObjectReference{Name: secretName},
+			Key: key,
+		}},
+	}
+}
+
+//Prepare oauth2-proxy deployment authenticating users against given OIDC provider
+func (s *ingressAuthServiceServer) prepareOAuth2ProxyDeployment(namespace string, uid string, config *v1.OAuth2Config) *appsv1.Deployment {
+	name := getOAuth2ProxyName(uid)
+	labels := oauth2ProxyLabels(uid, s.instanceLabel)
+
+	scope := config.Scope
+	if len(scope) == 0 {
+		scope = defaultOAuth2Scope
+	}
+	groupsClaim := config.GroupsClaim
+	if len(groupsClaim) == 0 {
+		groupsClaim = defaultOAuth2GroupsClaim
+	}
+
+	args := []string{
+		"--provider=oidc",
+		"--oidc-issuer-url=" + config.IssuerUrl,
+		"--oidc-groups-claim=" + groupsClaim,
+		"--scope=" + scope,
+		fmt.Sprintf("--http-address=0.0.0.0:%d", oauth2ProxyPort),
+		"--upstream=static://202",
+		"--email-domain=*",
+		"--reverse-proxy=true",
+		"--skip-provider-button=true",
+		"--set-xauthrequest=true",
+		"--cookie-secure=true",
+		"--cookie-name=_oauth2_proxy_" + uid,
+	}
+	for _, group := range config.AllowedGroups {
+		args = append(args, "--allowed-group="+strings.TrimSpace(group))
+	}
+
+	replicas := int32(1)
+	deployment := &appsv1.Deployment{}
+	deployment.SetNamespace(namespace)
+	deployment.SetName(name)
+	deployment.SetLabels(labels)
+	deployment.Spec.Replicas = &replicas
+	deployment.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	deployment.Spec.Template.SetLabels(labels)
+	deployment.Spec.Template.Spec.Containers = []apiv1.Container{{
+		Name: oauth2ProxyComponent,
+		Image: s.oauth2ProxyImage,
+		Args: args,
+		Env: []apiv1.EnvVar{
+			oauth2ProxySecretEnv("OAUTH2_PROXY_CLIENT_ID", name, "client-id"),
+			oauth2ProxySecretEnv("OAUTH2_PROXY_CLIENT_SECRET", name, "client-secret"),
+			oauth2ProxySecretEnv("OAUTH2_PROXY_COOKIE_SECRET", name, "cookie-secret"),
+		},
+		Ports: []apiv1.ContainerPort{{Name: "http", ContainerPort: oauth2ProxyPort}},
+		ReadinessProbe: &apiv1.Probe{ProbeHandler: apiv1.ProbeHandler{HTTPGet: &apiv1.HTTPGetAction{
+			Path: "/ping",
+			Port: intstr.FromString("http"),
+		}}},
+	}}
+	return deployment
+}
+
+//Prepare service exposing oauth2-proxy inside the namespace
+func prepareOAuth2ProxyService(namespace string, uid string, label string) *apiv1.Service {
+	service := &apiv1.Service{}
+	service.SetNamespace(namespace)
+	service.SetName(getOAuth2ProxyName(uid))
+	service.SetLabels(oauth2ProxyLabels(uid, label))
+	service.Spec.Selector = oauth2ProxyLabels(uid, label)
+	service.Spec.Ports = []apiv1.ServicePort{{Name: "http", Port: oauth2ProxyPort, TargetPort: intstr.FromString("http")}}
+	return service
+}
+
+//Prepare Ingress routing sign in and callback paths of all instance hosts to oauth2-proxy
+func prepareOAuth2ProxyIngress(namespace string, uid string, label string, instanceIngresses []networkingv1.Ingress) *networkingv1.Ingress {
+	name := getOAuth2ProxyName(uid)
+	pathType := networkingv1.PathTypePrefix
+	backend := networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{
+		Name: name,
+		Port: networkingv1.ServiceBackendPort{Number: oauth2ProxyPort},
+	}}
+
+	ingress := &networkingv1.Ingress{}
+	ingress.SetNamespace(namespace)
+	ingress.SetName(name)
+	ingress.SetLabels(oauth2ProxyLabels(uid, label))
+
+	hosts := make(map[string]bool)
+	for _, instanceIngress := range instanceIngresses {
+		if ingress.Spec.IngressClassName == nil {
+			ingress.Spec.IngressClassName = instanceIngress.Spec.IngressClassName
+		}
+		ingress.Spec.TLS = append(ingress.Spec.TLS, instanceIngress.Spec.TLS...)
+		for _, rule := range instanceIngress.Spec.Rules {
+			if len(rule.Host) == 0 || hosts[rule.Host] {
+				continue
+			}
+			hosts[rule.Host] = true
+			ingress.Spec.Rules = append(ingress.Spec.Rules, networkingv1.IngressRule{
+				Host: rule.Host,
+				IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{{Path: oauth2ProxyPathPrefix, PathType: &pathType, Backend: backend}},
+				}},
+			})
+		}
+	}
+	return ingress
+}
+
+//Create oauth2-proxy deployment, service and Ingress or update the existing ones
+func createOrUpdateOAuth2ProxyObjects(ctx context.Context, kubeAPI kubernetes.Interface, deployment *appsv1.Deployment, service *apiv1.Service, ingress *networkingv1.Ingress) error {
+	namespace := deployment.Namespace
+
+	existingDeployment, err := kubeAPI.AppsV1().Deployments(namespace).Get(ctx, deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		_, err = kubeAPI.AppsV1().Deployments(namespace).Create(ctx, deployment, metav1.CreateOptions{})
+	} else {
+		existingDeployment.Spec = deployment.Spec
+		_, err = kubeAPI.AppsV1().Deployments(namespace).Update(ctx, existingDeployment, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	existingService, err := kubeAPI.CoreV1().Services(namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if err != nil {
+		_, err = kubeAPI.CoreV1().Services(namespace).Create(ctx, service, metav1.CreateOptions{})
+	} else {
+		existingService.Spec.Selector = service.Spec.Selector
+		existingService.Spec.Ports = service.Spec.Ports
+		_, err = kubeAPI.CoreV1().Services(namespace).Update(ctx, existingService, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	existingIngress, err := kubeAPI.NetworkingV1().Ingresses(namespace).Get(ctx, ingress.Name, metav1.GetOptions{})
+	if err != nil {
+		_, err = kubeAPI.NetworkingV1().Ingresses(namespace).Create(ctx, ingress, metav1.CreateOptions{})
+	} else {
+		existingIngress.Spec = ingress.Spec
+		_, err = kubeAPI.NetworkingV1().Ingresses(namespace).Update(ctx, existingIngress, metav1.UpdateOptions{})
+	}
+	return err
+}
+
+//Point instance Ingress objects to oauth2-proxy for authentication
+func (s *ingressAuthServiceServer) wireOAuth2(ctx context.Context, namespace string, uid string) (int, error) {
+	if s.ingressController == IngressControllerTraefik {
+		middleware := getOAuth2ProxyName(uid)
+		spec := map[string]interface{}{"forwardAuth": map[string]interface{}{
+			"address": oauth2ProxyServiceUrl(namespace, uid) + "/",
+			"trustForwardHeader": true,
+			"authResponseHeaders": strings.Split(oauth2ProxyResponseHeaders, ","),
+		}}
+		if err := createOrUpdateTraefikMiddleware(ctx, s.dynamicAPI, namespace, middleware, spec); err != nil {
+			return 0, err
+		}
+		ref := traefikMiddlewareRef(namespace, middleware)
+		return updateInstanceIngresses(ctx, s.kubeAPI, namespace, uid, s.instanceLabel, func(annotations map[string]string) bool {
+			return addTraefikMiddleware(annotations, ref)
+		})
+	}
+
+	authUrl := oauth2ProxyServiceUrl(namespace, uid) + oauth2ProxyPathPrefix + "/auth"
+	signinUrl := "https://$host" + oauth2ProxyPathPrefix + "/start?rd=$escaped_request_uri"
+	return updateInstanceIngresses(ctx, s.kubeAPI, namespace, uid, s.instanceLabel, func(annotations map[string]string) bool {
+		changed := annotations[nginxAuthUrlAnnotation] != authUrl || annotations[nginxAuthSigninAnnotation] != signinUrl
+		annotations[nginxAuthUrlAnnotation] = authUrl
+		annotations[nginxAuthSigninAnnotation] = signinUrl
+		annotations[nginxAuthResponseHeadersAnnotation] = oauth2ProxyResponseHeaders
+		return changed
+	})
+}
+
+//Remove oauth2-proxy references from instance Ingress objects
+func (s *ingressAuthServiceServer) unwireOAuth2(ctx context.Context, namespace string, uid string) error {
+	ref := traefikMiddlewareRef(namespace, getOAuth2ProxyName(uid))
+	proxyUrl := oauth2ProxyServiceUrl(namespace, uid)
+
+	_, err := updateInstanceIngresses(ctx, s.kubeAPI, namespace, uid, s.instanceLabel, func(annotations map[string]string) bool {
+		changed := removeTraefikMiddleware(annotations, ref)
+		if strings.HasPrefix(annotations[nginxAuthUrlAnnotation], proxyUrl) {
+			delete(annotations, nginxAuthUrlAnnotation)
+			delete(annotations, nginxAuthSigninAnnotation)
+			delete(annotations, nginxAuthResponseHeadersAnnotation)
+			changed = true
+		}
+		return changed
+	})
+	return err
+}
+
+func (s *ingressAuthServiceServer) EnableOAuth2(ctx context.Context, req *v1.InstanceOAuth2Request) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Instance
+	if err := validateOAuth2Config(req.Oauth2); err != nil {
+		return prepareResponse(v1.Status_FAILED, "Invalid OAuth2 configuration"), err
+	}
+	logLine(fmt.Sprintf("> Enabling OAuth2 for instance:%s in namespace:%s", depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	ingresses, err := findInstanceIngresses(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while retrieving Ingress list"), err
+	}
+	if len(ingresses) == 0 {
+		return prepareResponse(v1.Status_FAILED, "No Ingress found for instance"), status.Errorf(codes.FailedPrecondition, "Instance has no Ingress to protect")
+	}
+
+	err = s.createOrUpdateOAuth2ProxySecret(ctx, depl.Namespace, depl.Uid, req.Oauth2)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while storing OAuth2 client secret!"), err
+	}
+
+	err = createOrUpdateOAuth2ProxyObjects(ctx, s.kubeAPI,
+		s.prepareOAuth2ProxyDeployment(depl.Namespace, depl.Uid, req.Oauth2),
+		prepareOAuth2ProxyService(depl.Namespace, depl.Uid, s.instanceLabel),
+		prepareOAuth2ProxyIngress(depl.Namespace, depl.Uid, s.instanceLabel, ingresses))
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while deploying oauth2-proxy!"), err
+	}
+
+	//both modes cannot protect the same Ingress, basic auth secret is kept so that it can be enabled again
+	err = unwireBasicAuth(ctx, s.kubeAPI, s.dynamicAPI, s.ingressController, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while removing basic auth from Ingress!"), err
+	}
+
+	count, err := s.wireOAuth2(ctx, depl.Namespace, depl.Uid)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while configuring Ingress!"), err
+	}
+	return prepareResponse(v1.Status_OK, fmt.Sprintf("OAuth2 enabled on %d Ingress", count)), nil
+}
+
+func (s *ingressAuthServiceServer) DisableOAuth2(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+	logLine(fmt.Sprintf("> Disabling OAuth2 for instance:%s in namespace:%s", depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	err = s.unwireOAuth2(ctx, depl.Namespace, depl.Uid)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while removing Ingress configuration!"), err
+	}
+
+	name := getOAuth2ProxyName(depl.Uid)
+	deletions := []error{
+		deleteTraefikMiddlewareIfConfigured(ctx, s.dynamicAPI, s.ingressController, depl.Namespace, name),
+		s.kubeAPI.NetworkingV1().Ingresses(depl.Namespace).Delete(ctx, name, metav1.DeleteOptions{}),
+		s.kubeAPI.CoreV1().Services(depl.Namespace).Delete(ctx, name, metav1.DeleteOptions{}),
+		s.kubeAPI.AppsV1().Deployments(depl.Namespace).Delete(ctx, name, metav1.DeleteOptions{}),
+		s.kubeAPI.CoreV1().Secrets(depl.Namespace).Delete(ctx, name, metav1.DeleteOptions{}),
+	}
+	for _, err := range deletions {
+		if err != nil && !apierrors.IsNotFound(err) {
+			return prepareResponse(v1.Status_FAILED, "Error while removing oauth2-proxy!"), err
+		}
+	}
+	return prepareResponse(v1.Status_OK, "OAuth2 disabled successfully"), nil
+}
+
+//Delete Traefik middleware only when Traefik is the configured controller
+func deleteTraefikMiddlewareIfConfigured(ctx context.Context, dynamicAPI dynamic.Interface, controller IngressController, namespace string, name string) error {
+	if controller != IngressControllerTraefik {
+		return nil
+	}
+	return deleteTraefikMiddleware(ctx, dynamicAPI, namespace, name)
+}
+
+//Determine which authentication mode protects Ingress based on its annotations
+func ingressAuthMode(ingress *networkingv1.Ingress, uid string) v1.IngressAuthMode {
+	annotations := ingress.GetAnnotations()
+	middlewares := annotations[traefikMiddlewaresAnnotation]
+	if len(annotations[nginxAuthUrlAnnotation]) > 0 || strings.Contains(middlewares, "-"+getOAuth2ProxyName(uid)+"@") {
+		return v1.IngressAuthMode_AUTH_OAUTH2
+	}
+	if annotations[nginxAuthTypeAnnotation] == "basic" || strings.Contains(middlewares, "-"+getBasicAuthMiddlewareName(uid)+"@") {
+		return v1.IngressAuthMode_AUTH_BASIC
+	}
+	return v1.IngressAuthMode_AUTH_NONE
+}
+
+func (s *ingressAuthServiceServer) GetStatus(ctx context.Context, req *v1.InstanceRequest) (*v1.IngressAuthStatusResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareIngressAuthStatusResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	ingresses, err := findInstanceIngresses(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareIngressAuthStatusResponse(v1.Status_FAILED, "Error while retrieving Ingress list"), err
+	}
+
+	res := prepareIngressAuthStatusResponse(v1.Status_OK, "")
+	for i := range ingresses {
+		mode := ingressAuthMode(&ingresses[i], depl.Uid)
+		res.Ingresses = append(res.Ingresses, &v1.IngressAuthInfo{Name: ingresses[i].Name, Mode: mode})
+		//instance is reported with the strongest mode found on its Ingress objects
+		if mode > res.Mode {
+			res.Mode = mode
+		}
+	}
+
+	secret, err := s.kubeAPI.CoreV1().Secrets(depl.Namespace).Get(ctx, getAuthSecretName(depl.Uid), metav1.GetOptions{})
+	if err == nil {
+		res.BasicAuthUsers = int32(len(parseHtpasswd(string(secret.Data[htpasswdSecretKey]))))
+	}
+
+	proxy, err := s.kubeAPI.AppsV1().Deployments(depl.Namespace).Get(ctx, getOAuth2ProxyName(depl.Uid), metav1.GetOptions{})
+	if err == nil {
+		res.Oauth2ProxyReady = proxy.Status.AvailableReplicas > 0
+	}
+
+	if len(ingresses) == 0 {
+		res.Message = "No Ingress found for instance"
+	}
+	return res, nil
+}
@@ -0,0 +1,220 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+)
+
+var oauth2Config = v1.OAuth2Config{IssuerUrl: "https://sso.example.org/realms/nmaas", ClientId: "client", ClientSecret: "secret",
+	AllowedGroups: []string{"noc", "admins"}}
+
+func TestIngressAuthServiceServer_EnableOAuth2(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewIngressAuthServiceServer(client, nil, IngressControllerNginx, "oauth2-proxy:test", "")
+
+	//Fail on API version check
+	res, err := server.EnableOAuth2(context.Background(), &v1.InstanceOAuth2Request{Api: "illegal", Instance: &inst, Oauth2: &oauth2Config})
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on invalid configuration
+	invalid := v1.OAuth2Config{IssuerUrl: "http://sso.example.org", ClientId: "client", ClientSecret: "secret"}
+	res, err = server.EnableOAuth2(context.Background(), &v1.InstanceOAuth2Request{Api: apiVersion, Instance: &inst, Oauth2: &invalid})
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	oreq := v1.InstanceOAuth2Request{Api: apiVersion, Instance: &inst, Oauth2: &oauth2Config}
+
+	//Fail on namespace check
+	res, err = server.EnableOAuth2(context.Background(), &oreq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//create mock namespace
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Fail without instance ingress
+	res, err = server.EnableOAuth2(context.Background(), &oreq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//create mock ingress already protected with basic auth
+	ing := networkingv1.Ingress{}
+	ing.Name = "test-uid"
+	ing.Annotations = map[string]string{
+		"nginx.ingress.kubernetes.io/auth-type": "basic",
+		"nginx.ingress.kubernetes.io/auth-secret": "test-uid-auth",
+	}
+	ing.Spec.Rules = []networkingv1.IngressRule{{Host: "app.example.org"}}
+	ing.Spec.TLS = []networkingv1.IngressTLS{{Hosts: []string{"app.example.org"}, SecretName: "test-uid-tls"}}
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &ing, metav1.CreateOptions{})
+
+	//Pass
+	res, err = server.EnableOAuth2(context.Background(), &oreq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+
+	depl, err := client.AppsV1().Deployments("test-namespace").Get(context.Background(), "test-uid-oauth2-proxy", metav1.GetOptions{})
+	if err != nil || depl.Spec.Template.Spec.Containers[0].Image != "oauth2-proxy:test" {
+		t.Fatal(err)
+	}
+	args := strings.Join(depl.Spec.Template.Spec.Containers[0].Args, " ")
+	if !strings.Contains(args, "--allowed-group=noc") || !strings.Contains(args, "--allowed-group=admins") ||
+		!strings.Contains(args, "--oidc-issuer-url=https://sso.example.org/realms/nmaas") || strings.Contains(args, "secret") {
+		t.Fail()
+	}
+
+	sec, err := client.CoreV1().Secrets("test-namespace").Get(context.Background(), "test-uid-oauth2-proxy", metav1.GetOptions{})
+	if err != nil || string(sec.Data["client-secret"]) != "secret" || len(sec.Data["cookie-secret"]) != 32 {
+		t.Fail()
+	}
+	cookieSecret := string(sec.Data["cookie-secret"])
+
+	proxyIngress, err := client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid-oauth2-proxy", metav1.GetOptions{})
+	if err != nil || len(proxyIngress.Spec.Rules) != 1 || proxyIngress.Spec.Rules[0].Host != "app.example.org" ||
+		proxyIngress.Spec.Rules[0].HTTP.Paths[0].Path != "/oauth2" || len(proxyIngress.Spec.TLS) != 1 {
+		t.Fail()
+	}
+
+	annotated, _ := client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if annotated.Annotations["nginx.ingress.kubernetes.io/auth-url"] != "http://test-uid-oauth2-proxy.test-namespace.svc.cluster.local:4180/oauth2/auth" ||
+		!strings.HasPrefix(annotated.Annotations["nginx.ingress.kubernetes.io/auth-signin"], "https://$host/oauth2/start") {
+		t.Fail()
+	}
+	if _, ok := annotated.Annotations["nginx.ingress.kubernetes.io/auth-type"]; ok {
+		t.Fail()
+	}
+
+	//Should keep cookie secret when configuration is updated
+	res, err = server.EnableOAuth2(context.Background(), &oreq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	sec, _ = client.CoreV1().Secrets("test-namespace").Get(context.Background(), "test-uid-oauth2-proxy", metav1.GetOptions{})
+	if string(sec.Data["cookie-secret"]) != cookieSecret {
+		t.Fail()
+	}
+}
+
+func TestIngressAuthServiceServer_DisableOAuth2(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewIngressAuthServiceServer(client, nil, IngressControllerNginx, "oauth2-proxy:test", "")
+
+	//Fail on API version check
+	res, err := server.DisableOAuth2(context.Background(), &illegal_req)
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//create mock namespace
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Pass if not enabled
+	res, err = server.DisableOAuth2(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+
+	ing := networkingv1.Ingress{}
+	ing.Name = "test-uid"
+	ing.Spec.Rules = []networkingv1.IngressRule{{Host: "app.example.org"}}
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &ing, metav1.CreateOptions{})
+	_, _ = server.EnableOAuth2(context.Background(), &v1.InstanceOAuth2Request{Api: apiVersion, Instance: &inst, Oauth2: &oauth2Config})
+
+	//Should remove proxy and annotations
+	res, err = server.DisableOAuth2(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	_, err = client.AppsV1().Deployments("test-namespace").Get(context.Background(), "test-uid-oauth2-proxy", metav1.GetOptions{})
+	if err == nil {
+		t.Fail()
+	}
+	_, err = client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid-oauth2-proxy", metav1.GetOptions{})
+	if err == nil {
+		t.Fail()
+	}
+	annotated, _ := client.NetworkingV1().Ingresses("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if len(annotated.Annotations) != 0 {
+		t.Fail()
+	}
+}
+
+func TestIngressAuthServiceServer_GetStatus(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewIngressAuthServiceServer(client, nil, IngressControllerNginx, "oauth2-proxy:test", "")
+
+	//Fail on API version check
+	res, err := server.GetStatus(context.Background(), &illegal_req)
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	res, err = server.GetStatus(context.Background(), &req)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//create mock namespace
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Pass without ingress
+	res, err = server.GetStatus(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || res.Mode != v1.IngressAuthMode_AUTH_NONE {
+		t.Fail()
+	}
+
+	//create mock ingresses, one unprotected and one with basic auth
+	i1 := networkingv1.Ingress{}
+	i1.Name = "test-uid"
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &i1, metav1.CreateOptions{})
+	i2 := networkingv1.Ingress{}
+	i2.Name = "test-uid-api"
+	i2.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	i2.Annotations = map[string]string{"nginx.ingress.kubernetes.io/auth-type": "basic"}
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &i2, metav1.CreateOptions{})
+	//ingress of another instance whose uid starts with the same characters
+	i3 := networkingv1.Ingress{}
+	i3.Name = "test-uid-2"
+	i3.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid-2"}
+	_, _ = client.NetworkingV1().Ingresses("test-namespace").Create(context.Background(), &i3, metav1.CreateOptions{})
+	sec := corev1.Secret{}
+	sec.Name = getAuthSecretName("test-uid")
+	sec.Data = map[string][]byte{"auth": []byte("alice:x\nbob:y\n")}
+	_, _ = client.CoreV1().Secrets("test-namespace").Create(context.Background(), &sec, metav1.CreateOptions{})
+
+	res, err = server.GetStatus(context.Background(), &req)
+	if err != nil || res.Mode != v1.IngressAuthMode_AUTH_BASIC || len(res.Ingresses) != 2 || res.BasicAuthUsers != 2 {
+		t.Fail()
+	}
+
+	//Should report OAuth2 once enabled, not counting proxy ingress
+	_, _ = server.EnableOAuth2(context.Background(), &v1.InstanceOAuth2Request{Api: apiVersion, Instance: &inst, Oauth2: &oauth2Config})
+	res, err = server.GetStatus(context.Background(), &req)
+	if err != nil || res.Mode != v1.IngressAuthMode_AUTH_OAUTH2 || len(res.Ingresses) != 2 || res.Oauth2ProxyReady {
+		t.Fail()
+	}
+	for _, i := range res.Ingresses {
+		if i.Mode != v1.IngressAuthMode_AUTH_OAUTH2 {
+			t.Fail()
+		}
+	}
+}
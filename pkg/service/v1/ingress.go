@@ -0,0 +1,253 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+)
+
+//Ingress controller for which Janitor prepares Ingress configuration
+type IngressController string
+
+const (
+	IngressControllerNginx IngressController = "nginx"
+	IngressControllerTraefik IngressController = "traefik"
+)
+
+const (
+	instanceLabel = "app.kubernetes.io/instance"
+	componentLabel = "app.kubernetes.io/component"
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByJanitor = "nmaas-janitor"
+	nginxAuthTypeAnnotation = "nginx.ingress.kubernetes.io/auth-type"
+	nginxAuthSecretAnnotation = "nginx.ingress.kubernetes.io/auth-secret"
+	nginxAuthRealmAnnotation = "nginx.ingress.kubernetes.io/auth-realm"
+	traefikMiddlewaresAnnotation = "traefik.ingress.kubernetes.io/router.middlewares"
+	//Traefik reads htpasswd content of basic auth middleware from this secret key
+	traefikUsersSecretKey = "users"
+	//Traefik v3 renamed ipWhiteList middleware to ipAllowList
+	traefikIPAllowListKey = "ipAllowList"
+	traefikIPWhiteListKey = "ipWhiteList"
+	basicAuthRealm = "Authentication Required"
+)
+
+var traefikMiddlewareResource = schema.GroupVersionResource{Group: "traefik.io", Version: "v1alpha1", Resource: "middlewares"}
+
+//Map ingress controller name given in configuration, empty name selects ingress-nginx
+func ParseIngressController(name string) (IngressController, error) {
+	switch strings.ToLower(name) {
+	case "", "nginx", "ingress-nginx":
+		return IngressControllerNginx, nil
+	case "traefik":
+		return IngressControllerTraefik, nil
+	}
+	return "", fmt.Errorf("unsupported ingress controller '%s'", name)
+}
+
+//Map Traefik major version given in configuration to spec key of its IP allowlist middleware, empty version selects Traefik v3
+func ParseTraefikIPAllowlistKey(version string) (string, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "v") {
+	case "", "3":
+		return traefikIPAllowListKey, nil
+	case "2":
+		return traefikIPWhiteListKey, nil
+	}
+	return "", fmt.Errorf("unsupported Traefik version '%s'", version)
+}
+
+//Check if given object belongs to instance, either by instance label or by name equal to instance uid.
+//Names starting with uid are not matched, as they may belong to another instance with longer uid.
+func belongsToInstance(object metav1.Object, uid string, label string) bool {
+	return object.GetLabels()[label] == uid || object.GetName() == uid
+}
+
+//Check if given object was created by Janitor itself, such objects are not part of the application
+func isManagedByJanitor(object metav1.Object) bool {
+	return object.GetLabels()[managedByLabel] == managedByJanitor
+}
+
+//Find all Ingress objects of the instance in given namespace
+func findInstanceIngresses(ctx context.Context, kubeAPI kubernetes.Interface, namespace string, uid string, label string) ([]networkingv1.Ingress, error) {
+	all, err := kubeAPI.NetworkingV1().Ingresses(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	ingresses := make([]networkingv1.Ingress, 0)
+	for _, ingress := range all.Items {
+		if isManagedByJanitor(&ingress) {
+			continue
+		}
+		if belongsToInstance(&ingress, uid, label) {
+			ingresses = append(ingresses, ingress)
+		}
+	}
+	return ingresses, nil
+}
+
+//Apply modification to annotations of every instance Ingress, updating only those that changed
+func updateInstanceIngresses(ctx context.Context, kubeAPI kubernetes.Interface, namespace string, uid string, label string, modify func(annotations map[string]string) bool) (int, error) {
+	ingresses, err := findInstanceIngresses(ctx, kubeAPI, namespace, uid, label)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range ingresses {
+		ingress := &ingresses[i]
+		annotations := ingress.GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		if !modify(annotations) {
+			continue
+		}
+		ingress.SetAnnotations(annotations)
+
+		logLine(fmt.Sprintf("Updating annotations of Ingress %s", ingress.Name))
+		_, err = kubeAPI.NetworkingV1().Ingresses(namespace).Update(ctx, ingress, metav1.UpdateOptions{})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(ingresses), nil
+}
+
+//Reference to Traefik middleware as used in Ingress router annotation
+func traefikMiddlewareRef(namespace string, name string) string {
+	return namespace + "-" + name + "@kubernetescrd"
+}
+
+//Add middleware reference to comma separated list, reporting whether list changed
+func addTraefikMiddleware(annotations map[string]string, ref string) bool {
+	current := annotations[traefikMiddlewaresAnnotation]
+	for _, m := range strings.Split(current, ",") {
+		if strings.TrimSpace(m) == ref {
+			return false
+		}
+	}
+	if len(current) > 0 {
+		ref = current + "," + ref
+	}
+	annotations[traefikMiddlewaresAnnotation] = ref
+	return true
+}
+
+//Remove middleware reference from comma separated list, reporting whether list changed
+func removeTraefikMiddleware(annotations map[string]string, ref string) bool {
+	current, ok := annotations[traefikMiddlewaresAnnotation]
+	if !ok {
+		return false
+	}
+	remaining := make([]string, 0)
+	for _, m := range strings.Split(current, ",") {
+		if m = strings.TrimSpace(m); len(m) > 0 && m != ref {
+			remaining = append(remaining, m)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(annotations, traefikMiddlewaresAnnotation)
+	} else {
+		annotations[traefikMiddlewaresAnnotation] = strings.Join(remaining, ",")
+	}
+	return annotations[traefikMiddlewaresAnnotation] != current
+}
+
+//Create Traefik middleware or replace spec of the existing one
+func createOrUpdateTraefikMiddleware(ctx context.Context, dynamicAPI dynamic.Interface, namespace string, name string, spec map[string]interface{}) error {
+	middleware := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": traefikMiddlewareResource.GroupVersion().String(),
+		"kind": "Middleware",
+		"metadata": map[string]interface{}{
+			"name": name,
+			"namespace": namespace,
+		},
+		"spec": spec,
+	}}
+
+	_, err := dynamicAPI.Resource(traefikMiddlewareResource).Namespace(namespace).Create(ctx, middleware, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		existing, err := dynamicAPI.Resource(traefikMiddlewareResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		existing.Object["spec"] = spec
+		_, err = dynamicAPI.Resource(traefikMiddlewareResource).Namespace(namespace).Update(ctx, existing, metav1.UpdateOptions{})
+		return err
+	}
+	return err
+}
+
+//Delete Traefik middleware, missing middleware is not an error
+func deleteTraefikMiddleware(ctx context.Context, dynamicAPI dynamic.Interface, namespace string, name string) error {
+	err := dynamicAPI.Resource(traefikMiddlewareResource).Namespace(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func getBasicAuthMiddlewareName(uid string) string {
+	return uid + "-basic-auth"
+}
+
+//Enable basic auth with instance secret on all instance Ingress objects, returning number of Ingress objects found
+func wireBasicAuth(ctx context.Context, kubeAPI kubernetes.Interface, dynamicAPI dynamic.Interface, controller IngressController, namespace string, uid string, label string) (int, error) {
+	secretName := getAuthSecretName(uid)
+
+	if controller == IngressControllerTraefik {
+		middleware := getBasicAuthMiddlewareName(uid)
+		spec := map[string]interface{}{"basicAuth": map[string]interface{}{"secret": secretName, "realm": basicAuthRealm}}
+		if err := createOrUpdateTraefikMiddleware(ctx, dynamicAPI, namespace, middleware, spec); err != nil {
+			return 0, err
+		}
+		ref := traefikMiddlewareRef(namespace, middleware)
+		return updateInstanceIngresses(ctx, kubeAPI, namespace, uid, label, func(annotations map[string]string) bool {
+			return addTraefikMiddleware(annotations, ref)
+		})
+	}
+
+	return updateInstanceIngresses(ctx, kubeAPI, namespace, uid, label, func(annotations map[string]string) bool {
+		changed := annotations[nginxAuthSecretAnnotation] != secretName || annotations[nginxAuthTypeAnnotation] != "basic"
+		annotations[nginxAuthTypeAnnotation] = "basic"
+		annotations[nginxAuthSecretAnnotation] = secretName
+		if _, ok := annotations[nginxAuthRealmAnnotation]; !ok {
+			annotations[nginxAuthRealmAnnotation] = basicAuthRealm
+			changed = true
+		}
+		return changed
+	})
+}
+
+//Remove basic auth configuration referencing instance secret from all instance Ingress objects
+func unwireBasicAuth(ctx context.Context, kubeAPI kubernetes.Interface, dynamicAPI dynamic.Interface, controller IngressController, namespace string, uid string, label string) error {
+	secretName := getAuthSecretName(uid)
+	middleware := getBasicAuthMiddlewareName(uid)
+	ref := traefikMiddlewareRef(namespace, middleware)
+
+	//annotations of both controllers are cleaned in case controller was changed in the meantime
+	_, err := updateInstanceIngresses(ctx, kubeAPI, namespace, uid, label, func(annotations map[string]string) bool {
+		changed := removeTraefikMiddleware(annotations, ref)
+		if annotations[nginxAuthSecretAnnotation] == secretName {
+			delete(annotations, nginxAuthTypeAnnotation)
+			delete(annotations, nginxAuthSecretAnnotation)
+			delete(annotations, nginxAuthRealmAnnotation)
+			changed = true
+		}
+		return changed
+	})
+	if err != nil {
+		return err
+	}
+
+	if controller == IngressControllerTraefik {
+		return deleteTraefikMiddleware(ctx, dynamicAPI, namespace, middleware)
+	}
+	return nil
+}
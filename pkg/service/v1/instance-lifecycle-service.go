@@ -0,0 +1,258 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+const (
+	//Replicas of workload before it was suspended, present only on suspended workloads
+	suspendedReplicasAnnotation = "janitor.nmaas.eu/suspended-replicas"
+	//Pod template annotation changed by kubectl rollout restart
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+	//DaemonSets cannot be scaled, they are suspended by selecting nodes which do not exist
+	suspendedNodeSelector = "janitor.nmaas.eu/suspended"
+)
+
+type instanceLifecycleServiceServer struct {
+	kubeAPI kubernetes.Interface
+	instanceLabel string
+}
+
+func NewInstanceLifecycleServiceServer(kubeAPI kubernetes.Interface, label string) v1.InstanceLifecycleServiceServer {
+	if len(label) == 0 {
+		label = instanceLabel
+	}
+	return &instanceLifecycleServiceServer{kubeAPI: kubeAPI, instanceLabel: label}
+}
+
+//Workload running instance pods, patched through the client of its kind
+type instanceWorkload struct {
+	kind string
+	name string
+	replicas int32
+	annotations map[string]string
+	patch func(ctx context.Context, data []byte) error
+}
+
+func (w *instanceWorkload) suspended() bool {
+	_, found := w.annotations[suspendedReplicasAnnotation]
+	return found
+}
+
+//Check if Deployment or StatefulSet was scaled to zero by Suspend
+func isSuspended(object metav1.Object, replicas *int32) bool {
+	_, found := object.GetAnnotations()[suspendedReplicasAnnotation]
+	return found && desiredReplicas(replicas) == 0
+}
+
+//Find Deployments, StatefulSets and DaemonSets of the instance, Jobs run to completion and are not managed
+func (s *instanceLifecycleServiceServer) findWorkloads(ctx context.Context, namespace string, uid string) ([]*instanceWorkload, error) {
+	found, err := findInstanceWorkloads(ctx, s.kubeAPI, namespace, uid, s.instanceLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	workloads := make([]*instanceWorkload, 0)
+	for _, dep := range found.deployments {
+		name := dep.Name
+		workloads = append(workloads, &instanceWorkload{kind: "Deployment", name: name, replicas: desiredReplicas(dep.Spec.Replicas), annotations: dep.Annotations,
+			patch: func(ctx context.Context, data []byte) error {
+				_, err := s.kubeAPI.AppsV1().Deployments(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+				return err
+			}})
+	}
+	for _, sts := range found.statefulSets {
+		name := sts.Name
+		workloads = append(workloads, &instanceWorkload{kind: "StatefulSet", name: name, replicas: desiredReplicas(sts.Spec.Replicas), annotations: sts.Annotations,
+			patch: func(ctx context.Context, data []byte) error {
+				_, err := s.kubeAPI.AppsV1().StatefulSets(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+				return err
+			}})
+	}
+	for _, ds := range found.daemonSets {
+		name := ds.Name
+		workloads = append(workloads, &instanceWorkload{kind: "DaemonSet", name: name, replicas: ds.Status.DesiredNumberScheduled, annotations: ds.Annotations,
+			patch: func(ctx context.Context, data []byte) error {
+				_, err := s.kubeAPI.AppsV1().DaemonSets(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+				return err
+			}})
+	}
+	return workloads, nil
+}
+
+//Find instance workloads, failing when there are none
+func (s *instanceLifecycleServiceServer) instanceWorkloads(ctx context.Context, depl *v1.Instance) ([]*instanceWorkload, *v1.ServiceResponse, error) {
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	workloads, err := s.findWorkloads(ctx, depl.Namespace, depl.Uid)
+	if err != nil {
+		return nil, prepareResponse(v1.Status_FAILED, "Error while retrieving workloads!"), err
+	}
+	if len(workloads) == 0 {
+		logLine("no workloads found")
+		return nil, prepareResponse(v1.Status_FAILED, "No workloads found!"), status.Errorf(codes.NotFound, "no workloads found for instance %s", depl.Uid)
+	}
+	return workloads, nil, nil
+}
+
+//Merge patch changing workload spec and annotations, nil annotation values remove them
+func workloadPatch(annotations map[string]interface{}, spec map[string]interface{}) []byte {
+	patch := map[string]interface{}{"spec": spec}
+	if annotations != nil {
+		patch["metadata"] = map[string]interface{}{"annotations": annotations}
+	}
+	data, _ := json.Marshal(patch)
+	return data
+}
+
+func describeWorkloads(workloads []string) string {
+	if len(workloads) == 0 {
+		return ""
+	}
+	return ": " + strings.Join(workloads, ", ")
+}
+
+func (s *instanceLifecycleServiceServer) Restart(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+	logLine(fmt.Sprintf("> Restarting instance %s in namespace %s", depl.Uid, depl.Namespace))
+
+	workloads, res, err := s.instanceWorkloads(ctx, depl)
+	if res != nil {
+		return res, err
+	}
+
+	restartedAt := time.Now().UTC().Format(time.RFC3339)
+	restarted := make([]string, 0)
+	for _, w := range workloads {
+		//suspended workloads have no pods to restart
+		if w.suspended() {
+			continue
+		}
+		patch := workloadPatch(nil, map[string]interface{}{
+			"template": map[string]interface{}{"metadata": map[string]interface{}{"annotations": map[string]string{restartedAtAnnotation: restartedAt}}},
+		})
+		if err = w.patch(ctx, patch); err != nil {
+			return prepareResponse(v1.Status_FAILED, fmt.Sprintf("Error while restarting %s %s", w.kind, w.name)), err
+		}
+		restarted = append(restarted, w.kind+" "+w.name)
+	}
+
+	if len(restarted) == 0 {
+		logLine("< instance is suspended")
+		return prepareResponse(v1.Status_FAILED, "Instance is suspended, resume it instead"), status.Errorf(codes.FailedPrecondition, "instance %s is suspended", depl.Uid)
+	}
+	message := fmt.Sprintf("Restarted %d workload(s)%s", len(restarted), describeWorkloads(restarted))
+	logLine("< " + message)
+	return prepareResponse(v1.Status_OK, message), nil
+}
+
+func (s *instanceLifecycleServiceServer) Suspend(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+	logLine(fmt.Sprintf("> Suspending instance %s in namespace %s", depl.Uid, depl.Namespace))
+
+	workloads, res, err := s.instanceWorkloads(ctx, depl)
+	if res != nil {
+		return res, err
+	}
+
+	suspended := make([]string, 0)
+	for _, w := range workloads {
+		//workload suspended before keeps its originally recorded replicas
+		if w.suspended() {
+			continue
+		}
+		annotations := map[string]interface{}{suspendedReplicasAnnotation: strconv.Itoa(int(w.replicas))}
+		spec := map[string]interface{}{"replicas": 0}
+		if w.kind == "DaemonSet" {
+			spec = map[string]interface{}{
+				"template": map[string]interface{}{"spec": map[string]interface{}{"nodeSelector": map[string]string{suspendedNodeSelector: "true"}}},
+			}
+		}
+		if err = w.patch(ctx, workloadPatch(annotations, spec)); err != nil {
+			return prepareResponse(v1.Status_FAILED, fmt.Sprintf("Error while suspending %s %s", w.kind, w.name)), err
+		}
+		suspended = append(suspended, w.kind+" "+w.name)
+	}
+
+	if len(suspended) == 0 {
+		logLine("< instance already suspended")
+		return prepareResponse(v1.Status_OK, "Instance is already suspended"), nil
+	}
+	message := fmt.Sprintf("Suspended %d workload(s)%s", len(suspended), describeWorkloads(suspended))
+	logLine("< " + message)
+	return prepareResponse(v1.Status_OK, message), nil
+}
+
+func (s *instanceLifecycleServiceServer) Resume(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+	logLine(fmt.Sprintf("> Resuming instance %s in namespace %s", depl.Uid, depl.Namespace))
+
+	workloads, res, err := s.instanceWorkloads(ctx, depl)
+	if res != nil {
+		return res, err
+	}
+
+	resumed := make([]string, 0)
+	for _, w := range workloads {
+		if !w.suspended() {
+			continue
+		}
+		annotations := map[string]interface{}{suspendedReplicasAnnotation: nil}
+		var spec map[string]interface{}
+		if w.kind == "DaemonSet" {
+			spec = map[string]interface{}{
+				"template": map[string]interface{}{"spec": map[string]interface{}{"nodeSelector": map[string]interface{}{suspendedNodeSelector: nil}}},
+			}
+		} else {
+			replicas, err := strconv.Atoi(w.annotations[suspendedReplicasAnnotation])
+			if err != nil || replicas < 0 {
+				message := fmt.Sprintf("Invalid replicas recorded on %s %s", w.kind, w.name)
+				return prepareResponse(v1.Status_FAILED, message), status.Errorf(codes.FailedPrecondition, "%s", message)
+			}
+			spec = map[string]interface{}{"replicas": replicas}
+		}
+		if err = w.patch(ctx, workloadPatch(annotations, spec)); err != nil {
+			return prepareResponse(v1.Status_FAILED, fmt.Sprintf("Error while resuming %s %s", w.kind, w.name)), err
+		}
+		resumed = append(resumed, w.kind+" "+w.name)
+	}
+
+	if len(resumed) == 0 {
+		logLine("< instance not suspended")
+		return prepareResponse(v1.Status_OK, "Instance is not suspended"), nil
+	}
+	message := fmt.Sprintf("Resumed %d workload(s)%s", len(resumed), describeWorkloads(resumed))
+	logLine("< " + message)
+	return prepareResponse(v1.Status_OK, message), nil
+}
@@ -0,0 +1,222 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestInstanceLifecycleServiceServer(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewInstanceLifecycleServiceServer(client, "")
+
+	//Fail on API version check
+	for _, operation := range []func(context.Context, *v1.InstanceRequest) (*v1.ServiceResponse, error){server.Restart, server.Suspend, server.Resume} {
+		res, err := operation(context.Background(), &illegal_req)
+		if err == nil || res != nil {
+			t.Fail()
+		}
+	}
+
+	//Fail on namespace check
+	res, err := server.Suspend(context.Background(), &v1.InstanceRequest{Api: apiVersion, Deployment: &fake_ns_inst})
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Fail when there are no workloads
+	res, err = server.Restart(context.Background(), &req)
+	if status.Code(err) != codes.NotFound || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	depl := appsv1.Deployment{}
+	depl.Name = "test-uid"
+	depl.Spec.Replicas = int32Ptr(3)
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &depl, metav1.CreateOptions{})
+	sts := appsv1.StatefulSet{}
+	sts.Name = "test-uid-db"
+	sts.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	_, _ = client.AppsV1().StatefulSets("test-namespace").Create(context.Background(), &sts, metav1.CreateOptions{})
+	ds := appsv1.DaemonSet{}
+	ds.Name = "test-uid-agent"
+	ds.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	ds.Spec.Template.Spec.NodeSelector = map[string]string{"kubernetes.io/os": "linux"}
+	_, _ = client.AppsV1().DaemonSets("test-namespace").Create(context.Background(), &ds, metav1.CreateOptions{})
+
+	res, err = server.Restart(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err, res)
+	}
+	d, _ := client.AppsV1().Deployments("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if len(d.Spec.Template.Annotations[restartedAtAnnotation]) == 0 || *d.Spec.Replicas != 3 {
+		t.Errorf("deployment not restarted %v", d.Spec.Template.Annotations)
+	}
+	a, _ := client.AppsV1().DaemonSets("test-namespace").Get(context.Background(), "test-uid-agent", metav1.GetOptions{})
+	if len(a.Spec.Template.Annotations[restartedAtAnnotation]) == 0 {
+		t.Error("daemon set not restarted")
+	}
+
+	res, err = server.Suspend(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err, res)
+	}
+	d, _ = client.AppsV1().Deployments("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	s, _ := client.AppsV1().StatefulSets("test-namespace").Get(context.Background(), "test-uid-db", metav1.GetOptions{})
+	a, _ = client.AppsV1().DaemonSets("test-namespace").Get(context.Background(), "test-uid-agent", metav1.GetOptions{})
+	if *d.Spec.Replicas != 0 || d.Annotations[suspendedReplicasAnnotation] != "3" || *s.Spec.Replicas != 0 || s.Annotations[suspendedReplicasAnnotation] != "1" {
+		t.Errorf("workloads not scaled to zero %v, %v", d.Annotations, s.Annotations)
+	}
+	if a.Spec.Template.Spec.NodeSelector[suspendedNodeSelector] != "true" || a.Spec.Template.Spec.NodeSelector["kubernetes.io/os"] != "linux" {
+		t.Errorf("daemon set not suspended %v", a.Spec.Template.Spec.NodeSelector)
+	}
+
+	//suspending again keeps originally recorded replicas
+	res, err = server.Suspend(context.Background(), &req)
+	d, _ = client.AppsV1().Deployments("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	if err != nil || res.Message != "Instance is already suspended" || d.Annotations[suspendedReplicasAnnotation] != "3" {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	//suspended instance is reported as suspended by readiness check
+	ready, err := NewReadinessServiceServer(client, "").CheckIfReady(context.Background(), &req)
+	if err != nil || ready.Status != v1.Status_SUSPENDED || len(ready.PodProblems) != 0 {
+		t.Errorf("unexpected readiness %v, %v", ready, err)
+	}
+
+	//Fail on restart of suspended instance
+	res, err = server.Restart(context.Background(), &req)
+	if status.Code(err) != codes.FailedPrecondition || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	res, err = server.Resume(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err, res)
+	}
+	d, _ = client.AppsV1().Deployments("test-namespace").Get(context.Background(), "test-uid", metav1.GetOptions{})
+	s, _ = client.AppsV1().StatefulSets("test-namespace").Get(context.Background(), "test-uid-db", metav1.GetOptions{})
+	a, _ = client.AppsV1().DaemonSets("test-namespace").Get(context.Background(), "test-uid-agent", metav1.GetOptions{})
+	if *d.Spec.Replicas != 3 || *s.Spec.Replicas != 1 || len(d.Annotations[suspendedReplicasAnnotation]) != 0 || len(s.Annotations) != 0 {
+		t.Errorf("workloads not resumed %v, %v", d.Annotations, s.Annotations)
+	}
+	if _, found := a.Spec.Template.Spec.NodeSelector[suspendedNodeSelector]; found || len(a.Annotations) != 0 || a.Spec.Template.Spec.NodeSelector["kubernetes.io/os"] != "linux" {
+		t.Errorf("daemon set not resumed %v", a.Spec.Template.Spec.NodeSelector)
+	}
+
+	res, err = server.Resume(context.Background(), &req)
+	if err != nil || res.Message != "Instance is not suspended" {
+		t.Errorf("unexpected response %v", res)
+	}
+}
+
+func TestAggregateSuspendedWorkloadStatuses(t *testing.T) {
+	statuses := []*v1.WorkloadStatus{
+		workloadStatus("Deployment", "test-uid", v1.Status_SUSPENDED, "Deployment is suspended"),
+		workloadStatus("Job", "test-uid-migrate", v1.Status_PENDING, ""),
+		workloadStatus("PersistentVolumeClaim", "test-uid-data", v1.Status_OK, ""),
+	}
+	if result, message := aggregateWorkloadStatuses(statuses); result != v1.Status_SUSPENDED || message != "Suspended: Deployment test-uid" {
+		t.Errorf("unexpected status %v: %s", result, message)
+	}
+	statuses[2].Status = v1.Status_FAILED
+	if result, _ := aggregateWorkloadStatuses(statuses); result != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Deployment scaled to zero by hand is not suspended
+	depl := appsv1.Deployment{}
+	depl.Name = "test-uid"
+	depl.Spec.Replicas = int32Ptr(0)
+	if deploymentStatus(&depl).Status != v1.Status_OK {
+		t.Fail()
+	}
+	depl.Annotations = map[string]string{suspendedReplicasAnnotation: "2"}
+	if deploymentStatus(&depl).Status != v1.Status_SUSPENDED {
+		t.Fail()
+	}
+}
+
+func TestInstanceLifecycleServiceServer_CustomLabel(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewInstanceLifecycleServiceServer(client, "nmaas.eu/instance")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//workload found only through configured label, another one labelled with the default label is left alone
+	depl := appsv1.Deployment{}
+	depl.Name = "web"
+	depl.Labels = map[string]string{"nmaas.eu/instance": "test-uid"}
+	depl.Spec.Replicas = int32Ptr(2)
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &depl, metav1.CreateOptions{})
+	other := appsv1.Deployment{}
+	other.Name = "other"
+	other.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &other, metav1.CreateOptions{})
+
+	res, err := server.Suspend(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || res.Message != "Suspended 1 workload(s): Deployment web" {
+		t.Fatal(err, res)
+	}
+
+	//readiness check with the same label reports the instance suspended
+	ready, err := NewReadinessServiceServer(client, "nmaas.eu/instance").CheckIfReady(context.Background(), &req)
+	if err != nil || ready.Status != v1.Status_SUSPENDED || len(ready.Workloads) != 1 {
+		t.Errorf("unexpected readiness %v, %v", ready, err)
+	}
+}
+
+func TestInstanceLifecycleServiceServer_SkipsOAuth2Proxy(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewInstanceLifecycleServiceServer(client, "")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	depl := appsv1.Deployment{}
+	depl.Name = "test-uid"
+	depl.Spec.Replicas = int32Ptr(1)
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &depl, metav1.CreateOptions{})
+
+	//oauth2-proxy carries the instance label but is managed by Janitor, not the application
+	authServer := &ingressAuthServiceServer{instanceLabel: instanceLabel}
+	proxy := authServer.prepareOAuth2ProxyDeployment("test-namespace", "test-uid", &v1.OAuth2Config{IssuerUrl: "https://idp.example.com"})
+	proxy.Status.Replicas = 1
+	proxy.Status.ReadyReplicas = 1
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), proxy, metav1.CreateOptions{})
+	proxyPod := corev1.Pod{}
+	proxyPod.Name = proxy.Name + "-abc"
+	proxyPod.Labels = proxy.Spec.Template.Labels
+	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &proxyPod, metav1.CreateOptions{})
+
+	ready, err := NewReadinessServiceServer(client, "").CheckIfReady(context.Background(), &req)
+	if err != nil || ready.Status == v1.Status_OK || len(ready.Workloads) != 1 || ready.Workloads[0].Name != "test-uid" {
+		t.Errorf("unexpected readiness %v, %v", ready, err)
+	}
+	pods, err := findInstancePodsBySelector(context.Background(), client, "test-namespace", "test-uid", instanceLabel)
+	if err != nil || len(pods) != 0 {
+		t.Errorf("oauth2-proxy pod listed as instance pod %v, %v", pods, err)
+	}
+
+	res, err := server.Suspend(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || res.Message != "Suspended 1 workload(s): Deployment test-uid" {
+		t.Fatal(err, res)
+	}
+	p, _ := client.AppsV1().Deployments("test-namespace").Get(context.Background(), proxy.Name, metav1.GetOptions{})
+	if *p.Spec.Replicas != 1 || len(p.Annotations[suspendedReplicasAnnotation]) != 0 {
+		t.Errorf("oauth2-proxy scaled down %v", p.Annotations)
+	}
+}
@@ -0,0 +1,404 @@
+package v1
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+const (
+	//Lines already buffered are sent together, up to this many in single message
+	maxLogBatchLines = 100
+	//Longer lines are split, so that single line can not exhaust memory
+	maxLogLineBytes = 64 * 1024
+)
+
+//Split log output into lines, dropping line break at the end of output
+func splitLogLines(logs string) []string {
+	logs = strings.TrimSuffix(logs, "\n")
+	if len(logs) == 0 {
+		return make([]string, 0)
+	}
+	lines := strings.Split(logs, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	return lines
+}
+
+//Read log lines as they arrive and pass them to send. Lines already buffered are batched, otherwise each line is sent
+//immediately. Since send blocks until the client accepts the message, slow clients slow down reading of the log.
+//Lines longer than maxLineBytes are split into parts of at most that size.
+func streamLogLines(ctx context.Context, reader io.Reader, maxLineBytes int, send func(lines []string) error) error {
+	buffered := bufio.NewReaderSize(reader, maxLogLineBytes)
+	batch := make([]string, 0, maxLogBatchLines)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := send(batch)
+		batch = make([]string, 0, maxLogBatchLines)
+		return err
+	}
+
+	var long []byte
+	for {
+		line, err := buffered.ReadSlice('\n')
+		if err == bufio.ErrBufferFull && len(long)+len(line) < maxLineBytes {
+			//keep collecting parts of line longer than the read buffer
+			long = append(long, line...)
+			continue
+		}
+		if len(long) > 0 {
+			line = append(long, line...)
+			long = nil
+		}
+		if len(line) > 0 {
+			batch = append(batch, strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"))
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if flushErr := flush(); flushErr != nil {
+				return flushErr
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if len(batch) >= maxLogBatchLines || buffered.Buffered() == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//Translate requested log options to PodLogOptions, container and follow are set by caller
+func podLogOptions(options *v1.LogOptions) (apiv1.PodLogOptions, error) {
+	opts := apiv1.PodLogOptions{}
+	if options == nil {
+		return opts, nil
+	}
+	if options.TailLines < 0 || options.SinceSeconds < 0 || options.LimitBytes < 0 {
+		return opts, errors.New("tailLines, sinceSeconds and limitBytes must not be negative")
+	}
+	if options.SinceSeconds > 0 && len(options.SinceTime) > 0 {
+		return opts, errors.New("only one of sinceSeconds and sinceTime may be given")
+	}
+
+	if options.TailLines > 0 {
+		opts.TailLines = &options.TailLines
+	}
+	if options.SinceSeconds > 0 {
+		opts.SinceSeconds = &options.SinceSeconds
+	}
+	if len(options.SinceTime) > 0 {
+		since, err := time.Parse(time.RFC3339, options.SinceTime)
+		if err != nil {
+			return opts, fmt.Errorf("sinceTime '%s' is not a valid RFC 3339 timestamp", options.SinceTime)
+		}
+		sinceTime := metav1.NewTime(since)
+		opts.SinceTime = &sinceTime
+	}
+	if options.LimitBytes > 0 {
+		opts.LimitBytes = &options.LimitBytes
+	}
+	opts.Previous = options.Previous
+	opts.Timestamps = options.Timestamps
+	return opts, nil
+}
+
+//Containers to read logs from. Empty name selects the default container of single-container pods.
+func logContainers(pod *apiv1.Pod, requested []string, all bool) []string {
+	if !all {
+		if len(requested) > 0 {
+			return requested[:1]
+		}
+		return []string{""}
+	}
+
+	containers := make([]string, 0)
+	for _, container := range pod.Spec.InitContainers {
+		containers = append(containers, container.Name)
+	}
+	for _, container := range pod.Spec.Containers {
+		containers = append(containers, container.Name)
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		containers = append(containers, container.Name)
+	}
+	return containers
+}
+
+//Prefix marking container which logged the line when logs of all containers are merged
+func containerLogPrefix(container string) string {
+	return "[" + container + "] "
+}
+
+//Split timestamp added to log line by kubelet
+func splitLogTimestamp(line string) (time.Time, string, bool) {
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return time.Time{}, line, false
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, line[:i])
+	if err != nil {
+		return time.Time{}, line, false
+	}
+	return timestamp, line[i+1:], true
+}
+
+//Log lines of single container
+type containerLogs struct {
+	container string
+	lines []string
+}
+
+//Merge timestamped logs of several containers in time order, prefixing each line with its container.
+//Timestamps are kept only if requested by client.
+func mergeContainerLogs(logs []containerLogs, timestamps bool) []string {
+	type entry struct {
+		time time.Time
+		line string
+	}
+	entries := make([]entry, 0)
+	for _, l := range logs {
+		prefix := containerLogPrefix(l.container)
+		last := time.Time{}
+		for _, line := range l.lines {
+			timestamp, text, ok := splitLogTimestamp(line)
+			//lines without timestamp keep position after the previous line of the container
+			if ok {
+				last = timestamp
+			}
+			if timestamps {
+				text = line
+			}
+			entries = append(entries, entry{time: last, line: prefix + text})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+	lines := make([]string, len(entries))
+	for i := range entries {
+		lines[i] = entries[i].line
+	}
+	return lines
+}
+
+//Read complete log of single container
+func readPodLogBytes(ctx context.Context, kubeAPI kubernetes.Interface, namespace string, pod string, opts apiv1.PodLogOptions) ([]byte, error) {
+	podLogs, err := kubeAPI.CoreV1().Pods(namespace).GetLogs(pod, &opts).Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer podLogs.Close()
+
+	logBuffer := new(bytes.Buffer)
+	if _, err = io.Copy(logBuffer, podLogs); err != nil {
+		return nil, err
+	}
+	return logBuffer.Bytes(), nil
+}
+
+func (s *podServiceServer) readContainerLogs(ctx context.Context, namespace string, pod string, opts apiv1.PodLogOptions) ([]string, error) {
+	logs, err := readPodLogBytes(ctx, s.kubeAPI, namespace, pod, opts)
+	if err != nil {
+		return nil, err
+	}
+	return splitLogLines(string(logs)), nil
+}
+
+//Read logs of given containers, merging them if logs of all containers were requested. Containers which fail
+//to provide logs are skipped, for example those that were never restarted when previous logs are requested.
+func (s *podServiceServer) readPodLogs(ctx context.Context, namespace string, pod string, containers []string, opts apiv1.PodLogOptions, all bool) ([]string, error) {
+	if !all {
+		opts.Container = containers[0]
+		return s.readContainerLogs(ctx, namespace, pod, opts)
+	}
+
+	timestamps := opts.Timestamps
+	//timestamps are needed to merge logs of containers in time order
+	opts.Timestamps = true
+	logs := make([]containerLogs, 0, len(containers))
+	var lastErr error
+	for _, container := range containers {
+		opts.Container = container
+		lines, err := s.readContainerLogs(ctx, namespace, pod, opts)
+		if err != nil {
+			logLine(fmt.Sprintf("Skipping logs of container %s: %s", container, err))
+			lastErr = err
+			continue
+		}
+		logs = append(logs, containerLogs{container: container, lines: lines})
+	}
+	if len(logs) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return mergeContainerLogs(logs, timestamps), nil
+}
+
+//Stream log of single container until it ends or context is cancelled
+func (s *podServiceServer) streamContainerLogs(ctx context.Context, namespace string, pod string, opts apiv1.PodLogOptions, maxLineBytes int, send func(lines []string) error) error {
+	podLogs, err := s.kubeAPI.CoreV1().Pods(namespace).GetLogs(pod, &opts).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer podLogs.Close()
+
+	//unblock pending read when client goes away
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = podLogs.Close()
+		case <-done:
+		}
+	}()
+
+	return streamLogLines(ctx, podLogs, maxLineBytes, send)
+}
+
+//Follow logs of several containers concurrently, prefixing lines with their container. Lines are passed to send
+//from single goroutine, readers wait until their lines are accepted.
+func (s *podServiceServer) followAllContainerLogs(ctx context.Context, namespace string, pod string, containers []string, opts apiv1.PodLogOptions, send func(lines []string) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := make(chan []string)
+	errs := make(chan error, len(containers))
+	var wg sync.WaitGroup
+	for _, container := range containers {
+		wg.Add(1)
+		go func(container string) {
+			defer wg.Done()
+			containerOpts := opts
+			containerOpts.Container = container
+			prefix := containerLogPrefix(container)
+			err := s.streamContainerLogs(ctx, namespace, pod, containerOpts, maxLogLineBytes, func(lines []string) error {
+				for i := range lines {
+					lines[i] = prefix + lines[i]
+				}
+				select {
+				case batches <- lines:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil && ctx.Err() == nil {
+				logLine(fmt.Sprintf("Log stream of container %s ended: %s", container, err))
+			}
+			errs <- err
+		}(container)
+	}
+	go func() {
+		wg.Wait()
+		close(batches)
+	}()
+
+	for lines := range batches {
+		if err := send(lines); err != nil {
+			cancel()
+			for range batches {
+			}
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	//stream fails only if none of the containers provided logs
+	var lastErr error
+	for range containers {
+		err := <-errs
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+//Map end of log stream caused by client to gRPC error
+func logStreamEndError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return status.Errorf(codes.DeadlineExceeded, "log stream deadline exceeded")
+	case context.Canceled:
+		return status.Errorf(codes.Canceled, "log stream cancelled by client")
+	}
+	return err
+}
+
+func (s *podServiceServer) StreamPodLogs(req *v1.PodRequest, stream v1.PodService_StreamPodLogsServer) error {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return err
+	}
+	if req.Pod == nil {
+		return status.Errorf(codes.InvalidArgument, "pod must be given")
+	}
+
+	ctx := stream.Context()
+	depl := req.Deployment
+	pod := req.Pod
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	opts, err := podLogOptions(req.LogOptions)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid log options: %s", err)
+	}
+	opts.Follow = true
+	all := req.LogOptions.GetAllContainers()
+
+	//check if given pod exists
+	existing, err := s.kubeAPI.CoreV1().Pods(depl.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	containers := logContainers(existing, pod.Containers, all)
+	logLine(fmt.Sprintf("> Following logs of pod/container(s) %s/%s in namespace %s", pod.Name, strings.Join(containers, ","), depl.Namespace))
+
+	send := func(lines []string) error {
+		return stream.Send(preparePodLogsResponse(v1.Status_OK, "", lines))
+	}
+	if all {
+		err = s.followAllContainerLogs(ctx, depl.Namespace, pod.Name, containers, opts, send)
+	} else {
+		opts.Container = containers[0]
+		err = s.streamContainerLogs(ctx, depl.Namespace, pod.Name, opts, maxLogLineBytes, send)
+	}
+	if err != nil {
+		logLine(fmt.Sprintf("< Log stream of pod %s ended: %s", pod.Name, err))
+		return logStreamEndError(ctx, err)
+	}
+	logLine(fmt.Sprintf("< Log stream of pod %s ended", pod.Name))
+	return nil
+}
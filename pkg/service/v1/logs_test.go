@@ -0,0 +1,270 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	"google.golang.org/grpc"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+	"time"
+)
+
+type podLogsStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	sent []*v1.PodLogsResponse
+}
+
+func (s *podLogsStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *podLogsStream) Send(res *v1.PodLogsResponse) error {
+	s.sent = append(s.sent, res)
+	return nil
+}
+
+func TestSplitLogLines(t *testing.T) {
+	tests := []struct {
+		logs     string
+		expected []string
+	}{
+		{"", []string{}},
+		{"single", []string{"single"}},
+		{"first\nsecond\n", []string{"first", "second"}},
+		{"first\r\n\nthird", []string{"first", "", "third"}},
+	}
+	for _, test := range tests {
+		lines := splitLogLines(test.logs)
+		if strings.Join(lines, "|") != strings.Join(test.expected, "|") || len(lines) != len(test.expected) {
+			t.Errorf("unexpected lines %q for %q", lines, test.logs)
+		}
+	}
+}
+
+func TestStreamLogLines(t *testing.T) {
+	reader, writer := io.Pipe()
+	batches := make(chan []string)
+	done := make(chan error, 1)
+	go func() {
+		done <- streamLogLines(context.Background(), reader, maxLogLineBytes, func(lines []string) error {
+			batches <- lines
+			return nil
+		})
+	}()
+
+	//lines available at once are sent in single batch
+	go func() { _, _ = writer.Write([]byte("first\nsecond\n")) }()
+	if batch := <-batches; len(batch) != 2 || batch[1] != "second" {
+		t.Errorf("unexpected batch %q", batch)
+	}
+
+	//reading stops while client does not accept previous batch
+	_, _ = writer.Write([]byte("third\n"))
+	written := make(chan struct{})
+	go func() {
+		_, _ = writer.Write([]byte("fourth\n"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Error("log was read although previous batch was not sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if batch := <-batches; len(batch) != 1 || batch[0] != "third" {
+		t.Errorf("unexpected batch %q", batch)
+	}
+	if batch := <-batches; len(batch) != 1 || batch[0] != "fourth" {
+		t.Errorf("unexpected batch %q", batch)
+	}
+
+	//overlong lines are split, unterminated last line is sent at the end
+	go func() {
+		_, _ = writer.Write([]byte(strings.Repeat("x", maxLogLineBytes+10) + "\nlast"))
+		_ = writer.Close()
+	}()
+	lines := make([]string, 0)
+	for len(lines) < 3 {
+		lines = append(lines, <-batches...)
+	}
+	if len(lines[0]) != maxLogLineBytes || len(lines[1]) != 10 || lines[2] != "last" {
+		t.Errorf("unexpected lines of length %d, %d", len(lines[0]), len(lines[1]))
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStreamLogLinesJoined(t *testing.T) {
+	//parts of lines longer than the read buffer are joined up to given size
+	logs := strings.Repeat("x", maxLogLineBytes*2+10) + "\n" + strings.Repeat("y", maxLogLineBytes*4) + "\nlast\n"
+	lines := make([]string, 0)
+	err := streamLogLines(context.Background(), strings.NewReader(logs), maxLogLineBytes*3, func(batch []string) error {
+		lines = append(lines, batch...)
+		return nil
+	})
+	if err != nil || len(lines) != 4 {
+		t.Fatalf("unexpected %d lines, %v", len(lines), err)
+	}
+	if len(lines[0]) != maxLogLineBytes*2+10 || len(lines[1]) != maxLogLineBytes*3 || len(lines[2]) != maxLogLineBytes || lines[3] != "last" {
+		t.Errorf("unexpected lines of length %d, %d, %d", len(lines[0]), len(lines[1]), len(lines[2]))
+	}
+}
+
+func TestStreamLogLinesCancelled(t *testing.T) {
+	reader, writer := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- streamLogLines(ctx, reader, maxLogLineBytes, func(lines []string) error { return nil })
+	}()
+
+	cancel()
+	_ = writer.CloseWithError(context.Canceled)
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not stop")
+	}
+	if logStreamEndError(ctx, nil) == nil {
+		t.Fail()
+	}
+}
+
+func TestPodServiceServer_StreamPodLogs(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewPodServiceServer(client, nil, "")
+	stream := &podLogsStream{ctx: context.Background()}
+
+	//Fail on API version check
+	if err := server.StreamPodLogs(&v1.PodRequest{Api: "invalid"}, stream); err == nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	podReq := v1.PodRequest{Api: apiVersion, Pod: &v1.PodInfo{Name: "test-uid-pod"}, Deployment: &fake_ns_inst}
+	if err := server.StreamPodLogs(&podReq, stream); err == nil {
+		t.Fail()
+	}
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Fail on missing pod
+	podReq.Deployment = &inst
+	if err := server.StreamPodLogs(&podReq, stream); err == nil {
+		t.Fail()
+	}
+
+	p1 := corev1.Pod{}
+	p1.Name = "test-uid-pod"
+	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &p1, metav1.CreateOptions{})
+
+	//fake client returns static log and ends the stream
+	if err := server.StreamPodLogs(&podReq, stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(stream.sent) != 1 || stream.sent[0].Status != v1.Status_OK || len(stream.sent[0].Lines) != 1 {
+		t.Errorf("unexpected messages %v", stream.sent)
+	}
+}
+
+func TestPodLogOptions(t *testing.T) {
+	opts, err := podLogOptions(nil)
+	if err != nil || opts.TailLines != nil || opts.Previous {
+		t.Fail()
+	}
+
+	opts, err = podLogOptions(&v1.LogOptions{TailLines: 100, SinceTime: "2024-05-01T10:00:00Z", LimitBytes: 1024, Previous: true, Timestamps: true})
+	if err != nil || *opts.TailLines != 100 || opts.SinceSeconds != nil || !opts.SinceTime.Time.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) ||
+		*opts.LimitBytes != 1024 || !opts.Previous || !opts.Timestamps {
+		t.Errorf("unexpected options %v", opts)
+	}
+
+	for _, invalid := range []*v1.LogOptions{
+		{TailLines: -1},
+		{SinceSeconds: 60, SinceTime: "2024-05-01T10:00:00Z"},
+		{SinceTime: "yesterday"},
+	} {
+		if _, err = podLogOptions(invalid); err == nil {
+			t.Errorf("options %v should be rejected", invalid)
+		}
+	}
+}
+
+func TestMergeContainerLogs(t *testing.T) {
+	logs := []containerLogs{
+		{container: "app", lines: []string{"2024-05-01T10:00:01Z starting", "2024-05-01T10:00:03Z ready", "  continued"}},
+		{container: "proxy", lines: []string{"2024-05-01T10:00:02.5Z listening"}},
+	}
+
+	lines := mergeContainerLogs(logs, false)
+	expected := []string{"[app] starting", "[proxy] listening", "[app] ready", "[app]   continued"}
+	if strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Errorf("unexpected lines %q", lines)
+	}
+
+	lines = mergeContainerLogs(logs, true)
+	if len(lines) != 4 || lines[1] != "[proxy] 2024-05-01T10:00:02.5Z listening" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+}
+
+func TestPodServiceServer_RetrievePodLogsOfAllContainers(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewPodServiceServer(client, nil, "")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	p1 := corev1.Pod{}
+	p1.Name = "test-uid-pod"
+	p1.Spec.InitContainers = []corev1.Container{{Name: "init"}}
+	p1.Spec.Containers = []corev1.Container{{Name: "app"}, {Name: "proxy"}}
+	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &p1, metav1.CreateOptions{})
+
+	//Fail on invalid options
+	podReq := v1.PodRequest{Api: apiVersion, Pod: &v1.PodInfo{Name: "test-uid-pod"}, Deployment: &inst,
+		LogOptions: &v1.LogOptions{SinceSeconds: -5}}
+	res, err := server.RetrievePodLogs(context.Background(), &podReq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	podReq.LogOptions = &v1.LogOptions{AllContainers: true, TailLines: 10}
+	res, err = server.RetrievePodLogs(context.Background(), &podReq)
+	expected := []string{"[init] fake logs", "[app] fake logs", "[proxy] fake logs"}
+	if err != nil || res.Status != v1.Status_OK || strings.Join(res.Lines, "|") != strings.Join(expected, "|") {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	stream := &podLogsStream{ctx: context.Background()}
+	if err = server.StreamPodLogs(&podReq, stream); err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]string, 0)
+	for _, res := range stream.sent {
+		lines = append(lines, res.Lines...)
+	}
+	if len(lines) != 3 {
+		t.Errorf("unexpected lines %q", lines)
+	}
+	for _, line := range expected {
+		found := false
+		for _, l := range lines {
+			found = found || l == line
+		}
+		if !found {
+			t.Errorf("line %s not streamed", line)
+		}
+	}
+}
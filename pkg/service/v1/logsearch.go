@@ -0,0 +1,315 @@
+package v1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+const (
+	//Logs are searched within this window when neither sinceSeconds nor sinceTime is given
+	defaultSearchWindow = int64(3600)
+	//Number of container logs read at the same time
+	searchConcurrency = 4
+	defaultSearchMatches = 100
+	maxSearchMatches = 1000
+	maxSearchContextLines = 10
+	//Matching and context lines are cut to this length
+	maxSearchLineLength = 2048
+	//Lines are matched whole up to this size, longer lines are matched in parts of this size
+	maxSearchLineBytes = 1024 * 1024
+	searchTimeout = 2 * time.Minute
+)
+
+//Reading of container log stops once lines newer than the end of search window appear
+var errSearchWindowEnd = errors.New("end of search window reached")
+
+//Prepare log search response
+func prepareSearchLogsResponse(status v1.Status, message string, matches []*v1.LogMatch, truncated bool) *v1.SearchLogsResponse {
+	if matches == nil {
+		matches = make([]*v1.LogMatch, 0)
+	}
+	return &v1.SearchLogsResponse{
+		Api: apiVersion,
+		Status: status,
+		Message: message,
+		Matches: matches,
+		Truncated: truncated,
+	}
+}
+
+//Compile query into line matcher, either regular expression or plain substring
+func compileLogQuery(query string, regex bool, ignoreCase bool) (func(line string) bool, error) {
+	if len(query) == 0 {
+		return nil, errors.New("query must not be empty")
+	}
+	if regex {
+		if ignoreCase {
+			query = "(?i)" + query
+		}
+		//RE2 syntax guarantees matching in linear time
+		expression, err := regexp.Compile(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %s", err)
+		}
+		return expression.MatchString, nil
+	}
+	if ignoreCase {
+		query = strings.ToLower(query)
+		return func(line string) bool {
+			return strings.Contains(strings.ToLower(line), query)
+		}, nil
+	}
+	return func(line string) bool {
+		return strings.Contains(line, query)
+	}, nil
+}
+
+func truncateLogLine(line string) string {
+	if len(line) > maxSearchLineLength {
+		return line[:maxSearchLineLength]
+	}
+	return line
+}
+
+//Matches collected from all searched containers, search is cancelled once the limit is reached
+type searchResults struct {
+	mu sync.Mutex
+	matches []*v1.LogMatch
+	max int
+	truncated bool
+	failed int
+	cancel context.CancelFunc
+}
+
+func (r *searchResults) add(match *v1.LogMatch) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.matches) >= r.max {
+		r.truncated = true
+		r.cancel()
+		return false
+	}
+	r.matches = append(r.matches, match)
+	return true
+}
+
+func (r *searchResults) fail() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed++
+}
+
+//Search state of single container log, keeping preceding lines and matches still waiting for following lines
+type containerSearch struct {
+	pod string
+	container string
+	matches func(line string) bool
+	until *time.Time
+	contextLines int
+	results *searchResults
+	before []string
+	pending []*v1.LogMatch
+	timestamp string
+}
+
+//Process timestamped log lines, as passed by streamLogLines
+func (c *containerSearch) process(lines []string) error {
+	for _, line := range lines {
+		timestamp, text, ok := splitLogTimestamp(line)
+		if ok {
+			if c.until != nil && timestamp.After(*c.until) {
+				return errSearchWindowEnd
+			}
+			c.timestamp = timestamp.UTC().Format(time.RFC3339Nano)
+		}
+		//matching uses the whole line, only the reported copy is truncated
+		stored := truncateLogLine(text)
+
+		pending := c.pending[:0]
+		for _, match := range c.pending {
+			match.After = append(match.After, stored)
+			if len(match.After) < c.contextLines {
+				pending = append(pending, match)
+			}
+		}
+		c.pending = pending
+
+		if c.matches(text) {
+			match := &v1.LogMatch{
+				Pod: c.pod,
+				Container: c.container,
+				Timestamp: c.timestamp,
+				Line: stored,
+				Before: append(make([]string, 0, len(c.before)), c.before...),
+				After: make([]string, 0),
+			}
+			if !c.results.add(match) {
+				return context.Canceled
+			}
+			if c.contextLines > 0 {
+				c.pending = append(c.pending, match)
+			}
+		}
+
+		if c.contextLines > 0 {
+			if len(c.before) == c.contextLines {
+				c.before = c.before[1:]
+			}
+			c.before = append(c.before, stored)
+		}
+	}
+	return nil
+}
+
+//Keep only items present in filter, empty filter keeps everything
+func filterNames(names []string, filter []string) []string {
+	if len(filter) == 0 {
+		return names
+	}
+	allowed := make(map[string]bool, len(filter))
+	for _, name := range filter {
+		allowed[name] = true
+	}
+	filtered := make([]string, 0, len(names))
+	for _, name := range names {
+		if allowed[name] {
+			filtered = append(filtered, name)
+		}
+	}
+	return filtered
+}
+
+//Search logs of instance containers for lines matching the query. Lines longer than maxSearchLineBytes are matched in
+//parts, so a match spanning two parts of such line is not found.
+func (s *podServiceServer) SearchLogs(ctx context.Context, req *v1.SearchLogsRequest) (*v1.SearchLogsResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Instance
+	logLine(fmt.Sprintf("> Searching logs of instance %s in namespace %s", depl.Uid, depl.Namespace))
+
+	matches, err := compileLogQuery(req.Query, req.Regex, req.IgnoreCase)
+	if err != nil {
+		return prepareSearchLogsResponse(v1.Status_FAILED, err.Error(), nil, false), status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+	window := &v1.LogOptions{SinceSeconds: req.SinceSeconds, SinceTime: req.SinceTime}
+	if req.SinceSeconds == 0 && len(req.SinceTime) == 0 {
+		window.SinceSeconds = defaultSearchWindow
+	}
+	opts, err := podLogOptions(window)
+	if err != nil {
+		return prepareSearchLogsResponse(v1.Status_FAILED, err.Error(), nil, false), status.Errorf(codes.InvalidArgument, "%s", err)
+	}
+	//timestamps of lines are reported with matches and used to end search window
+	opts.Timestamps = true
+	var until *time.Time
+	if len(req.UntilTime) > 0 {
+		parsed, err := time.Parse(time.RFC3339, req.UntilTime)
+		if err != nil {
+			message := fmt.Sprintf("untilTime '%s' is not a valid RFC 3339 timestamp", req.UntilTime)
+			return prepareSearchLogsResponse(v1.Status_FAILED, message, nil, false), status.Errorf(codes.InvalidArgument, "%s", message)
+		}
+		until = &parsed
+	}
+
+	contextLines := int(req.ContextLines)
+	if contextLines < 0 {
+		contextLines = 0
+	} else if contextLines > maxSearchContextLines {
+		contextLines = maxSearchContextLines
+	}
+	maxMatches := int(req.MaxMatches)
+	if maxMatches <= 0 {
+		maxMatches = defaultSearchMatches
+	} else if maxMatches > maxSearchMatches {
+		maxMatches = maxSearchMatches
+	}
+
+	//check if given k8s namespace exists
+	_, err = s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareSearchLogsResponse(v1.Status_FAILED, namespaceNotFound, nil, false), err
+	}
+
+	pods, err := findInstancePodsBySelector(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareSearchLogsResponse(v1.Status_FAILED, "Issue with collecting pods", nil, false), err
+	}
+	podFilter := make(map[string]bool)
+	for _, name := range req.Pods {
+		podFilter[name] = true
+	}
+
+	searchCtx, cancel := context.WithTimeout(ctx, searchTimeout)
+	defer cancel()
+	results := &searchResults{matches: make([]*v1.LogMatch, 0), max: maxMatches, cancel: cancel}
+	semaphore := make(chan struct{}, searchConcurrency)
+	var wg sync.WaitGroup
+	searched := 0
+	for i := range pods {
+		pod := &pods[i]
+		if len(podFilter) > 0 && !podFilter[pod.Name] {
+			continue
+		}
+		for _, container := range filterNames(logContainers(pod, nil, true), req.Containers) {
+			searched++
+			wg.Add(1)
+			go func(pod *apiv1.Pod, container string) {
+				defer wg.Done()
+				select {
+				case semaphore <- struct{}{}:
+					defer func() { <-semaphore }()
+				case <-searchCtx.Done():
+					return
+				}
+
+				search := &containerSearch{pod: pod.Name, container: container, matches: matches, until: until,
+					contextLines: contextLines, results: results, before: make([]string, 0, contextLines)}
+				containerOpts := opts
+				containerOpts.Container = container
+				err := s.streamContainerLogs(searchCtx, depl.Namespace, pod.Name, containerOpts, maxSearchLineBytes, search.process)
+				if err != nil && err != errSearchWindowEnd && searchCtx.Err() == nil {
+					logLine(fmt.Sprintf("Could not search logs of pod/container %s/%s: %s", pod.Name, container, err))
+					results.fail()
+				}
+			}(pod, container)
+		}
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		logLine("< Log search cancelled by client")
+		return nil, status.Errorf(codes.Canceled, "log search cancelled by client")
+	}
+
+	message := fmt.Sprintf("Found %d match(es) in logs of %d container(s)", len(results.matches), searched)
+	if searchCtx.Err() == context.DeadlineExceeded {
+		results.truncated = true
+		message += ", search timed out before all logs were read"
+	}
+	if results.failed > 0 {
+		message += fmt.Sprintf(", %d log(s) could not be read", results.failed)
+	}
+
+	sort.SliceStable(results.matches, func(i, j int) bool {
+		a, _ := time.Parse(time.RFC3339Nano, results.matches[i].Timestamp)
+		b, _ := time.Parse(time.RFC3339Nano, results.matches[j].Timestamp)
+		return a.Before(b)
+	})
+	logLine("< " + message)
+	return prepareSearchLogsResponse(v1.Status_OK, message, results.matches, results.truncated), nil
+}
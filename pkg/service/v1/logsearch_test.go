@@ -0,0 +1,181 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileLogQuery(t *testing.T) {
+	tests := []struct {
+		query      string
+		regex      bool
+		ignoreCase bool
+		line       string
+		expected   bool
+	}{
+		{"error", false, false, "an error occurred", true},
+		{"ERROR", false, false, "an error occurred", false},
+		{"ERROR", false, true, "an error occurred", true},
+		{"status=5\\d\\d", true, false, "GET / status=503", true},
+		{"status=5\\d\\d", true, false, "GET / status=200", false},
+		{"timeout|refused", true, true, "Connection REFUSED", true},
+	}
+	for _, test := range tests {
+		matches, err := compileLogQuery(test.query, test.regex, test.ignoreCase)
+		if err != nil || matches(test.line) != test.expected {
+			t.Errorf("unexpected result of query '%s' for line '%s'", test.query, test.line)
+		}
+	}
+
+	for _, invalid := range []string{"", "("} {
+		if _, err := compileLogQuery(invalid, true, false); err == nil {
+			t.Errorf("query '%s' should be rejected", invalid)
+		}
+	}
+}
+
+func TestContainerSearch(t *testing.T) {
+	until := time.Date(2024, 5, 1, 10, 0, 10, 0, time.UTC)
+	matches, _ := compileLogQuery("error", false, false)
+	results := &searchResults{max: 10, cancel: func() {}}
+	search := &containerSearch{pod: "test-uid-web", container: "app", matches: matches, until: &until, contextLines: 2, results: results}
+
+	err := search.process([]string{
+		"2024-05-01T10:00:01Z one",
+		"2024-05-01T10:00:02Z two",
+		"2024-05-01T10:00:03Z three",
+		"2024-05-01T10:00:04Z first error",
+		"2024-05-01T10:00:05Z five",
+		"2024-05-01T10:00:06Z second error",
+		"2024-05-01T10:00:07Z seven",
+		"2024-05-01T10:00:08Z " + strings.Repeat("x", maxSearchLineLength+1),
+	})
+	if err != nil || len(results.matches) != 2 {
+		t.Fatal(err, results.matches)
+	}
+
+	first := results.matches[0]
+	if first.Pod != "test-uid-web" || first.Container != "app" || first.Timestamp != "2024-05-01T10:00:04Z" || first.Line != "first error" ||
+		strings.Join(first.Before, "|") != "two|three" || strings.Join(first.After, "|") != "five|second error" {
+		t.Errorf("unexpected match %v", first)
+	}
+	second := results.matches[1]
+	if strings.Join(second.Before, "|") != "first error|five" || len(second.After) != 2 || len(second.After[1]) != maxSearchLineLength {
+		t.Errorf("unexpected match %v", second)
+	}
+
+	//lines after the end of search window stop reading
+	if search.process([]string{"2024-05-01T10:00:11Z late error"}) != errSearchWindowEnd || len(results.matches) != 2 {
+		t.Fail()
+	}
+
+	//search stops once the limit of matches is reached
+	results.max = 2
+	search.until = nil
+	if search.process([]string{"2024-05-01T10:00:12Z third error"}) == nil || !results.truncated {
+		t.Fail()
+	}
+
+	//match past the length limit is found, reported line is truncated
+	results = &searchResults{max: 10, cancel: func() {}}
+	search = &containerSearch{pod: "test-uid-web", container: "app", matches: matches, results: results}
+	err = search.process([]string{"2024-05-01T10:00:13Z " + strings.Repeat("x", maxSearchLineLength) + " late error"})
+	if err != nil || len(results.matches) != 1 || len(results.matches[0].Line) != maxSearchLineLength {
+		t.Errorf("unexpected matches %v", results.matches)
+	}
+}
+
+func TestContainerSearchLongLine(t *testing.T) {
+	matches, _ := compileLogQuery("boundary error", false, false)
+	results := &searchResults{max: 10, cancel: func() {}}
+	search := &containerSearch{pod: "test-uid-web", container: "app", matches: matches, results: results}
+
+	//query spans the read buffer boundary, the line is matched whole and reported once
+	prefix := "2024-05-01T10:00:01Z "
+	line := prefix + strings.Repeat("x", maxLogLineBytes-len(prefix)-len("boundary")) + "boundary error " + strings.Repeat("y", maxLogLineBytes)
+	err := streamLogLines(context.Background(), strings.NewReader(line+"\n"), maxSearchLineBytes, search.process)
+	if err != nil || len(results.matches) != 1 || results.matches[0].Timestamp != "2024-05-01T10:00:01Z" {
+		t.Errorf("unexpected matches %v, %v", results.matches, err)
+	}
+}
+
+func TestPodServiceServer_SearchLogs(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewPodServiceServer(client, nil, "")
+
+	//Fail on API version check
+	res, err := server.SearchLogs(context.Background(), &v1.SearchLogsRequest{Api: "invalid"})
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on invalid query
+	sreq := v1.SearchLogsRequest{Api: apiVersion, Instance: &inst, Query: "(", Regex: true}
+	res, err = server.SearchLogs(context.Background(), &sreq)
+	if status.Code(err) != codes.InvalidArgument || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	sreq = v1.SearchLogsRequest{Api: apiVersion, Instance: &fake_ns_inst, Query: "fake"}
+	res, err = server.SearchLogs(context.Background(), &sreq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	for _, name := range []string{"test-uid-web", "test-uid-worker"} {
+		pod := corev1.Pod{}
+		pod.Name = name
+		pod.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+		pod.Spec.Containers = []corev1.Container{{Name: "app"}, {Name: "proxy"}}
+		_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &pod, metav1.CreateOptions{})
+	}
+
+	//fake client returns the same log line for every container
+	sreq.Instance = &inst
+	res, err = server.SearchLogs(context.Background(), &sreq)
+	if err != nil || res.Status != v1.Status_OK || len(res.Matches) != 4 || res.Truncated {
+		t.Fatal(err, res)
+	}
+
+	sreq.Pods = []string{"test-uid-web"}
+	sreq.Containers = []string{"proxy"}
+	res, err = server.SearchLogs(context.Background(), &sreq)
+	if err != nil || len(res.Matches) != 1 || res.Matches[0].Pod != "test-uid-web" || res.Matches[0].Container != "proxy" {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	sreq.Pods = nil
+	sreq.Containers = nil
+	sreq.MaxMatches = 2
+	res, err = server.SearchLogs(context.Background(), &sreq)
+	if err != nil || len(res.Matches) != 2 || !res.Truncated {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	sreq.Query = "no such line"
+	res, err = server.SearchLogs(context.Background(), &sreq)
+	if err != nil || res.Status != v1.Status_OK || len(res.Matches) != 0 {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	//cancelled search returns no partial results
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err = server.SearchLogs(ctx, &sreq)
+	if status.Code(err) != codes.Canceled || res != nil {
+		t.Errorf("unexpected response %v, %v", res, err)
+	}
+}
@@ -0,0 +1,56 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+//Maximum time spent listing secrets on a single scrape
+const metricsScrapeTimeout = 20 * time.Second
+
+var certificateExpiryDesc = prometheus.NewDesc(
+	"nmaas_janitor_certificate_expiry_days",
+	"Number of days until certificate stored in instance TLS secret expires",
+	[]string{"namespace", "secret", "subject"}, nil,
+)
+
+//Collector reporting expiry of certificates in instance TLS secrets, evaluated on every scrape
+type certificateExpiryCollector struct {
+	kubeAPI kubernetes.Interface
+}
+
+func NewCertificateExpiryCollector(kubeAPI kubernetes.Interface) prometheus.Collector {
+	return &certificateExpiryCollector{kubeAPI: kubeAPI}
+}
+
+func (c *certificateExpiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certificateExpiryDesc
+}
+
+func (c *certificateExpiryCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsScrapeTimeout)
+	defer cancel()
+
+	secrets, err := findCertificateSecrets(ctx, c.kubeAPI, "")
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(certificateExpiryDesc, err)
+		return
+	}
+
+	now := time.Now()
+	for i := range secrets {
+		leaf, err := parseCertificateChain(secrets[i].Data[apiv1.TLSCertKey])
+		if err != nil {
+			logLine(fmt.Sprintf("Skipping secret %s/%s: %s", secrets[i].Namespace, secrets[i].Name, err))
+			continue
+		}
+		//fractional days let alerts fire at exact thresholds
+		days := leaf[0].NotAfter.Sub(now).Hours() / 24
+		ch <- prometheus.MustNewConstMetric(certificateExpiryDesc, prometheus.GaugeValue, days,
+			secrets[i].Namespace, secrets[i].Name, leaf[0].Subject.String())
+	}
+}
@@ -0,0 +1,40 @@
+package v1
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCertificateExpiryCollector(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	root := newTestCertificate(t, "Test Root CA", nil, time.Now().Add(365*24*time.Hour), nil)
+	leaf := newTestCertificate(t, "app.example.org", []string{"app.example.org"}, time.Now().Add(30*24*time.Hour), root)
+	createTestCertificateSecret(t, client, "test-namespace", "test-uid-tls", leaf)
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(NewCertificateExpiryCollector(client))
+
+	families, err := registry.Gather()
+	if err != nil || len(families) != 1 || len(families[0].Metric) != 1 {
+		t.Fatal(err)
+	}
+	if families[0].GetName() != "nmaas_janitor_certificate_expiry_days" || families[0].GetType() != dto.MetricType_GAUGE {
+		t.Fail()
+	}
+
+	metric := families[0].Metric[0]
+	if math.Abs(metric.GetGauge().GetValue()-30) > 0.01 {
+		t.Errorf("unexpected expiry %f", metric.GetGauge().GetValue())
+	}
+	labels := make(map[string]string)
+	for _, l := range metric.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["namespace"] != "test-namespace" || labels["secret"] != "test-uid-tls" || labels["subject"] != leaf.certificate.Subject.String() {
+		t.Fail()
+	}
+}
@@ -0,0 +1,236 @@
+package v1
+
+import (
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"time"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+//Workloads of the instance, grouped by kind
+type workloadSet struct {
+	deployments []*appsv1.Deployment
+	statefulSets []*appsv1.StatefulSet
+	daemonSets []*appsv1.DaemonSet
+	jobs []*batchv1.Job
+}
+
+//Find workloads labelled with the instance, as well as Deployment or StatefulSet named after it.
+//Workloads created by Janitor itself, like oauth2-proxy, are skipped.
+func findInstanceWorkloads(ctx context.Context, kubeAPI kubernetes.Interface, namespace string, uid string, label string) (*workloadSet, error) {
+	options := metav1.ListOptions{LabelSelector: label + "=" + uid}
+	workloads := &workloadSet{}
+
+	deployments, err := kubeAPI.AppsV1().Deployments(namespace).List(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	named := false
+	for i := range deployments.Items {
+		if isManagedByJanitor(&deployments.Items[i]) {
+			continue
+		}
+		named = named || deployments.Items[i].Name == uid
+		workloads.deployments = append(workloads.deployments, &deployments.Items[i])
+	}
+	if !named {
+		if dep, err := kubeAPI.AppsV1().Deployments(namespace).Get(ctx, uid, metav1.GetOptions{}); err == nil && !isManagedByJanitor(dep) {
+			workloads.deployments = append(workloads.deployments, dep)
+		}
+	}
+
+	statefulSets, err := kubeAPI.AppsV1().StatefulSets(namespace).List(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	named = false
+	for i := range statefulSets.Items {
+		if isManagedByJanitor(&statefulSets.Items[i]) {
+			continue
+		}
+		named = named || statefulSets.Items[i].Name == uid
+		workloads.statefulSets = append(workloads.statefulSets, &statefulSets.Items[i])
+	}
+	if !named {
+		if sts, err := kubeAPI.AppsV1().StatefulSets(namespace).Get(ctx, uid, metav1.GetOptions{}); err == nil && !isManagedByJanitor(sts) {
+			workloads.statefulSets = append(workloads.statefulSets, sts)
+		}
+	}
+
+	daemonSets, err := kubeAPI.AppsV1().DaemonSets(namespace).List(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	for i := range daemonSets.Items {
+		if isManagedByJanitor(&daemonSets.Items[i]) {
+			continue
+		}
+		workloads.daemonSets = append(workloads.daemonSets, &daemonSets.Items[i])
+	}
+
+	jobs, err := kubeAPI.BatchV1().Jobs(namespace).List(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	for i := range jobs.Items {
+		if isManagedByJanitor(&jobs.Items[i]) {
+			continue
+		}
+		workloads.jobs = append(workloads.jobs, &jobs.Items[i])
+	}
+	return workloads, nil
+}
+
+//Collect pod selectors of instance workloads
+func instanceWorkloadSelectors(ctx context.Context, kubeAPI kubernetes.Interface, namespace string, uid string, label string) ([]*metav1.LabelSelector, error) {
+	workloads, err := findInstanceWorkloads(ctx, kubeAPI, namespace, uid, label)
+	if err != nil {
+		return nil, err
+	}
+
+	selectors := make([]*metav1.LabelSelector, 0)
+	for _, dep := range workloads.deployments {
+		selectors = append(selectors, dep.Spec.Selector)
+	}
+	for _, sts := range workloads.statefulSets {
+		selectors = append(selectors, sts.Spec.Selector)
+	}
+	for _, ds := range workloads.daemonSets {
+		selectors = append(selectors, ds.Spec.Selector)
+	}
+	for _, job := range workloads.jobs {
+		selectors = append(selectors, job.Spec.Selector)
+	}
+	return selectors, nil
+}
+
+//Find pods of the instance through selectors of its workloads and the instance label, sorted by name
+func findInstancePodsBySelector(ctx context.Context, kubeAPI kubernetes.Interface, namespace string, uid string, label string) ([]apiv1.Pod, error) {
+	workloadSelectors, err := instanceWorkloadSelectors(ctx, kubeAPI, namespace, uid, label)
+	if err != nil {
+		return nil, err
+	}
+
+	selectors := []string{labels.SelectorFromSet(labels.Set{label: uid}).String()}
+	seen := map[string]bool{selectors[0]: true}
+	for _, workloadSelector := range workloadSelectors {
+		selector, err := metav1.LabelSelectorAsSelector(workloadSelector)
+		//empty selector would match every pod in the namespace
+		if err != nil || selector.Empty() {
+			continue
+		}
+		if !seen[selector.String()] {
+			seen[selector.String()] = true
+			selectors = append(selectors, selector.String())
+		}
+	}
+
+	pods := make([]apiv1.Pod, 0)
+	found := make(map[string]bool)
+	for _, selector := range selectors {
+		list, err := kubeAPI.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range list.Items {
+			if isManagedByJanitor(&pod) {
+				continue
+			}
+			if !found[pod.Name] {
+				found[pod.Name] = true
+				pods = append(pods, pod)
+			}
+		}
+	}
+
+	sort.Slice(pods, func(i, j int) bool {
+		return pods[i].Name < pods[j].Name
+	})
+	return pods, nil
+}
+
+//Describe container using its spec and status, status is missing until container is created
+func describeContainer(name string, image string, containerType v1.ContainerType, status *apiv1.ContainerStatus) *v1.ContainerInfo {
+	info := &v1.ContainerInfo{Name: name, Type: containerType, Image: image, State: "waiting"}
+	if status == nil {
+		return info
+	}
+
+	info.Ready = status.Ready
+	info.RestartCount = status.RestartCount
+	switch {
+	case status.State.Running != nil:
+		info.State = "running"
+	case status.State.Terminated != nil:
+		info.State = "terminated"
+		info.StateReason = status.State.Terminated.Reason
+	case status.State.Waiting != nil:
+		info.StateReason = status.State.Waiting.Reason
+	}
+	if terminated := status.LastTerminationState.Terminated; terminated != nil {
+		info.LastTerminationReason = terminated.Reason
+		info.LastTerminationExitCode = terminated.ExitCode
+		if !terminated.FinishedAt.IsZero() {
+			info.LastTerminationTime = terminated.FinishedAt.UTC().Format(time.RFC3339)
+		}
+	}
+	return info
+}
+
+func containerStatusesByName(statuses []apiv1.ContainerStatus) map[string]*apiv1.ContainerStatus {
+	byName := make(map[string]*apiv1.ContainerStatus, len(statuses))
+	for i := range statuses {
+		byName[statuses[i].Name] = &statuses[i]
+	}
+	return byName
+}
+
+//Describe pod with status of its init, regular and ephemeral containers
+func describePod(pod *apiv1.Pod) *v1.PodInfo {
+	info := &v1.PodInfo{
+		Name: pod.Name,
+		DisplayName: pod.Name,
+		Containers: make([]string, 0, len(pod.Spec.Containers)),
+		Phase: string(pod.Status.Phase),
+		NodeName: pod.Spec.NodeName,
+		PodIp: pod.Status.PodIP,
+		ContainerStatuses: make([]*v1.ContainerInfo, 0),
+	}
+	if pod.Status.StartTime != nil {
+		info.StartTime = pod.Status.StartTime.UTC().Format(time.RFC3339)
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodReady {
+			info.Ready = condition.Status == apiv1.ConditionTrue
+		}
+	}
+
+	initStatuses := containerStatusesByName(pod.Status.InitContainerStatuses)
+	for _, container := range pod.Spec.InitContainers {
+		info.ContainerStatuses = append(info.ContainerStatuses, describeContainer(container.Name, container.Image, v1.ContainerType_INIT_CONTAINER, initStatuses[container.Name]))
+	}
+	statuses := containerStatusesByName(pod.Status.ContainerStatuses)
+	for _, container := range pod.Spec.Containers {
+		info.Containers = append(info.Containers, container.Name)
+		info.ContainerStatuses = append(info.ContainerStatuses, describeContainer(container.Name, container.Image, v1.ContainerType_REGULAR_CONTAINER, statuses[container.Name]))
+	}
+	ephemeralStatuses := containerStatusesByName(pod.Status.EphemeralContainerStatuses)
+	for _, container := range pod.Spec.EphemeralContainers {
+		info.ContainerStatuses = append(info.ContainerStatuses, describeContainer(container.Name, container.Image, v1.ContainerType_EPHEMERAL_CONTAINER, ephemeralStatuses[container.Name]))
+	}
+
+	//restarts of debugging containers are not restarts of the pod
+	for _, container := range info.ContainerStatuses {
+		if container.Type != v1.ContainerType_EPHEMERAL_CONTAINER {
+			info.RestartCount += container.RestartCount
+		}
+	}
+	return info
+}
@@ -0,0 +1,120 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func createTestPod(t *testing.T, client *testclient.Clientset, name string, labels map[string]string) {
+	pod := corev1.Pod{}
+	pod.Name = name
+	pod.Labels = labels
+	if _, err := client.CoreV1().Pods("test-namespace").Create(context.Background(), &pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPodServiceServer_RetrievePodListWithWorkloadSelectors(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewPodServiceServer(client, nil, "nmaas.io/instance")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//deployment named after the instance selecting pods of differently named sub-chart
+	depl := appsv1.Deployment{}
+	depl.Name = "test-uid"
+	depl.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "grafana", "release": "test-uid"}}
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &depl, metav1.CreateOptions{})
+
+	//labelled job selecting its pods by controller uid
+	job := batchv1.Job{}
+	job.Name = "migrate"
+	job.Labels = map[string]string{"nmaas.io/instance": "test-uid"}
+	job.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"controller-uid": "1234"}}
+	_, _ = client.BatchV1().Jobs("test-namespace").Create(context.Background(), &job, metav1.CreateOptions{})
+
+	//labelled daemonset with empty selector must not select every pod
+	ds := appsv1.DaemonSet{}
+	ds.Name = "agent"
+	ds.Labels = map[string]string{"nmaas.io/instance": "test-uid"}
+	ds.Spec.Selector = &metav1.LabelSelector{}
+	_, _ = client.AppsV1().DaemonSets("test-namespace").Create(context.Background(), &ds, metav1.CreateOptions{})
+
+	createTestPod(t, client, "grafana-7d9f", map[string]string{"app": "grafana", "release": "test-uid"})
+	createTestPod(t, client, "migrate-x2k4", map[string]string{"controller-uid": "1234"})
+	createTestPod(t, client, "sidecar", map[string]string{"nmaas.io/instance": "test-uid", "app": "grafana", "release": "test-uid"})
+	//pod of another instance with uid sharing the prefix
+	createTestPod(t, client, "test-uid-2-web", map[string]string{"nmaas.io/instance": "test-uid-2", "app": "grafana"})
+
+	res, err := server.RetrievePodList(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || len(res.Pods) != 3 {
+		t.Fatal(err, res)
+	}
+	for i, name := range []string{"grafana-7d9f", "migrate-x2k4", "sidecar"} {
+		if res.Pods[i].Name != name {
+			t.Errorf("unexpected pod %s", res.Pods[i].Name)
+		}
+	}
+}
+
+func TestDescribePod(t *testing.T) {
+	started := metav1.NewTime(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	pod := corev1.Pod{}
+	pod.Name = "test-uid-web-0"
+	pod.Spec.NodeName = "worker-1"
+	pod.Spec.InitContainers = []corev1.Container{{Name: "migrate", Image: "app:1.0"}}
+	pod.Spec.Containers = []corev1.Container{{Name: "web", Image: "nginx:1.25"}, {Name: "exporter", Image: "exporter:0.3"}}
+	pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "busybox"}}}
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.PodIP = "10.244.1.7"
+	pod.Status.StartTime = &started
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionFalse}}
+	pod.Status.InitContainerStatuses = []corev1.ContainerStatus{{Name: "migrate", RestartCount: 1,
+		State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Completed"}}}}
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{Name: "web", Ready: true, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+		{Name: "exporter", RestartCount: 4,
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+			LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "OOMKilled", ExitCode: 137, FinishedAt: started}}},
+	}
+	pod.Status.EphemeralContainerStatuses = []corev1.ContainerStatus{{Name: "debugger", RestartCount: 2}}
+
+	info := describePod(&pod)
+	if info.Phase != "Running" || info.Ready || info.NodeName != "worker-1" || info.PodIp != "10.244.1.7" ||
+		info.StartTime != "2024-05-01T10:00:00Z" || info.RestartCount != 5 || len(info.Containers) != 2 || len(info.ContainerStatuses) != 4 {
+		t.Fatalf("unexpected pod info %v", info)
+	}
+
+	expected := []struct {
+		name   string
+		ctype  v1.ContainerType
+		state  string
+		reason string
+	}{
+		{"migrate", v1.ContainerType_INIT_CONTAINER, "terminated", "Completed"},
+		{"web", v1.ContainerType_REGULAR_CONTAINER, "running", ""},
+		{"exporter", v1.ContainerType_REGULAR_CONTAINER, "waiting", "CrashLoopBackOff"},
+		{"debugger", v1.ContainerType_EPHEMERAL_CONTAINER, "waiting", ""},
+	}
+	for i, e := range expected {
+		c := info.ContainerStatuses[i]
+		if c.Name != e.name || c.Type != e.ctype || c.State != e.state || c.StateReason != e.reason {
+			t.Errorf("unexpected container %v", c)
+		}
+	}
+
+	exporter := info.ContainerStatuses[2]
+	if exporter.Image != "exporter:0.3" || exporter.RestartCount != 4 || exporter.LastTerminationReason != "OOMKilled" ||
+		exporter.LastTerminationExitCode != 137 || exporter.LastTerminationTime != "2024-05-01T10:00:00Z" {
+		t.Errorf("unexpected container %v", exporter)
+	}
+}
@@ -0,0 +1,573 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+//Prepare readiness response
+func prepareReadinessResponse(status v1.Status, message string, workloads []*v1.WorkloadStatus) *v1.ReadinessResponse {
+	if workloads == nil {
+		workloads = make([]*v1.WorkloadStatus, 0)
+	}
+	return &v1.ReadinessResponse {
+		Api: apiVersion,
+		Status: status,
+		Message: message,
+		Workloads: workloads,
+		PodProblems: make([]*v1.PodProblem, 0),
+		WarningEvents: make([]*v1.EventInfo, 0),
+	}
+}
+
+func workloadStatus(kind string, name string, status v1.Status, message string) *v1.WorkloadStatus {
+	return &v1.WorkloadStatus{Kind: kind, Name: name, Status: status, Message: message, Conditions: make([]*v1.WorkloadCondition, 0)}
+}
+
+func workloadCondition(conditionType string, status apiv1.ConditionStatus, reason string, message string) *v1.WorkloadCondition {
+	return &v1.WorkloadCondition{Type: conditionType, Status: string(status), Reason: reason, Message: message}
+}
+
+func setReplicas(status *v1.WorkloadStatus, desired int32, updated int32, ready int32, available int32) {
+	status.DesiredReplicas = desired
+	status.UpdatedReplicas = updated
+	status.ReadyReplicas = ready
+	status.AvailableReplicas = available
+}
+
+//Number of desired replicas, API server defaults missing value to one
+func desiredReplicas(replicas *int32) int32 {
+	if replicas == nil {
+		return 1
+	}
+	return *replicas
+}
+
+//Rollout status of Deployment, following kubectl rollout status
+func deploymentStatus(dep *appsv1.Deployment) *v1.WorkloadStatus {
+	status := deploymentRolloutStatus(dep)
+	setReplicas(status, desiredReplicas(dep.Spec.Replicas), dep.Status.UpdatedReplicas, dep.Status.ReadyReplicas, dep.Status.AvailableReplicas)
+	for _, c := range dep.Status.Conditions {
+		status.Conditions = append(status.Conditions, workloadCondition(string(c.Type), c.Status, c.Reason, c.Message))
+	}
+	return status
+}
+
+func deploymentRolloutStatus(dep *appsv1.Deployment) *v1.WorkloadStatus {
+	pending := func(format string, args ...interface{}) *v1.WorkloadStatus {
+		return workloadStatus("Deployment", dep.Name, v1.Status_PENDING, fmt.Sprintf(format, args...))
+	}
+
+	if isSuspended(dep, dep.Spec.Replicas) {
+		return workloadStatus("Deployment", dep.Name, v1.Status_SUSPENDED, "Deployment is suspended")
+	}
+	if dep.Generation > dep.Status.ObservedGeneration {
+		return pending("Waiting for deployment spec update to be observed")
+	}
+	for _, c := range dep.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Reason == "ProgressDeadlineExceeded" {
+			return workloadStatus("Deployment", dep.Name, v1.Status_FAILED, fmt.Sprintf("Deployment exceeded its progress deadline: %s", c.Message))
+		}
+	}
+
+	desired := desiredReplicas(dep.Spec.Replicas)
+	if dep.Status.UpdatedReplicas < desired {
+		return pending("%d out of %d new replicas have been updated", dep.Status.UpdatedReplicas, desired)
+	}
+	if dep.Status.Replicas > dep.Status.UpdatedReplicas {
+		return pending("%d old replicas are pending termination", dep.Status.Replicas-dep.Status.UpdatedReplicas)
+	}
+	if dep.Status.AvailableReplicas < dep.Status.UpdatedReplicas {
+		return pending("%d of %d updated replicas are available", dep.Status.AvailableReplicas, dep.Status.UpdatedReplicas)
+	}
+	if desired == 0 {
+		return workloadStatus("Deployment", dep.Name, v1.Status_OK, "Deployment is scaled to zero")
+	}
+	return workloadStatus("Deployment", dep.Name, v1.Status_OK, "Deployment is ready")
+}
+
+//Rollout status of StatefulSet, following kubectl rollout status
+func statefulSetStatus(sts *appsv1.StatefulSet) *v1.WorkloadStatus {
+	status := statefulSetRolloutStatus(sts)
+	setReplicas(status, desiredReplicas(sts.Spec.Replicas), sts.Status.UpdatedReplicas, sts.Status.ReadyReplicas, sts.Status.AvailableReplicas)
+	for _, c := range sts.Status.Conditions {
+		status.Conditions = append(status.Conditions, workloadCondition(string(c.Type), c.Status, c.Reason, c.Message))
+	}
+	return status
+}
+
+func statefulSetRolloutStatus(sts *appsv1.StatefulSet) *v1.WorkloadStatus {
+	pending := func(format string, args ...interface{}) *v1.WorkloadStatus {
+		return workloadStatus("StatefulSet", sts.Name, v1.Status_PENDING, fmt.Sprintf(format, args...))
+	}
+
+	if isSuspended(sts, sts.Spec.Replicas) {
+		return workloadStatus("StatefulSet", sts.Name, v1.Status_SUSPENDED, "StatefulSet is suspended")
+	}
+	if sts.Generation > sts.Status.ObservedGeneration {
+		return pending("Waiting for statefulset spec update to be observed")
+	}
+	desired := desiredReplicas(sts.Spec.Replicas)
+	if sts.Status.ReadyReplicas < desired {
+		return pending("%d of %d replicas ready", sts.Status.ReadyReplicas, desired)
+	}
+	if sts.Status.Replicas > desired {
+		return pending("%d replicas are pending termination", sts.Status.Replicas-desired)
+	}
+	if desired == 0 {
+		return workloadStatus("StatefulSet", sts.Name, v1.Status_OK, "StatefulSet is scaled to zero")
+	}
+
+	//OnDelete strategy updates pods only when they are deleted, so there is no rollout to wait for
+	if sts.Spec.UpdateStrategy.Type == appsv1.RollingUpdateStatefulSetStrategyType || len(sts.Spec.UpdateStrategy.Type) == 0 {
+		rollingUpdate := sts.Spec.UpdateStrategy.RollingUpdate
+		if rollingUpdate != nil && rollingUpdate.Partition != nil && *rollingUpdate.Partition > 0 {
+			expected := desired - *rollingUpdate.Partition
+			if expected > 0 && sts.Status.UpdatedReplicas < expected {
+				return pending("Waiting for partitioned roll out to finish: %d out of %d new pods have been updated", sts.Status.UpdatedReplicas, expected)
+			}
+		} else if sts.Status.UpdateRevision != sts.Status.CurrentRevision {
+			return pending("Waiting for rolling update to complete: %d out of %d new pods have been updated", sts.Status.UpdatedReplicas, desired)
+		}
+	}
+	return workloadStatus("StatefulSet", sts.Name, v1.Status_OK, "StatefulSet is ready")
+}
+
+//Rollout status of DaemonSet, following kubectl rollout status
+func daemonSetStatus(ds *appsv1.DaemonSet) *v1.WorkloadStatus {
+	status := daemonSetRolloutStatus(ds)
+	setReplicas(status, ds.Status.DesiredNumberScheduled, ds.Status.UpdatedNumberScheduled, ds.Status.NumberReady, ds.Status.NumberAvailable)
+	for _, c := range ds.Status.Conditions {
+		status.Conditions = append(status.Conditions, workloadCondition(string(c.Type), c.Status, c.Reason, c.Message))
+	}
+	return status
+}
+
+func daemonSetRolloutStatus(ds *appsv1.DaemonSet) *v1.WorkloadStatus {
+	pending := func(format string, args ...interface{}) *v1.WorkloadStatus {
+		return workloadStatus("DaemonSet", ds.Name, v1.Status_PENDING, fmt.Sprintf(format, args...))
+	}
+
+	if _, found := ds.Annotations[suspendedReplicasAnnotation]; found {
+		return workloadStatus("DaemonSet", ds.Name, v1.Status_SUSPENDED, "DaemonSet is suspended")
+	}
+	if ds.Generation > ds.Status.ObservedGeneration {
+		return pending("Waiting for daemon set spec update to be observed")
+	}
+	desired := ds.Status.DesiredNumberScheduled
+	//OnDelete strategy updates pods only when they are deleted, so there is no rollout to wait for
+	if ds.Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType && ds.Status.UpdatedNumberScheduled < desired {
+		return pending("%d out of %d new pods have been updated", ds.Status.UpdatedNumberScheduled, desired)
+	}
+	if ds.Status.NumberAvailable < desired {
+		return pending("%d of %d updated pods are available", ds.Status.NumberAvailable, desired)
+	}
+	return workloadStatus("DaemonSet", ds.Name, v1.Status_OK, "DaemonSet is ready")
+}
+
+func jobStatus(job *batchv1.Job) *v1.WorkloadStatus {
+	status := jobCompletionStatus(job)
+	for _, c := range job.Status.Conditions {
+		status.Conditions = append(status.Conditions, workloadCondition(string(c.Type), c.Status, c.Reason, c.Message))
+	}
+	return status
+}
+
+func jobCompletionStatus(job *batchv1.Job) *v1.WorkloadStatus {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != apiv1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return workloadStatus("Job", job.Name, v1.Status_OK, "Job completed")
+		case batchv1.JobFailed:
+			return workloadStatus("Job", job.Name, v1.Status_FAILED, fmt.Sprintf("Job failed: %s", condition.Message))
+		}
+	}
+	return workloadStatus("Job", job.Name, v1.Status_PENDING,
+		fmt.Sprintf("%d active, %d succeeded, %d failed pods", job.Status.Active, job.Status.Succeeded, job.Status.Failed))
+}
+
+func persistentVolumeClaimStatus(pvc *apiv1.PersistentVolumeClaim) *v1.WorkloadStatus {
+	switch pvc.Status.Phase {
+	case apiv1.ClaimBound:
+		return workloadStatus("PersistentVolumeClaim", pvc.Name, v1.Status_OK, "Claim is bound")
+	case apiv1.ClaimLost:
+		return workloadStatus("PersistentVolumeClaim", pvc.Name, v1.Status_FAILED, "Claim lost its volume")
+	}
+	return workloadStatus("PersistentVolumeClaim", pvc.Name, v1.Status_PENDING, "Waiting for volume to be bound")
+}
+
+//Check if job was created by a CronJob, such jobs do not take part in instance readiness
+func ownedByCronJob(object metav1.Object) bool {
+	for _, owner := range object.GetOwnerReferences() {
+		if owner.Kind == "CronJob" {
+			return true
+		}
+	}
+	return false
+}
+
+//Evaluate status of every workload of the instance and of persistent volume claims labelled with it
+func collectWorkloadStatuses(ctx context.Context, kubeAPI kubernetes.Interface, namespace string, uid string, label string) ([]*v1.WorkloadStatus, error) {
+	workloads, err := findInstanceWorkloads(ctx, kubeAPI, namespace, uid, label)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*v1.WorkloadStatus, 0)
+	for _, dep := range workloads.deployments {
+		statuses = append(statuses, deploymentStatus(dep))
+	}
+	for _, sts := range workloads.statefulSets {
+		statuses = append(statuses, statefulSetStatus(sts))
+	}
+	for _, ds := range workloads.daemonSets {
+		statuses = append(statuses, daemonSetStatus(ds))
+	}
+	for _, job := range workloads.jobs {
+		if !ownedByCronJob(job) {
+			statuses = append(statuses, jobStatus(job))
+		}
+	}
+
+	claims, err := kubeAPI.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{LabelSelector: label + "=" + uid})
+	if err != nil {
+		return nil, err
+	}
+	for i := range claims.Items {
+		statuses = append(statuses, persistentVolumeClaimStatus(&claims.Items[i]))
+	}
+	return statuses, nil
+}
+
+//Aggregate workload statuses, any failure fails the instance, suspended workloads mark it suspended
+//and any pending workload keeps it pending
+func aggregateWorkloadStatuses(statuses []*v1.WorkloadStatus) (v1.Status, string) {
+	failed := make([]string, 0)
+	suspended := make([]string, 0)
+	pending := make([]string, 0)
+	for _, s := range statuses {
+		switch s.Status {
+		case v1.Status_FAILED:
+			failed = append(failed, s.Kind + " " + s.Name)
+		case v1.Status_SUSPENDED:
+			suspended = append(suspended, s.Kind + " " + s.Name)
+		case v1.Status_PENDING:
+			pending = append(pending, s.Kind + " " + s.Name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return v1.Status_FAILED, "Failed: " + strings.Join(failed, ", ")
+	}
+	if len(suspended) > 0 {
+		return v1.Status_SUSPENDED, "Suspended: " + strings.Join(suspended, ", ")
+	}
+	if len(pending) > 0 {
+		return v1.Status_PENDING, "Waiting for " + strings.Join(pending, ", ")
+	}
+	return v1.Status_OK, fmt.Sprintf("All %d workload(s) ready", len(statuses))
+}
+
+const (
+	//Warning events older than this are not reported as readiness diagnostics
+	recentEventsWindow = time.Hour
+	maxReportedEvents = 20
+)
+
+//Container waiting reasons indicating that pod will not become ready without intervention
+var stuckContainerReasons = map[string]bool{
+	"CrashLoopBackOff": true,
+	"ImagePullBackOff": true,
+	"ErrImagePull": true,
+	"InvalidImageName": true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError": true,
+	"RunContainerError": true,
+}
+
+//Describe problems of pods stuck in CrashLoopBackOff, image pull errors or Pending phase
+func diagnosePods(pods []apiv1.Pod) []*v1.PodProblem {
+	problems := make([]*v1.PodProblem, 0)
+	for _, pod := range pods {
+		found := false
+		statuses := append(append([]apiv1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, cs := range statuses {
+			if cs.State.Waiting != nil && stuckContainerReasons[cs.State.Waiting.Reason] {
+				message := cs.State.Waiting.Message
+				if cs.LastTerminationState.Terminated != nil && len(message) == 0 {
+					message = fmt.Sprintf("Last termination: %s (exit code %d)",
+						cs.LastTerminationState.Terminated.Reason, cs.LastTerminationState.Terminated.ExitCode)
+				}
+				problems = append(problems, &v1.PodProblem{Pod: pod.Name, Container: cs.Name, Phase: string(pod.Status.Phase),
+					Reason: cs.State.Waiting.Reason, Message: message})
+				found = true
+			}
+		}
+		if found || pod.Status.Phase != apiv1.PodPending {
+			continue
+		}
+
+		problem := &v1.PodProblem{Pod: pod.Name, Phase: string(pod.Status.Phase), Reason: "Pending"}
+		for _, c := range pod.Status.Conditions {
+			if c.Type == apiv1.PodScheduled && c.Status == apiv1.ConditionFalse {
+				problem.Reason = c.Reason
+				problem.Message = c.Message
+			}
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+//Time of the last occurrence of the event
+func eventTime(event *apiv1.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+func eventInfo(event *apiv1.Event) *v1.EventInfo {
+	count := event.Count
+	if event.Series != nil && event.Series.Count > count {
+		count = event.Series.Count
+	}
+	first := event.FirstTimestamp.Time
+	if first.IsZero() {
+		first = eventTime(event)
+	}
+	return &v1.EventInfo{
+		Type: event.Type,
+		Reason: event.Reason,
+		Message: event.Message,
+		InvolvedKind: event.InvolvedObject.Kind,
+		InvolvedName: event.InvolvedObject.Name,
+		Count: count,
+		LastTimestamp: eventTime(event).UTC().Format(time.RFC3339),
+		FirstTimestamp: first.UTC().Format(time.RFC3339),
+	}
+}
+
+//Find recent Warning events of the namespace, newest first
+func recentWarningEvents(ctx context.Context, kubeAPI kubernetes.Interface, namespace string, now time.Time) ([]*v1.EventInfo, error) {
+	list, err := kubeAPI.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{FieldSelector: "type=" + apiv1.EventTypeWarning})
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]apiv1.Event, 0)
+	for _, event := range list.Items {
+		if event.Type == apiv1.EventTypeWarning && now.Sub(eventTime(&event)) <= recentEventsWindow {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return eventTime(&events[i]).After(eventTime(&events[j]))
+	})
+	if len(events) > maxReportedEvents {
+		events = events[:maxReportedEvents]
+	}
+
+	infos := make([]*v1.EventInfo, 0, len(events))
+	for i := range events {
+		infos = append(infos, eventInfo(&events[i]))
+	}
+	return infos, nil
+}
+
+const (
+	defaultWatchTimeout = 10 * time.Minute
+	maxWatchTimeout = time.Hour
+	//Periodic re-evaluation covers changes not visible through watched objects, e.g. aging events
+	watchResyncPeriod = 30 * time.Second
+)
+
+//Timeout of readiness watch requested by client, bounded by server maximum
+func watchTimeout(seconds int32) time.Duration {
+	if seconds <= 0 {
+		return defaultWatchTimeout
+	}
+	timeout := time.Duration(seconds) * time.Second
+	if timeout > maxWatchTimeout {
+		return maxWatchTimeout
+	}
+	return timeout
+}
+
+//Watch all kinds of objects taking part in instance readiness, merged into single channel.
+//Channel is closed as soon as any of the watches is closed by API server, so that caller can restart them.
+func watchReadinessObjects(ctx context.Context, kubeAPI kubernetes.Interface, namespace string) (<-chan metav1.Object, func(), error) {
+	starters := []func() (watch.Interface, error){
+		func() (watch.Interface, error) { return kubeAPI.AppsV1().Deployments(namespace).Watch(ctx, metav1.ListOptions{}) },
+		func() (watch.Interface, error) { return kubeAPI.AppsV1().StatefulSets(namespace).Watch(ctx, metav1.ListOptions{}) },
+		func() (watch.Interface, error) { return kubeAPI.AppsV1().DaemonSets(namespace).Watch(ctx, metav1.ListOptions{}) },
+		func() (watch.Interface, error) { return kubeAPI.BatchV1().Jobs(namespace).Watch(ctx, metav1.ListOptions{}) },
+		func() (watch.Interface, error) { return kubeAPI.CoreV1().PersistentVolumeClaims(namespace).Watch(ctx, metav1.ListOptions{}) },
+		func() (watch.Interface, error) { return kubeAPI.CoreV1().Pods(namespace).Watch(ctx, metav1.ListOptions{}) },
+	}
+
+	watchers := make([]watch.Interface, 0, len(starters))
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			for _, w := range watchers {
+				w.Stop()
+			}
+		})
+	}
+	for _, start := range starters {
+		w, err := start()
+		if err != nil {
+			stop()
+			return nil, nil, err
+		}
+		watchers = append(watchers, w)
+	}
+
+	changes := make(chan metav1.Object)
+	var wg sync.WaitGroup
+	for _, w := range watchers {
+		wg.Add(1)
+		go func(w watch.Interface) {
+			defer wg.Done()
+			defer stop()
+			for event := range w.ResultChan() {
+				object, ok := event.Object.(metav1.Object)
+				if !ok {
+					continue
+				}
+				select {
+				case changes <- object:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(w)
+	}
+	go func() {
+		wg.Wait()
+		close(changes)
+	}()
+	return changes, stop, nil
+}
+
+func (s *readinessServiceServer) WatchReadiness(req *v1.WatchReadinessRequest, stream v1.ReadinessService_WatchReadinessServer) error {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return err
+	}
+
+	depl := req.Instance
+	timeout := watchTimeout(req.TimeoutSeconds)
+	logLine(fmt.Sprintf("> Watching readiness of deployment:%s in namespace:%s for %s", depl.Uid, depl.Namespace, timeout))
+
+	ctx, cancel := context.WithTimeout(stream.Context(), timeout)
+	defer cancel()
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	var last *v1.ReadinessResponse
+	//send current readiness if it changed, reporting whether watch should end.
+	//Suspended and failed instances do not become ready without further action, so the watch ends on them as well.
+	update := func() (bool, error) {
+		res, found, err := s.evaluateReadiness(ctx, depl)
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			//workloads may not have been created yet
+			res.Status = v1.Status_PENDING
+			res.Message = "Waiting for workloads to be created"
+		}
+		if last == nil || !proto.Equal(last, res) {
+			if err = stream.Send(res); err != nil {
+				return false, err
+			}
+			last = res
+		}
+		return isFinalReadinessStatus(res.Status), nil
+	}
+
+	resync := time.NewTicker(watchResyncPeriod)
+	defer resync.Stop()
+	for {
+		//watches are started before evaluation so that no change is missed in between
+		changes, stop, err := watchReadinessObjects(ctx, s.kubeAPI, depl.Namespace)
+		if err != nil {
+			return watchEndError(ctx, err)
+		}
+
+		finished, err := update()
+		watching := true
+		for watching && err == nil && !finished {
+			select {
+			case object, ok := <-changes:
+				if !ok {
+					logLine("watch closed, restarting")
+					watching = false
+				} else if belongsToInstance(object, depl.Uid, s.instanceLabel) {
+					finished, err = update()
+				}
+			case <-resync.C:
+				finished, err = update()
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		stop()
+		//let watch goroutines finish
+		go func(changes <-chan metav1.Object) {
+			for range changes {
+			}
+		}(changes)
+
+		if err != nil {
+			return watchEndError(ctx, err)
+		}
+		if finished {
+			logLine(fmt.Sprintf("< instance %s", strings.ToLower(last.Status.String())))
+			return nil
+		}
+	}
+}
+
+//Check if readiness status ends the watch
+func isFinalReadinessStatus(status v1.Status) bool {
+	return status == v1.Status_OK || status == v1.Status_SUSPENDED || status == v1.Status_FAILED
+}
+
+//Translate error ending readiness watch into gRPC status
+func watchEndError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return status.Errorf(codes.DeadlineExceeded, "instance did not become ready in time")
+	case context.Canceled:
+		return status.Errorf(codes.Canceled, "watch cancelled by client")
+	}
+	return err
+}
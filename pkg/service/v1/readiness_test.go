@@ -0,0 +1,575 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+	"time"
+)
+
+var instanceLabels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+
+func TestReadinessServiceServer_CheckIfReadyWithLabelledWorkloads(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewReadinessServiceServer(client, "")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//create mock workloads with different names, all labelled with the instance
+	depl := appsv1.Deployment{}
+	depl.Name = "test-uid-web"
+	depl.Labels = instanceLabels
+	depl.Status.UpdatedReplicas = 1
+	depl.Status.ReadyReplicas = 1
+	depl.Status.AvailableReplicas = 1
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &depl, metav1.CreateOptions{})
+
+	ds := appsv1.DaemonSet{}
+	ds.Name = "test-uid-agent"
+	ds.Labels = instanceLabels
+	ds.Status.DesiredNumberScheduled = 3
+	ds.Status.UpdatedNumberScheduled = 3
+	ds.Status.NumberReady = 2
+	ds.Status.NumberAvailable = 2
+	_, _ = client.AppsV1().DaemonSets("test-namespace").Create(context.Background(), &ds, metav1.CreateOptions{})
+
+	job := batchv1.Job{}
+	job.Name = "test-uid-init-db"
+	job.Labels = instanceLabels
+	job.Status.Active = 1
+	_, _ = client.BatchV1().Jobs("test-namespace").Create(context.Background(), &job, metav1.CreateOptions{})
+
+	pvc := corev1.PersistentVolumeClaim{}
+	pvc.Name = "data-test-uid-0"
+	pvc.Labels = instanceLabels
+	pvc.Status.Phase = corev1.ClaimBound
+	_, _ = client.CoreV1().PersistentVolumeClaims("test-namespace").Create(context.Background(), &pvc, metav1.CreateOptions{})
+
+	//workloads of other instances are ignored
+	other := appsv1.Deployment{}
+	other.Name = "other-uid"
+	other.Labels = map[string]string{"app.kubernetes.io/instance": "other-uid"}
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &other, metav1.CreateOptions{})
+
+	res, err := server.CheckIfReady(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_PENDING || len(res.Workloads) != 4 {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Message, "DaemonSet test-uid-agent") || !strings.Contains(res.Message, "Job test-uid-init-db") {
+		t.Errorf("unexpected message %s", res.Message)
+	}
+
+	//complete daemonset and job
+	ds.Status.NumberReady = 3
+	ds.Status.NumberAvailable = 3
+	_, _ = client.AppsV1().DaemonSets("test-namespace").Update(context.Background(), &ds, metav1.UpdateOptions{})
+	job.Status.Active = 0
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	_, _ = client.BatchV1().Jobs("test-namespace").Update(context.Background(), &job, metav1.UpdateOptions{})
+
+	res, err = server.CheckIfReady(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	for _, w := range res.Workloads {
+		if w.Status != v1.Status_OK {
+			t.Errorf("%s %s not ready", w.Kind, w.Name)
+		}
+	}
+
+	//failed job fails the instance
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Message: "BackoffLimitExceeded"}}
+	_, _ = client.BatchV1().Jobs("test-namespace").Update(context.Background(), &job, metav1.UpdateOptions{})
+
+	res, err = server.CheckIfReady(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+}
+
+func TestWorkloadStatuses(t *testing.T) {
+	cronJob := batchv1.Job{}
+	cronJob.OwnerReferences = []metav1.OwnerReference{{Kind: "CronJob", Name: "backup"}}
+	if !ownedByCronJob(&cronJob) {
+		t.Fail()
+	}
+
+	pvc := corev1.PersistentVolumeClaim{}
+	pvc.Status.Phase = corev1.ClaimPending
+	if persistentVolumeClaimStatus(&pvc).Status != v1.Status_PENDING {
+		t.Fail()
+	}
+	pvc.Status.Phase = corev1.ClaimLost
+	if persistentVolumeClaimStatus(&pvc).Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//DaemonSet without matching nodes has nothing to wait for
+	ds := appsv1.DaemonSet{}
+	if daemonSetStatus(&ds).Status != v1.Status_OK {
+		t.Fail()
+	}
+
+	status, _ := aggregateWorkloadStatuses([]*v1.WorkloadStatus{
+		workloadStatus("Deployment", "a", v1.Status_PENDING, ""),
+		workloadStatus("Job", "b", v1.Status_FAILED, ""),
+	})
+	if status != v1.Status_FAILED {
+		t.Fail()
+	}
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func TestDeploymentRolloutStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		replicas   *int32
+		generation int64
+		status     appsv1.DeploymentStatus
+		expected   v1.Status
+		message    string
+	}{
+		{"nil replicas defaults to one", nil, 1,
+			appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 1, UpdatedReplicas: 1, ReadyReplicas: 1, AvailableReplicas: 1}, v1.Status_OK, "ready"},
+		{"nil replicas not yet available", nil, 1,
+			appsv1.DeploymentStatus{ObservedGeneration: 1}, v1.Status_PENDING, "0 out of 1 new replicas"},
+		{"scaled to zero", int32Ptr(0), 2,
+			appsv1.DeploymentStatus{ObservedGeneration: 2}, v1.Status_OK, "scaled to zero"},
+		{"scaled to zero with terminating pods", int32Ptr(0), 2,
+			appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 1}, v1.Status_PENDING, "pending termination"},
+		{"spec update not observed", int32Ptr(2), 3,
+			appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 2, UpdatedReplicas: 2, ReadyReplicas: 2, AvailableReplicas: 2}, v1.Status_PENDING, "to be observed"},
+		{"rollout in progress", int32Ptr(3), 2,
+			appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 1, ReadyReplicas: 3, AvailableReplicas: 3}, v1.Status_PENDING, "1 out of 3 new replicas"},
+		{"old replicas terminating", int32Ptr(3), 2,
+			appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 4, UpdatedReplicas: 3, ReadyReplicas: 4, AvailableReplicas: 4}, v1.Status_PENDING, "1 old replicas"},
+		{"updated replicas not available", int32Ptr(3), 2,
+			appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 3, ReadyReplicas: 3, AvailableReplicas: 2}, v1.Status_PENDING, "2 of 3 updated replicas"},
+		{"progress deadline exceeded", int32Ptr(1), 1,
+			appsv1.DeploymentStatus{ObservedGeneration: 1, Replicas: 1, Conditions: []appsv1.DeploymentCondition{
+				{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Reason: "ProgressDeadlineExceeded"}}}, v1.Status_FAILED, "progress deadline"},
+		{"complete", int32Ptr(3), 2,
+			appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 3, ReadyReplicas: 3, AvailableReplicas: 3}, v1.Status_OK, "ready"},
+	}
+
+	for _, test := range tests {
+		dep := appsv1.Deployment{}
+		dep.Name = "test-uid"
+		dep.Generation = test.generation
+		dep.Spec.Replicas = test.replicas
+		dep.Status = test.status
+		res := deploymentStatus(&dep)
+		if res.Status != test.expected || !strings.Contains(res.Message, test.message) {
+			t.Errorf("%s: unexpected status %v", test.name, res)
+		}
+	}
+}
+
+func TestStatefulSetRolloutStatus(t *testing.T) {
+	onDelete := appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}
+	partitioned := appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType,
+		RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: int32Ptr(2)}}
+
+	tests := []struct {
+		name       string
+		replicas   *int32
+		generation int64
+		strategy   appsv1.StatefulSetUpdateStrategy
+		status     appsv1.StatefulSetStatus
+		expected   v1.Status
+		message    string
+	}{
+		{"nil replicas defaults to one", nil, 1, appsv1.StatefulSetUpdateStrategy{},
+			appsv1.StatefulSetStatus{ObservedGeneration: 1, Replicas: 1, ReadyReplicas: 1}, v1.Status_OK, "ready"},
+		{"nil replicas not yet ready", nil, 1, appsv1.StatefulSetUpdateStrategy{},
+			appsv1.StatefulSetStatus{ObservedGeneration: 1}, v1.Status_PENDING, "0 of 1 replicas"},
+		{"scaled to zero", int32Ptr(0), 1, appsv1.StatefulSetUpdateStrategy{},
+			appsv1.StatefulSetStatus{ObservedGeneration: 1}, v1.Status_OK, "scaled to zero"},
+		{"scaled to zero with terminating pods", int32Ptr(0), 1, appsv1.StatefulSetUpdateStrategy{},
+			appsv1.StatefulSetStatus{ObservedGeneration: 1, Replicas: 1}, v1.Status_PENDING, "pending termination"},
+		{"spec update not observed", int32Ptr(1), 2, appsv1.StatefulSetUpdateStrategy{},
+			appsv1.StatefulSetStatus{ObservedGeneration: 1, Replicas: 1, ReadyReplicas: 1}, v1.Status_PENDING, "to be observed"},
+		{"rolling update in progress", int32Ptr(2), 1, appsv1.StatefulSetUpdateStrategy{},
+			appsv1.StatefulSetStatus{ObservedGeneration: 1, Replicas: 2, ReadyReplicas: 2, UpdatedReplicas: 1, CurrentRevision: "a", UpdateRevision: "b"}, v1.Status_PENDING, "rolling update"},
+		{"partitioned rollout in progress", int32Ptr(4), 1, partitioned,
+			appsv1.StatefulSetStatus{ObservedGeneration: 1, Replicas: 4, ReadyReplicas: 4, UpdatedReplicas: 1, CurrentRevision: "a", UpdateRevision: "b"}, v1.Status_PENDING, "partitioned"},
+		{"partitioned rollout finished", int32Ptr(4), 1, partitioned,
+			appsv1.StatefulSetStatus{ObservedGeneration: 1, Replicas: 4, ReadyReplicas: 4, UpdatedReplicas: 2, CurrentRevision: "a", UpdateRevision: "b"}, v1.Status_OK, "ready"},
+		{"on delete strategy ignores revisions", int32Ptr(2), 1, onDelete,
+			appsv1.StatefulSetStatus{ObservedGeneration: 1, Replicas: 2, ReadyReplicas: 2, CurrentRevision: "a", UpdateRevision: "b"}, v1.Status_OK, "ready"},
+		{"complete", int32Ptr(2), 1, appsv1.StatefulSetUpdateStrategy{},
+			appsv1.StatefulSetStatus{ObservedGeneration: 1, Replicas: 2, ReadyReplicas: 2, UpdatedReplicas: 2, CurrentRevision: "b", UpdateRevision: "b"}, v1.Status_OK, "ready"},
+	}
+
+	for _, test := range tests {
+		sts := appsv1.StatefulSet{}
+		sts.Name = "test-uid"
+		sts.Generation = test.generation
+		sts.Spec.Replicas = test.replicas
+		sts.Spec.UpdateStrategy = test.strategy
+		sts.Status = test.status
+		res := statefulSetStatus(&sts)
+		if res.Status != test.expected || !strings.Contains(res.Message, test.message) {
+			t.Errorf("%s: unexpected status %v", test.name, res)
+		}
+	}
+}
+
+func TestDaemonSetRolloutStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		generation int64
+		strategy   appsv1.DaemonSetUpdateStrategyType
+		status     appsv1.DaemonSetStatus
+		expected   v1.Status
+		message    string
+	}{
+		{"no matching nodes", 1, "",
+			appsv1.DaemonSetStatus{ObservedGeneration: 1}, v1.Status_OK, "ready"},
+		{"spec update not observed", 2, "",
+			appsv1.DaemonSetStatus{ObservedGeneration: 1, DesiredNumberScheduled: 1, UpdatedNumberScheduled: 1, NumberReady: 1, NumberAvailable: 1}, v1.Status_PENDING, "to be observed"},
+		{"rollout in progress", 1, appsv1.RollingUpdateDaemonSetStrategyType,
+			appsv1.DaemonSetStatus{ObservedGeneration: 1, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 1, NumberReady: 3, NumberAvailable: 3}, v1.Status_PENDING, "1 out of 3"},
+		{"on delete strategy ignores updated pods", 1, appsv1.OnDeleteDaemonSetStrategyType,
+			appsv1.DaemonSetStatus{ObservedGeneration: 1, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 1, NumberReady: 3, NumberAvailable: 3}, v1.Status_OK, "ready"},
+		{"pods not available", 1, appsv1.RollingUpdateDaemonSetStrategyType,
+			appsv1.DaemonSetStatus{ObservedGeneration: 1, DesiredNumberScheduled: 3, UpdatedNumberScheduled: 3, NumberReady: 3, NumberAvailable: 2}, v1.Status_PENDING, "2 of 3"},
+	}
+
+	for _, test := range tests {
+		ds := appsv1.DaemonSet{}
+		ds.Name = "test-uid"
+		ds.Generation = test.generation
+		ds.Spec.UpdateStrategy.Type = test.strategy
+		ds.Status = test.status
+		res := daemonSetStatus(&ds)
+		if res.Status != test.expected || !strings.Contains(res.Message, test.message) {
+			t.Errorf("%s: unexpected status %v", test.name, res)
+		}
+	}
+}
+
+func TestReadinessServiceServer_CheckIfReadyDiagnostics(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewReadinessServiceServer(client, "")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	depl := appsv1.Deployment{}
+	depl.Name = "test-uid"
+	q := int32(3)
+	depl.Spec.Replicas = &q
+	depl.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	depl.Status.UpdatedReplicas = 3
+	depl.Status.ReadyReplicas = 1
+	depl.Status.AvailableReplicas = 1
+	depl.Status.Conditions = []appsv1.DeploymentCondition{
+		{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionTrue, Reason: "ReplicaSetUpdated"},
+	}
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &depl, metav1.CreateOptions{})
+
+	crashing := corev1.Pod{}
+	crashing.Name = "test-uid-5d8f-abcde"
+	crashing.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	crashing.Status.Phase = corev1.PodRunning
+	crashing.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		Name: "app",
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+		LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Error", ExitCode: 1}},
+	}}
+	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &crashing, metav1.CreateOptions{})
+
+	pulling := corev1.Pod{}
+	pulling.Name = "test-uid-5d8f-fghij"
+	//selected through deployment selector only
+	pulling.Labels = map[string]string{"app": "web"}
+	pulling.Status.Phase = corev1.PodPending
+	pulling.Status.InitContainerStatuses = []corev1.ContainerStatus{{
+		Name: "init",
+		State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"}},
+	}}
+	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &pulling, metav1.CreateOptions{})
+
+	unschedulable := corev1.Pod{}
+	unschedulable.Name = "test-uid-5d8f-klmno"
+	unschedulable.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	unschedulable.Status.Phase = corev1.PodPending
+	unschedulable.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionFalse,
+		Reason: "Unschedulable", Message: "0/3 nodes are available: 3 Insufficient memory."}}
+	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &unschedulable, metav1.CreateOptions{})
+
+	//pod of another instance whose uid starts with the same characters
+	other := corev1.Pod{}
+	other.Name = "test-uid-2-5d8f-uvwxy"
+	other.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid-2"}
+	other.Status.Phase = corev1.PodPending
+	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &other, metav1.CreateOptions{})
+
+	healthy := corev1.Pod{}
+	healthy.Name = "test-uid-5d8f-pqrst"
+	healthy.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+	healthy.Status.Phase = corev1.PodRunning
+	_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &healthy, metav1.CreateOptions{})
+
+	recent := corev1.Event{}
+	recent.Name = "recent"
+	recent.Type = corev1.EventTypeWarning
+	recent.Reason = "BackOff"
+	recent.Count = 12
+	recent.InvolvedObject = corev1.ObjectReference{Kind: "Pod", Name: crashing.Name}
+	recent.LastTimestamp = metav1.Now()
+	_, _ = client.CoreV1().Events("test-namespace").Create(context.Background(), &recent, metav1.CreateOptions{})
+
+	old := corev1.Event{}
+	old.Name = "old"
+	old.Type = corev1.EventTypeWarning
+	old.LastTimestamp = metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	_, _ = client.CoreV1().Events("test-namespace").Create(context.Background(), &old, metav1.CreateOptions{})
+
+	normal := corev1.Event{}
+	normal.Name = "normal"
+	normal.Type = corev1.EventTypeNormal
+	normal.LastTimestamp = metav1.Now()
+	_, _ = client.CoreV1().Events("test-namespace").Create(context.Background(), &normal, metav1.CreateOptions{})
+
+	res, err := server.CheckIfReady(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_PENDING || len(res.Workloads) != 1 {
+		t.Fatal(err)
+	}
+
+	w := res.Workloads[0]
+	if w.DesiredReplicas != 3 || w.UpdatedReplicas != 3 || w.ReadyReplicas != 1 || w.AvailableReplicas != 1 ||
+		len(w.Conditions) != 1 || w.Conditions[0].Reason != "ReplicaSetUpdated" {
+		t.Errorf("unexpected workload status %v", w)
+	}
+
+	reasons := make(map[string]*v1.PodProblem)
+	for _, p := range res.PodProblems {
+		reasons[p.Reason] = p
+	}
+	if len(res.PodProblems) != 3 || reasons["CrashLoopBackOff"] == nil || reasons["ImagePullBackOff"] == nil || reasons["Unschedulable"] == nil {
+		t.Fatalf("unexpected pod problems %v", res.PodProblems)
+	}
+	if !strings.Contains(reasons["CrashLoopBackOff"].Message, "exit code 1") || reasons["ImagePullBackOff"].Container != "init" ||
+		!strings.Contains(reasons["Unschedulable"].Message, "Insufficient memory") {
+		t.Fail()
+	}
+
+	if len(res.WarningEvents) != 1 || res.WarningEvents[0].Reason != "BackOff" || res.WarningEvents[0].Count != 12 ||
+		res.WarningEvents[0].InvolvedName != crashing.Name {
+		t.Errorf("unexpected events %v", res.WarningEvents)
+	}
+
+	//no diagnostics once ready
+	depl.Status.ReadyReplicas = 3
+	depl.Status.AvailableReplicas = 3
+	_, _ = client.AppsV1().Deployments("test-namespace").Update(context.Background(), &depl, metav1.UpdateOptions{})
+	res, err = server.CheckIfReady(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || len(res.PodProblems) != 0 || len(res.WarningEvents) != 0 {
+		t.Fail()
+	}
+}
+
+//Server stream collecting sent readiness responses
+type readinessStream struct {
+	grpc.ServerStream
+	ctx context.Context
+	sent chan *v1.ReadinessResponse
+}
+
+func newReadinessStream(ctx context.Context) *readinessStream {
+	return &readinessStream{ctx: ctx, sent: make(chan *v1.ReadinessResponse, 100)}
+}
+
+func (s *readinessStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *readinessStream) Send(res *v1.ReadinessResponse) error {
+	s.sent <- res
+	return nil
+}
+
+func (s *readinessStream) next(t *testing.T) *v1.ReadinessResponse {
+	select {
+	case res := <-s.sent:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("no readiness update received")
+	}
+	return nil
+}
+
+func TestWatchTimeout(t *testing.T) {
+	if watchTimeout(0) != defaultWatchTimeout || watchTimeout(30) != 30*time.Second || watchTimeout(100000) != maxWatchTimeout {
+		t.Fail()
+	}
+}
+
+func TestReadinessServiceServer_WatchReadiness(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewReadinessServiceServer(client, "")
+	wreq := v1.WatchReadinessRequest{Api: apiVersion, Instance: &inst, TimeoutSeconds: 10}
+
+	//Fail on API version check
+	err := server.WatchReadiness(&v1.WatchReadinessRequest{Api: "illegal", Instance: &inst}, newReadinessStream(context.Background()))
+	if err == nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	err = server.WatchReadiness(&wreq, newReadinessStream(context.Background()))
+	if err == nil {
+		t.Fail()
+	}
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	stream := newReadinessStream(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.WatchReadiness(&wreq, stream)
+	}()
+
+	//Pending until workloads are created
+	res := stream.next(t)
+	if res.Status != v1.Status_PENDING || len(res.Workloads) != 0 {
+		t.Errorf("unexpected update %v", res)
+	}
+
+	depl := appsv1.Deployment{}
+	depl.Name = "test-uid"
+	q := int32(2)
+	depl.Spec.Replicas = &q
+	depl.Status.UpdatedReplicas = q
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &depl, metav1.CreateOptions{})
+
+	res = stream.next(t)
+	if res.Status != v1.Status_PENDING || len(res.Workloads) != 1 || res.Workloads[0].ReadyReplicas != 0 {
+		t.Errorf("unexpected update %v", res)
+	}
+
+	//unrelated objects do not produce updates
+	other := appsv1.Deployment{}
+	other.Name = "other-uid"
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &other, metav1.CreateOptions{})
+
+	depl.Status.ReadyReplicas = 1
+	depl.Status.AvailableReplicas = 1
+	_, _ = client.AppsV1().Deployments("test-namespace").Update(context.Background(), &depl, metav1.UpdateOptions{})
+	res = stream.next(t)
+	if res.Status != v1.Status_PENDING || res.Workloads[0].ReadyReplicas != 1 {
+		t.Errorf("unexpected update %v", res)
+	}
+
+	//Finish once ready
+	depl.Status.ReadyReplicas = 2
+	depl.Status.AvailableReplicas = 2
+	_, _ = client.AppsV1().Deployments("test-namespace").Update(context.Background(), &depl, metav1.UpdateOptions{})
+	res = stream.next(t)
+	if res.Status != v1.Status_OK {
+		t.Errorf("unexpected update %v", res)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not finish")
+	}
+}
+
+func TestReadinessServiceServer_WatchReadinessEnds(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	server := NewReadinessServiceServer(client, "")
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Fail on timeout
+	err := server.WatchReadiness(&v1.WatchReadinessRequest{Api: apiVersion, Instance: &inst, TimeoutSeconds: 1}, newReadinessStream(context.Background()))
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	//Stop on client cancel
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := newReadinessStream(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- server.WatchReadiness(&v1.WatchReadinessRequest{Api: apiVersion, Instance: &inst}, stream)
+	}()
+	stream.next(t)
+	cancel()
+	select {
+	case err = <-done:
+		if status.Code(err) != codes.Canceled {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not stop")
+	}
+
+	//Finish on suspended instance, it does not become ready by itself
+	depl := appsv1.Deployment{}
+	depl.Name = "test-uid"
+	depl.Spec.Replicas = int32Ptr(0)
+	depl.Annotations = map[string]string{suspendedReplicasAnnotation: "1"}
+	_, _ = client.AppsV1().Deployments("test-namespace").Create(context.Background(), &depl, metav1.CreateOptions{})
+	stream = newReadinessStream(context.Background())
+	go func() {
+		done <- server.WatchReadiness(&v1.WatchReadinessRequest{Api: apiVersion, Instance: &inst}, stream)
+	}()
+	if res := stream.next(t); res.Status != v1.Status_SUSPENDED {
+		t.Errorf("unexpected update %v", res)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not finish on suspended instance")
+	}
+
+	//Finish on failed instance
+	depl.Annotations = nil
+	depl.Spec.Replicas = int32Ptr(1)
+	depl.Status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Reason: "ProgressDeadlineExceeded"}}
+	_, _ = client.AppsV1().Deployments("test-namespace").Update(context.Background(), &depl, metav1.UpdateOptions{})
+	stream = newReadinessStream(context.Background())
+	go func() {
+		done <- server.WatchReadiness(&v1.WatchReadinessRequest{Api: apiVersion, Instance: &inst}, stream)
+	}()
+	if res := stream.next(t); res.Status != v1.Status_FAILED {
+		t.Errorf("unexpected update %v", res)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not finish on failed instance")
+	}
+}
@@ -0,0 +1,329 @@
+package v1
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"github.com/xanzy/go-gitlab"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"log"
+	"strconv"
+	"time"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+const (
+	repositoryAccessTypeAnnotation = "janitor.nmaas.eu/repository-access-type"
+	repositoryProjectIdAnnotation = "janitor.nmaas.eu/gitlab-project-id"
+	repositoryCredentialIdAnnotation = "janitor.nmaas.eu/gitlab-credential-id"
+	//GitLab does not accept project access tokens valid for longer than a year
+	accessTokenLifetimeDays = 364
+)
+
+type repositoryAccessServiceServer struct {
+	kubeAPI kubernetes.Interface
+	gitAPI *gitlab.Client
+}
+
+func NewRepositoryAccessServiceServer(kubeAPI kubernetes.Interface, gitAPI *gitlab.Client) v1.RepositoryAccessServiceServer {
+	return &repositoryAccessServiceServer{kubeAPI: kubeAPI, gitAPI: gitAPI}
+}
+
+func getRepositoryAccessSecretName(uid string) string {
+	return uid + "-git-access"
+}
+
+//Generate new ed25519 key pair, returning authorized_keys formatted public key and PEM encoded private key
+func generateDeployKeyPair(comment string) (string, []byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(ssh.MarshalAuthorizedKey(sshPub)), pem.EncodeToMemory(block), nil
+}
+
+//Issue read-only deploy key for the project and prepare secret holding its private part
+func (s *repositoryAccessServiceServer) issueDeployKey(project *gitlab.Project, uid string) (*apiv1.Secret, error) {
+	title := "nmaas-" + uid
+	pub, priv, err := generateDeployKeyPair(title)
+	if err != nil {
+		log.Print(err)
+		return nil, status.Errorf(codes.Internal, "Failed to generate deploy key")
+	}
+
+	key, _, err := s.gitAPI.DeployKeys.AddDeployKey(project.ID, &gitlab.AddDeployKeyOptions{
+		Title: gitlab.Ptr(title),
+		Key: gitlab.Ptr(pub),
+		CanPush: gitlab.Ptr(false),
+	})
+	if err != nil {
+		log.Print(err)
+		return nil, status.Errorf(codes.Internal, "Failed to add deploy key to Gitlab project")
+	}
+	logLine(fmt.Sprintf("Added deploy key %d to project %d", key.ID, project.ID))
+
+	secret := apiv1.Secret{}
+	secret.Type = apiv1.SecretTypeSSHAuth
+	secret.Data = map[string][]byte{
+		apiv1.SSHAuthPrivateKey: priv,
+		"ssh-publickey": []byte(pub),
+		"url": []byte(project.SSHURLToRepo),
+	}
+	secret.SetAnnotations(map[string]string{
+		repositoryAccessTypeAnnotation: v1.RepositoryAccessType_DEPLOY_KEY.String(),
+		repositoryProjectIdAnnotation: strconv.Itoa(project.ID),
+		repositoryCredentialIdAnnotation: strconv.Itoa(key.ID),
+	})
+	return &secret, nil
+}
+
+//Issue project access token allowed to read the repository and prepare secret holding it
+func (s *repositoryAccessServiceServer) issueAccessToken(project *gitlab.Project, uid string) (*apiv1.Secret, error) {
+	name := "nmaas-" + uid
+	expiresAt := gitlab.ISOTime(time.Now().AddDate(0, 0, accessTokenLifetimeDays))
+
+	token, _, err := s.gitAPI.ProjectAccessTokens.CreateProjectAccessToken(project.ID, &gitlab.CreateProjectAccessTokenOptions{
+		Name: gitlab.Ptr(name),
+		Scopes: gitlab.Ptr([]string{"read_repository"}),
+		AccessLevel: gitlab.Ptr(gitlab.ReporterPermissions),
+		ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		log.Print(err)
+		return nil, status.Errorf(codes.Internal, "Failed to create Gitlab project access token")
+	}
+	logLine(fmt.Sprintf("Created access token %d for project %d", token.ID, project.ID))
+
+	secret := apiv1.Secret{}
+	secret.Type = apiv1.SecretTypeBasicAuth
+	secret.Data = map[string][]byte{
+		apiv1.BasicAuthUsernameKey: []byte(name),
+		apiv1.BasicAuthPasswordKey: []byte(token.Token),
+		"url": []byte(project.HTTPURLToRepo),
+	}
+	secret.SetAnnotations(map[string]string{
+		repositoryAccessTypeAnnotation: v1.RepositoryAccessType_ACCESS_TOKEN.String(),
+		repositoryProjectIdAnnotation: strconv.Itoa(project.ID),
+		repositoryCredentialIdAnnotation: strconv.Itoa(token.ID),
+	})
+	return &secret, nil
+}
+
+//Revoke deploy key or access token referenced by the secret annotations
+func revokeRepositoryCredential(gitAPI *gitlab.Client, secret *apiv1.Secret) error {
+	annotations := secret.GetAnnotations()
+	projectId, err := strconv.Atoi(annotations[repositoryProjectIdAnnotation])
+	if err != nil {
+		return status.Errorf(codes.Internal, "Secret does not reference Gitlab project")
+	}
+	credentialId, err := strconv.Atoi(annotations[repositoryCredentialIdAnnotation])
+	if err != nil {
+		return status.Errorf(codes.Internal, "Secret does not reference Gitlab credential")
+	}
+
+	var resp *gitlab.Response
+	switch annotations[repositoryAccessTypeAnnotation] {
+	case v1.RepositoryAccessType_DEPLOY_KEY.String():
+		logLine(fmt.Sprintf("Removing deploy key %d from project %d", credentialId, projectId))
+		resp, err = gitAPI.DeployKeys.DeleteDeployKey(projectId, credentialId)
+	case v1.RepositoryAccessType_ACCESS_TOKEN.String():
+		logLine(fmt.Sprintf("Revoking access token %d of project %d", credentialId, projectId))
+		resp, err = gitAPI.ProjectAccessTokens.RevokeProjectAccessToken(projectId, credentialId)
+	default:
+		return status.Errorf(codes.Internal, "Unknown repository access type")
+	}
+
+	//credential already removed in GitLab, nothing more to do
+	if resp != nil && resp.StatusCode == 404 {
+		return nil
+	}
+	return err
+}
+
+//Revoke repository access issued for the instance and remove the secret holding it
+func revokeRepositoryAccess(ctx context.Context, kubeAPI kubernetes.Interface, gitAPI *gitlab.Client, namespace string, uid string) error {
+	secretName := getRepositoryAccessSecretName(uid)
+
+	secret, err := kubeAPI.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+
+	err = revokeRepositoryCredential(gitAPI, secret)
+	if err != nil {
+		log.Print(err)
+		return err
+	}
+
+	return kubeAPI.CoreV1().Secrets(namespace).Delete(ctx, secretName, metav1.DeleteOptions{})
+}
+
+//Recreate secret with credential of different type. When the new secret cannot be created, the previous one
+//is restored so that its credential stays recorded, the new credential is revoked as nothing references it.
+func (s *repositoryAccessServiceServer) replaceSecret(ctx context.Context, existing *apiv1.Secret, secret *apiv1.Secret) error {
+	err := s.kubeAPI.CoreV1().Secrets(existing.Namespace).Delete(ctx, existing.Name, metav1.DeleteOptions{})
+	if err != nil {
+		_ = revokeRepositoryCredential(s.gitAPI, secret)
+		return err
+	}
+	_, err = s.kubeAPI.CoreV1().Secrets(secret.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+	if err == nil {
+		return nil
+	}
+	_ = revokeRepositoryCredential(s.gitAPI, secret)
+
+	restored := existing.DeepCopy()
+	restored.ResourceVersion = ""
+	restored.UID = ""
+	if _, restoreErr := s.kubeAPI.CoreV1().Secrets(existing.Namespace).Create(ctx, restored, metav1.CreateOptions{}); restoreErr != nil {
+		//previous credential would not be referenced anymore, so it cannot be left valid
+		log.Print(restoreErr)
+		logLine(fmt.Sprintf("Failed to restore repository access secret %s, revoking its credential", existing.Name))
+		_ = revokeRepositoryCredential(s.gitAPI, existing)
+	}
+	return err
+}
+
+//Issue new repository credential of given type and store it in the instance secret, revoking the previous one
+func (s *repositoryAccessServiceServer) issue(ctx context.Context, depl *v1.Instance, accessType v1.RepositoryAccessType) (*v1.ServiceResponse, error) {
+	project, err := findGitlabProject(s.gitAPI, depl.Uid, depl.Domain)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Cannot find corresponding GitLab project"), err
+	}
+
+	var secret *apiv1.Secret
+	if accessType == v1.RepositoryAccessType_ACCESS_TOKEN {
+		secret, err = s.issueAccessToken(project, depl.Uid)
+	} else {
+		secret, err = s.issueDeployKey(project, depl.Uid)
+	}
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while issuing repository credential!"), err
+	}
+	secret.SetNamespace(depl.Namespace)
+	secret.SetName(getRepositoryAccessSecretName(depl.Uid))
+
+	existing, err := s.kubeAPI.CoreV1().Secrets(depl.Namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+	//Secret does not exist, we have to create it
+	if err != nil {
+		_, err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Create(ctx, secret, metav1.CreateOptions{})
+		if err != nil {
+			_ = revokeRepositoryCredential(s.gitAPI, secret)
+			return prepareResponse(v1.Status_FAILED, "Error while creating secret!"), err
+		}
+		return prepareResponse(v1.Status_OK, "Repository access created successfully"), nil
+	}
+
+	//secret type is immutable, so it has to be recreated when switching between key and token
+	if existing.Type != secret.Type {
+		err = s.replaceSecret(ctx, existing, secret)
+	} else {
+		_, err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		if err != nil {
+			_ = revokeRepositoryCredential(s.gitAPI, secret)
+		}
+	}
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while updating secret!"), err
+	}
+
+	//new credential is in place, the old one can be revoked
+	err = revokeRepositoryCredential(s.gitAPI, existing)
+	if err != nil {
+		log.Print(err)
+		logLine(fmt.Sprintf("Failed to revoke previous repository credential of %s", depl.Uid))
+	}
+	return prepareResponse(v1.Status_OK, "Repository access replaced successfully"), nil
+}
+
+func (s *repositoryAccessServiceServer) CreateOrReplace(ctx context.Context, req *v1.RepositoryAccessRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Instance
+	logLine(fmt.Sprintf("> Creating %s for instance:%s in namespace:%s", req.Type.String(), depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	return s.issue(ctx, depl, req.Type)
+}
+
+func (s *repositoryAccessServiceServer) Rotate(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+	logLine(fmt.Sprintf("> Rotating repository access for instance:%s in namespace:%s", depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	secret, err := s.kubeAPI.CoreV1().Secrets(depl.Namespace).Get(ctx, getRepositoryAccessSecretName(depl.Uid), metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Repository access does not exist"), err
+	}
+
+	accessType, ok := v1.RepositoryAccessType_value[secret.GetAnnotations()[repositoryAccessTypeAnnotation]]
+	if !ok {
+		return prepareResponse(v1.Status_FAILED, "Unknown repository access type"), status.Errorf(codes.FailedPrecondition, "Secret does not define repository access type")
+	}
+
+	return s.issue(ctx, depl, v1.RepositoryAccessType(accessType))
+}
+
+func (s *repositoryAccessServiceServer) DeleteIfExists(ctx context.Context, req *v1.InstanceRequest) (*v1.ServiceResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, namespaceNotFound), err
+	}
+
+	//check if secret exist
+	_, err = s.kubeAPI.CoreV1().Secrets(depl.Namespace).Get(ctx, getRepositoryAccessSecretName(depl.Uid), metav1.GetOptions{})
+	if err != nil {
+		return prepareResponse(v1.Status_OK, "Repository access does not exist"), nil
+	}
+
+	err = revokeRepositoryAccess(ctx, s.kubeAPI, s.gitAPI, depl.Namespace, depl.Uid)
+	if err != nil {
+		return prepareResponse(v1.Status_FAILED, "Error while revoking repository access!"), err
+	}
+	return prepareResponse(v1.Status_OK, "Repository access revoked successfully"), nil
+}
@@ -0,0 +1,212 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/xanzy/go-gitlab"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//Minimal GitLab API serving a single project and recording revoked credentials
+func newFakeGitlab(t *testing.T, revoked *[]string) *gitlab.Client {
+	credentialId := 0
+	handler := http.NewServeMux()
+	handler.HandleFunc("/api/v4/groups", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id": 1, "name": "groups-test-domain"}]`)
+	})
+	handler.HandleFunc("/api/v4/projects/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/v4/projects/")
+		switch {
+		case path == "groups-test-domain%2Ftest-uid" && r.Method == http.MethodGet:
+			fmt.Fprint(w, `{"id": 42, "ssh_url_to_repo": "git@gitlab:groups-test-domain/test-uid.git", "http_url_to_repo": "https://gitlab/groups-test-domain/test-uid.git"}`)
+		case (path == "42/deploy_keys" || path == "42/access_tokens") && r.Method == http.MethodPost:
+			credentialId++
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"id": %d, "token": "glpat-%d"}`, credentialId, credentialId)
+		case r.Method == http.MethodDelete:
+			*revoked = append(*revoked, path)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestRepositoryAccessServiceServer_CreateOrReplace(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	revoked := make([]string, 0)
+	server := NewRepositoryAccessServiceServer(client, newFakeGitlab(t, &revoked))
+
+	//Fail on API version check
+	illreq := v1.RepositoryAccessRequest{Api: "illegal", Instance: &inst}
+	res, err := server.CreateOrReplace(context.Background(), &illreq)
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	freq := v1.RepositoryAccessRequest{Api: apiVersion, Instance: &fake_ns_inst}
+	res, err = server.CreateOrReplace(context.Background(), &freq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//create mock namespace
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Should create deploy key secret
+	keyReq := v1.RepositoryAccessRequest{Api: apiVersion, Instance: &inst, Type: v1.RepositoryAccessType_DEPLOY_KEY}
+	res, err = server.CreateOrReplace(context.Background(), &keyReq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+
+	sec, err := client.CoreV1().Secrets("test-namespace").Get(context.Background(), getRepositoryAccessSecretName("test-uid"), metav1.GetOptions{})
+	if err != nil || sec.Type != corev1.SecretTypeSSHAuth || !strings.Contains(string(sec.Data[corev1.SSHAuthPrivateKey]), "OPENSSH PRIVATE KEY") {
+		t.Fail()
+	}
+
+	//Should replace deploy key with access token and revoke the key
+	tokenReq := v1.RepositoryAccessRequest{Api: apiVersion, Instance: &inst, Type: v1.RepositoryAccessType_ACCESS_TOKEN}
+	res, err = server.CreateOrReplace(context.Background(), &tokenReq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+
+	sec, err = client.CoreV1().Secrets("test-namespace").Get(context.Background(), getRepositoryAccessSecretName("test-uid"), metav1.GetOptions{})
+	if err != nil || sec.Type != corev1.SecretTypeBasicAuth || string(sec.Data[corev1.BasicAuthPasswordKey]) != "glpat-2" {
+		t.Fail()
+	}
+	if len(revoked) != 1 || revoked[0] != "42/deploy_keys/1" {
+		t.Fail()
+	}
+
+	//Should rotate access token
+	res, err = server.Rotate(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+	if len(revoked) != 2 || revoked[1] != "42/access_tokens/2" {
+		t.Fail()
+	}
+}
+
+func TestRepositoryAccessServiceServer_DeleteIfExists(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	revoked := make([]string, 0)
+	server := NewRepositoryAccessServiceServer(client, newFakeGitlab(t, &revoked))
+
+	//Fail on API version check
+	res, err := server.DeleteIfExists(context.Background(), &illegal_req)
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//create mock namespace
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	//Pass if already nonexistent
+	res, err = server.DeleteIfExists(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+
+	//Rotate should fail without existing access
+	res, err = server.Rotate(context.Background(), &req)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//create mock secret
+	sec := corev1.Secret{}
+	sec.Name = getRepositoryAccessSecretName("test-uid")
+	sec.SetAnnotations(map[string]string{
+		repositoryAccessTypeAnnotation: v1.RepositoryAccessType_DEPLOY_KEY.String(),
+		repositoryProjectIdAnnotation: "42",
+		repositoryCredentialIdAnnotation: "5",
+	})
+	_, _ = client.CoreV1().Secrets("test-namespace").Create(context.Background(), &sec, metav1.CreateOptions{})
+
+	//Should revoke key and remove secret, also when cleaning up config
+	config := NewConfigServiceServer(client, server.(*repositoryAccessServiceServer).gitAPI)
+	res, err = config.DeleteIfExists(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fail()
+	}
+	if len(revoked) != 1 || revoked[0] != "42/deploy_keys/5" {
+		t.Fail()
+	}
+	_, err = client.CoreV1().Secrets("test-namespace").Get(context.Background(), sec.Name, metav1.GetOptions{})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestRepositoryAccessServiceServer_SwitchTypeCreateFailure(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	revoked := make([]string, 0)
+	server := NewRepositoryAccessServiceServer(client, newFakeGitlab(t, &revoked))
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	keyReq := v1.RepositoryAccessRequest{Api: apiVersion, Instance: &inst, Type: v1.RepositoryAccessType_DEPLOY_KEY}
+	res, err := server.CreateOrReplace(context.Background(), &keyReq)
+	if err != nil || res.Status != v1.Status_OK {
+		t.Fatal(err)
+	}
+
+	//creation of the access token secret fails, restoring the deploy key secret succeeds
+	failed := false
+	client.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failed {
+			return false, nil, nil
+		}
+		failed = true
+		return true, nil, errors.New("admission webhook denied the request")
+	})
+
+	tokenReq := v1.RepositoryAccessRequest{Api: apiVersion, Instance: &inst, Type: v1.RepositoryAccessType_ACCESS_TOKEN}
+	res, err = server.CreateOrReplace(context.Background(), &tokenReq)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	//deploy key stays recorded and valid, the unused access token is revoked
+	sec, err := client.CoreV1().Secrets("test-namespace").Get(context.Background(), getRepositoryAccessSecretName("test-uid"), metav1.GetOptions{})
+	if err != nil || sec.Type != corev1.SecretTypeSSHAuth || sec.Annotations[repositoryCredentialIdAnnotation] != "1" {
+		t.Fatalf("previous secret not restored %v, %v", sec, err)
+	}
+	if len(revoked) != 1 || revoked[0] != "42/access_tokens/2" {
+		t.Errorf("unexpected revoked credentials %v", revoked)
+	}
+
+	//the restored credential can still be revoked
+	res, err = server.DeleteIfExists(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || len(revoked) != 2 || revoked[1] != "42/deploy_keys/1" {
+		t.Errorf("unexpected revoked credentials %v", revoked)
+	}
+}
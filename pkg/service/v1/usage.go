@@ -0,0 +1,152 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	"time"
+
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+)
+
+const metricsUnavailable = "Metrics API is not available, metrics-server is probably not installed in the cluster. Only resource requests and limits are reported"
+
+//Prepare resource usage response
+func prepareResourceUsageResponse(status v1.Status, message string, metricsAvailable bool, pods []*v1.PodResourceUsage) *v1.ResourceUsageResponse {
+	if pods == nil {
+		pods = make([]*v1.PodResourceUsage, 0)
+	}
+	total := &v1.ResourceUsage{}
+	for _, pod := range pods {
+		addResourceUsage(total, pod.Total)
+	}
+	return &v1.ResourceUsageResponse{
+		Api: apiVersion,
+		Status: status,
+		Message: message,
+		MetricsAvailable: metricsAvailable,
+		Pods: pods,
+		Total: total,
+	}
+}
+
+func addResourceUsage(total *v1.ResourceUsage, usage *v1.ResourceUsage) {
+	total.CpuUsageMillicores += usage.CpuUsageMillicores
+	total.MemoryUsageBytes += usage.MemoryUsageBytes
+	total.CpuRequestMillicores += usage.CpuRequestMillicores
+	total.CpuLimitMillicores += usage.CpuLimitMillicores
+	total.MemoryRequestBytes += usage.MemoryRequestBytes
+	total.MemoryLimitBytes += usage.MemoryLimitBytes
+}
+
+//Resource requests and limits of container spec, zero when not set
+func containerResources(container *apiv1.Container) *v1.ResourceUsage {
+	usage := &v1.ResourceUsage{}
+	if cpu, ok := container.Resources.Requests[apiv1.ResourceCPU]; ok {
+		usage.CpuRequestMillicores = cpu.MilliValue()
+	}
+	if cpu, ok := container.Resources.Limits[apiv1.ResourceCPU]; ok {
+		usage.CpuLimitMillicores = cpu.MilliValue()
+	}
+	if memory, ok := container.Resources.Requests[apiv1.ResourceMemory]; ok {
+		usage.MemoryRequestBytes = memory.Value()
+	}
+	if memory, ok := container.Resources.Limits[apiv1.ResourceMemory]; ok {
+		usage.MemoryLimitBytes = memory.Value()
+	}
+	return usage
+}
+
+//Describe usage of pod containers next to their requests and limits, metrics are nil when not yet collected for the pod
+func podResourceUsage(pod *apiv1.Pod, metrics *metricsv1beta1.PodMetrics) *v1.PodResourceUsage {
+	usage := &v1.PodResourceUsage{Name: pod.Name, Containers: make([]*v1.ContainerResourceUsage, 0), Total: &v1.ResourceUsage{}}
+	measured := make(map[string]apiv1.ResourceList)
+	if metrics != nil {
+		usage.MetricsAvailable = true
+		usage.Timestamp = metrics.Timestamp.UTC().Format(time.RFC3339)
+		usage.WindowSeconds = int64(metrics.Window.Duration.Seconds())
+		for _, container := range metrics.Containers {
+			measured[container.Name] = container.Usage
+		}
+	}
+
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		resources := containerResources(container)
+		if cpu, ok := measured[container.Name][apiv1.ResourceCPU]; ok {
+			resources.CpuUsageMillicores = cpu.MilliValue()
+		}
+		if memory, ok := measured[container.Name][apiv1.ResourceMemory]; ok {
+			resources.MemoryUsageBytes = memory.Value()
+		}
+		usage.Containers = append(usage.Containers, &v1.ContainerResourceUsage{Name: container.Name, Usage: resources})
+		addResourceUsage(usage.Total, resources)
+	}
+	return usage
+}
+
+//Check if error means that metrics.k8s.io API is not served, which is the case when metrics-server is missing or down
+func isMetricsUnavailable(err error) bool {
+	return errors.IsNotFound(err) || errors.IsServiceUnavailable(err) || errors.IsMethodNotSupported(err)
+}
+
+func (s *podServiceServer) RetrieveResourceUsage(ctx context.Context, req *v1.InstanceRequest) (*v1.ResourceUsageResponse, error) {
+	// check if the API version requested by client is supported by server
+	if err := checkAPI(req.Api, apiVersion); err != nil {
+		return nil, err
+	}
+
+	depl := req.Deployment
+	logLine(fmt.Sprintf("> Retrieving resource usage of instance %s in namespace %s", depl.Uid, depl.Namespace))
+
+	//check if given k8s namespace exists
+	_, err := s.kubeAPI.CoreV1().Namespaces().Get(ctx, depl.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return prepareResourceUsageResponse(v1.Status_FAILED, namespaceNotFound, false, nil), err
+	}
+
+	pods, err := findInstancePodsBySelector(ctx, s.kubeAPI, depl.Namespace, depl.Uid, s.instanceLabel)
+	if err != nil {
+		return prepareResourceUsageResponse(v1.Status_FAILED, "Issue with collecting pods", false, nil), err
+	}
+
+	metrics := make(map[string]*metricsv1beta1.PodMetrics)
+	available := s.metricsAPI != nil
+	if available {
+		list, err := s.metricsAPI.MetricsV1beta1().PodMetricses(depl.Namespace).List(ctx, metav1.ListOptions{})
+		if err != nil && !isMetricsUnavailable(err) {
+			return prepareResourceUsageResponse(v1.Status_FAILED, "Issue with retrieving pod metrics", false, nil), err
+		}
+		available = err == nil
+		if available {
+			for i := range list.Items {
+				metrics[list.Items[i].Name] = &list.Items[i]
+			}
+		}
+	}
+
+	usage := make([]*v1.PodResourceUsage, 0, len(pods))
+	measured := 0
+	for i := range pods {
+		podUsage := podResourceUsage(&pods[i], metrics[pods[i].Name])
+		if podUsage.MetricsAvailable {
+			measured++
+		}
+		usage = append(usage, podUsage)
+	}
+
+	if !available {
+		logLine("< " + metricsUnavailable)
+		return prepareResourceUsageResponse(v1.Status_FAILED, metricsUnavailable, false, usage), nil
+	}
+	message := fmt.Sprintf("Retrieved usage of %d pod(s)", measured)
+	if measured < len(pods) {
+		//metrics of new pods appear after the first scrape
+		message += fmt.Sprintf(", metrics of %d pod(s) are not collected yet", len(pods)-measured)
+	}
+	logLine("< " + message)
+	return prepareResourceUsageResponse(v1.Status_OK, message, true, usage), nil
+}
@@ -0,0 +1,134 @@
+package v1
+
+import (
+	v1 "bitbucket.software.geant.org/projects/NMAAS/repos/nmaas-janitor/pkg/api/v1"
+	"context"
+	"errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	metricsv1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	metricsfake "k8s.io/metrics/pkg/client/clientset/versioned/fake"
+	"testing"
+	"time"
+)
+
+func createTestPodMetrics(name string, usage map[string]corev1.ResourceList) *metricsv1beta1.PodMetrics {
+	metrics := &metricsv1beta1.PodMetrics{}
+	metrics.Name = name
+	metrics.Namespace = "test-namespace"
+	metrics.Timestamp = metav1.NewTime(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC))
+	metrics.Window = metav1.Duration{Duration: 30 * time.Second}
+	for container, resources := range usage {
+		metrics.Containers = append(metrics.Containers, metricsv1beta1.ContainerMetrics{Name: container, Usage: resources})
+	}
+	return metrics
+}
+
+func TestPodResourceUsage(t *testing.T) {
+	pod := corev1.Pod{}
+	pod.Name = "test-uid-web"
+	pod.Spec.Containers = []corev1.Container{
+		{Name: "app", Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("250m"), corev1.ResourceMemory: resource.MustParse("128Mi")},
+			Limits: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1"), corev1.ResourceMemory: resource.MustParse("256Mi")},
+		}},
+		{Name: "proxy"},
+	}
+
+	usage := podResourceUsage(&pod, nil)
+	if usage.MetricsAvailable || len(usage.Containers) != 2 || usage.Total.CpuRequestMillicores != 250 ||
+		usage.Total.CpuLimitMillicores != 1000 || usage.Total.MemoryLimitBytes != 256*1024*1024 {
+		t.Errorf("unexpected usage %v", usage)
+	}
+
+	metrics := createTestPodMetrics("test-uid-web", map[string]corev1.ResourceList{
+		"app": {corev1.ResourceCPU: resource.MustParse("120m"), corev1.ResourceMemory: resource.MustParse("100Mi")},
+		"proxy": {corev1.ResourceCPU: resource.MustParse("5m"), corev1.ResourceMemory: resource.MustParse("10Mi")},
+	})
+	usage = podResourceUsage(&pod, metrics)
+	if !usage.MetricsAvailable || usage.Timestamp != "2024-05-01T10:00:00Z" || usage.WindowSeconds != 30 {
+		t.Errorf("unexpected usage %v", usage)
+	}
+	if usage.Containers[0].Usage.CpuUsageMillicores != 120 || usage.Containers[1].Usage.MemoryUsageBytes != 10*1024*1024 ||
+		usage.Total.CpuUsageMillicores != 125 || usage.Total.MemoryUsageBytes != 110*1024*1024 {
+		t.Errorf("unexpected usage %v", usage)
+	}
+}
+
+func TestPodServiceServer_RetrieveResourceUsage(t *testing.T) {
+	client := testclient.NewSimpleClientset()
+	metricsClient := metricsfake.NewSimpleClientset()
+	server := NewPodServiceServer(client, metricsClient, "")
+
+	//Fail on API version check
+	res, err := server.RetrieveResourceUsage(context.Background(), &illegal_req)
+	if err == nil || res != nil {
+		t.Fail()
+	}
+
+	//Fail on namespace check
+	res, err = server.RetrieveResourceUsage(context.Background(), &v1.InstanceRequest{Api: apiVersion, Deployment: &fake_ns_inst})
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Fail()
+	}
+
+	ns := corev1.Namespace{}
+	ns.Name = "test-namespace"
+	_, _ = client.CoreV1().Namespaces().Create(context.Background(), &ns, metav1.CreateOptions{})
+
+	for _, name := range []string{"test-uid-web", "test-uid-worker"} {
+		pod := corev1.Pod{}
+		pod.Name = name
+		pod.Labels = map[string]string{"app.kubernetes.io/instance": "test-uid"}
+		pod.Spec.Containers = []corev1.Container{{Name: "app", Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")},
+		}}}
+		_, _ = client.CoreV1().Pods("test-namespace").Create(context.Background(), &pod, metav1.CreateOptions{})
+	}
+
+	//fake metrics client serves pod metrics under the "pods" resource of metrics.k8s.io
+	podMetrics := schema.GroupVersionResource{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "pods"}
+	_ = metricsClient.Tracker().Create(podMetrics, createTestPodMetrics("test-uid-web", map[string]corev1.ResourceList{
+		"app": {corev1.ResourceCPU: resource.MustParse("200m"), corev1.ResourceMemory: resource.MustParse("50Mi")},
+	}), "test-namespace")
+
+	res, err = server.RetrieveResourceUsage(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_OK || !res.MetricsAvailable || len(res.Pods) != 2 {
+		t.Fatalf("unexpected response %v, %v", res, err)
+	}
+	if !res.Pods[0].MetricsAvailable || res.Pods[1].MetricsAvailable || res.Total.CpuUsageMillicores != 200 ||
+		res.Total.MemoryUsageBytes != 50*1024*1024 || res.Total.MemoryRequestBytes != 128*1024*1024 {
+		t.Errorf("unexpected response %v", res)
+	}
+
+	//missing metrics-server is reported without error, requests and limits are still returned
+	metricsClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(schema.GroupResource{Group: "metrics.k8s.io", Resource: "pods"}, "")
+	})
+	res, err = server.RetrieveResourceUsage(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_FAILED || res.MetricsAvailable || res.Message != metricsUnavailable ||
+		len(res.Pods) != 2 || res.Total.MemoryRequestBytes != 128*1024*1024 || res.Total.CpuUsageMillicores != 0 {
+		t.Errorf("unexpected response %v, %v", res, err)
+	}
+
+	//other errors fail the request
+	metricsClient.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	res, err = server.RetrieveResourceUsage(context.Background(), &req)
+	if err == nil || res.Status != v1.Status_FAILED {
+		t.Errorf("unexpected response %v, %v", res, err)
+	}
+
+	//server without metrics client reports the same as missing metrics-server
+	res, err = NewPodServiceServer(client, nil, "").RetrieveResourceUsage(context.Background(), &req)
+	if err != nil || res.Status != v1.Status_FAILED || res.MetricsAvailable || len(res.Pods) != 2 {
+		t.Errorf("unexpected response %v, %v", res, err)
+	}
+}